@@ -0,0 +1,260 @@
+package vuvuzela
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"sort"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The admin RPC lets an operator control a running server with
+// vuvuzelactl. It listens on its own address and every call carries
+// the operator's token.
+
+type AdminArgs struct {
+	Token string
+
+	// Service is "convo" or "dial" ("" means both, where that makes
+	// sense). SetNoise also accepts "mailbox".
+	Service string
+	Round   uint32
+
+	Mu float64
+	B  float64
+}
+
+type AdminRound struct {
+	Service string
+	Round   uint32
+	Status  string
+	Onions  int
+}
+
+type AdminReply struct {
+	Message    string
+	Rounds     []AdminRound
+	Clients    int
+	NoiseAudit []NoiseAuditStats
+}
+
+// CheckAdminAddr refuses admin addresses that aren't loopback, since the
+// admin RPC (token included) isn't encrypted.
+func CheckAdminAddr(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("bad admin address: %s", err)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	return fmt.Errorf("admin address %q is not loopback, and the admin RPC sends its token in the clear", addr)
+}
+
+func CheckAdminToken(want string, args *AdminArgs) error {
+	if want == "" || subtle.ConstantTimeCompare([]byte(want), []byte(args.Token)) != 1 {
+		return fmt.Errorf("bad admin token")
+	}
+	return nil
+}
+
+// ServerAdmin is the admin service for vuvuzela-server.
+type ServerAdmin struct {
+	Token   string
+	PKIPath string
+	Convo   *ConvoService
+	Dial    *DialService
+	Auditor *NoiseAuditor
+
+	Transcripts *TranscriptService
+}
+
+func (a *ServerAdmin) check(rpc string, args *AdminArgs) error {
+	if err := CheckAdminToken(a.Token, args); err != nil {
+		log.WithFields(log.Fields{"service": "admin", "rpc": rpc}).Warn(err)
+		return err
+	}
+	log.WithFields(log.Fields{"service": "admin", "rpc": rpc, "round": args.Round}).Info(args.Service)
+	return nil
+}
+
+func (a *ServerAdmin) setPaused(args *AdminArgs, paused int32) error {
+	switch args.Service {
+	case "convo":
+		atomic.StoreInt32(&a.Convo.paused, paused)
+	case "dial":
+		atomic.StoreInt32(&a.Dial.paused, paused)
+	case "":
+		atomic.StoreInt32(&a.Convo.paused, paused)
+		atomic.StoreInt32(&a.Dial.paused, paused)
+	default:
+		return fmt.Errorf("unknown service: %q", args.Service)
+	}
+	return nil
+}
+
+// Pause makes NewRound fail until Resume. Rounds already started finish.
+func (a *ServerAdmin) Pause(args *AdminArgs, reply *AdminReply) error {
+	if err := a.check("Pause", args); err != nil {
+		return err
+	}
+	return a.setPaused(args, 1)
+}
+
+func (a *ServerAdmin) Resume(args *AdminArgs, reply *AdminReply) error {
+	if err := a.check("Resume", args); err != nil {
+		return err
+	}
+	return a.setPaused(args, 0)
+}
+
+func (a *ServerAdmin) Rounds(args *AdminArgs, reply *AdminReply) error {
+	if err := a.check("Rounds", args); err != nil {
+		return err
+	}
+
+	a.Convo.roundsMu.RLock()
+	for n, r := range a.Convo.rounds {
+		r.Lock()
+		reply.Rounds = append(reply.Rounds, AdminRound{
+			Service: "convo",
+			Round:   n,
+			Status:  r.status.String(),
+			Onions:  r.numIncoming,
+		})
+		r.Unlock()
+	}
+	a.Convo.roundsMu.RUnlock()
+
+	// The last server keeps closed dial rounds for Buckets, so only
+	// list the ones still in progress.
+	closed := 0
+	a.Dial.roundsMu.RLock()
+	for n, r := range a.Dial.rounds {
+		r.Lock()
+		status := r.status
+		onions := r.numIncoming
+		r.Unlock()
+		if status == dialRoundClosed {
+			closed++
+			continue
+		}
+		reply.Rounds = append(reply.Rounds, AdminRound{
+			Service: "dial",
+			Round:   n,
+			Status:  status.String(),
+			Onions:  onions,
+		})
+	}
+	a.Dial.roundsMu.RUnlock()
+
+	sort.Slice(reply.Rounds, func(i, j int) bool {
+		return reply.Rounds[i].Round < reply.Rounds[j].Round
+	})
+	reply.Message = fmt.Sprintf("%d closed dial rounds not shown", closed)
+	return nil
+}
+
+// Abort deletes a round and lets the next one start if this round was
+// holding up the server. Further calls for the round fail.
+func (a *ServerAdmin) Abort(args *AdminArgs, reply *AdminReply) error {
+	if err := a.check("Abort", args); err != nil {
+		return err
+	}
+
+	switch args.Service {
+	case "convo":
+		srv := a.Convo
+		srv.roundsMu.Lock()
+		r, ok := srv.rounds[args.Round]
+		delete(srv.rounds, args.Round)
+		srv.roundsMu.Unlock()
+		if !ok {
+			return fmt.Errorf("round %d not found", args.Round)
+		}
+		r.releaseIdle()
+	case "dial":
+		srv := a.Dial
+		srv.roundsMu.Lock()
+		r, ok := srv.rounds[args.Round]
+		delete(srv.rounds, args.Round)
+		srv.roundsMu.Unlock()
+		if !ok {
+			return fmt.Errorf("round %d not found", args.Round)
+		}
+		r.releaseIdle()
+	default:
+		return fmt.Errorf("unknown service: %q", args.Service)
+	}
+	reply.Message = fmt.Sprintf("aborted %s round %d", args.Service, args.Round)
+	return nil
+}
+
+// SetNoise changes the noise parameters starting with the next round.
+func (a *ServerAdmin) SetNoise(args *AdminArgs, reply *AdminReply) error {
+	if err := a.check("SetNoise", args); err != nil {
+		return err
+	}
+	if args.Mu < 0 || args.B <= 0 {
+		return fmt.Errorf("bad noise parameters: mu=%v b=%v", args.Mu, args.B)
+	}
+
+	switch args.Service {
+	case "convo":
+		a.Convo.noiseMu.Lock()
+		a.Convo.LaplaceMu, a.Convo.LaplaceB = args.Mu, args.B
+		a.Convo.noiseMu.Unlock()
+	case "mailbox":
+		a.Convo.noiseMu.Lock()
+		a.Convo.MailboxMu, a.Convo.MailboxB = args.Mu, args.B
+		a.Convo.noiseMu.Unlock()
+	case "dial":
+		a.Dial.noiseMu.Lock()
+		a.Dial.LaplaceMu, a.Dial.LaplaceB = args.Mu, args.B
+		a.Dial.noiseMu.Unlock()
+	default:
+		return fmt.Errorf("unknown service: %q", args.Service)
+	}
+	reply.Message = fmt.Sprintf("%s noise: mu=%v b=%v", args.Service, args.Mu, args.B)
+	return nil
+}
+
+// ReloadPKI rereads the PKI file. Keys and the epoch can change, but
+// changing the servers or their addresses needs a restart.
+func (a *ServerAdmin) ReloadPKI(args *AdminArgs, reply *AdminReply) error {
+	if err := a.check("ReloadPKI", args); err != nil {
+		return err
+	}
+
+	pki, err := LoadPKI(a.PKIPath)
+	if err != nil {
+		return err
+	}
+	if err := SameServers(a.Convo.pki(), pki); err != nil {
+		return err
+	}
+	a.Convo.SetPKI(pki)
+	a.Dial.SetPKI(pki)
+	a.Auditor.SetPKI(pki)
+	a.Transcripts.SetPKI(pki)
+	reply.Message = fmt.Sprintf("loaded %s (epoch %d)", a.PKIPath, pki.Epoch)
+	return nil
+}
+
+// NoiseAudit reports how the previous server's noise has checked out.
+func (a *ServerAdmin) NoiseAudit(args *AdminArgs, reply *AdminReply) error {
+	if err := a.check("NoiseAudit", args); err != nil {
+		return err
+	}
+	if a.Auditor == nil {
+		reply.Message = "the first server has no noise to audit"
+		return nil
+	}
+	reply.NoiseAudit = a.Auditor.Stats()
+	return nil
+}
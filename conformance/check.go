@@ -0,0 +1,308 @@
+package conformance
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"golang.org/x/crypto/nacl/box"
+
+	. "github.com/davidlazar/vuvuzela"
+	"github.com/davidlazar/vuvuzela/onionbox"
+)
+
+// Implementation is the code under test. Keys and nonces are 32 and 24
+// bytes. Other implementations can be checked by wrapping them in this
+// interface, or by reading the vectors file directly.
+type Implementation interface {
+	ForwardNonce(round uint32) []byte
+	BackwardNonce(round uint32) []byte
+	ConvoNonce(round uint32, role byte) []byte
+	ConvoRole(myPublicKey, peerPublicKey []byte) byte
+	ConvoDeadDrop(myPrivateKey, peerPublicKey []byte, round uint32) []byte
+	MailboxDeadDrop(myPrivateKey, peerPublicKey []byte, senderRole byte, window uint32) []byte
+	KeyDialBucket(publicKey []byte, buckets uint32) uint32
+
+	// SealMessage encrypts a conversation message with box.
+	SealMessage(message, nonce, peerPublicKey, myPrivateKey []byte) []byte
+	MarshalConvoExchange(deadDrop []byte, mode uint8, encryptedMessage []byte) []byte
+	MarshalIntroduction(rendezvous uint32, longTermKey []byte, scheduleDelay uint32, note []byte) []byte
+	MarshalDialExchange(bucket uint32, encryptedIntro []byte) []byte
+
+	// SealOnion wraps message in one layer per server, using the given
+	// ephemeral private keys.
+	SealOnion(message, nonce []byte, publicKeys, ephemeralKeys [][]byte) []byte
+	// OpenReply removes the servers' layers from a reply.
+	OpenReply(reply, nonce []byte, sharedKeys [][]byte) ([]byte, bool)
+
+	// ConvoRoundMessage and DialRoundMessage are what the first server
+	// signs in round announcements.
+	ConvoRoundMessage(round, epoch uint32, timestamp int64) []byte
+	DialRoundMessage(round, buckets, epoch uint32, timestamp int64) []byte
+
+	// ParseEnvelope decodes an envelope from the entry server and
+	// encodes it again.
+	ParseEnvelope(data []byte) ([]byte, error)
+}
+
+// Reference is this repository's implementation.
+type Reference struct{}
+
+func key32(b []byte) *[32]byte {
+	k := new([32]byte)
+	copy(k[:], b)
+	return k
+}
+
+func nonce24(b []byte) *[24]byte {
+	n := new([24]byte)
+	copy(n[:], b)
+	return n
+}
+
+func boxKey(b []byte) *BoxKey {
+	return (*BoxKey)(key32(b))
+}
+
+func (Reference) ForwardNonce(round uint32) []byte {
+	return ForwardNonce(round)[:]
+}
+
+func (Reference) BackwardNonce(round uint32) []byte {
+	return BackwardNonce(round)[:]
+}
+
+func (Reference) ConvoNonce(round uint32, role byte) []byte {
+	return ConvoNonce(round, role)[:]
+}
+
+func (Reference) ConvoRole(myPublicKey, peerPublicKey []byte) byte {
+	return ConvoRole(boxKey(myPublicKey), boxKey(peerPublicKey))
+}
+
+func (Reference) ConvoDeadDrop(myPrivateKey, peerPublicKey []byte, round uint32) []byte {
+	drop := ConvoDeadDrop(boxKey(myPrivateKey), boxKey(peerPublicKey), round)
+	return drop[:]
+}
+
+func (Reference) MailboxDeadDrop(myPrivateKey, peerPublicKey []byte, senderRole byte, window uint32) []byte {
+	drop := MailboxDeadDrop(boxKey(myPrivateKey), boxKey(peerPublicKey), senderRole, window)
+	return drop[:]
+}
+
+func (Reference) KeyDialBucket(publicKey []byte, buckets uint32) uint32 {
+	return KeyDialBucket(boxKey(publicKey), buckets)
+}
+
+func (Reference) SealMessage(message, nonce, peerPublicKey, myPrivateKey []byte) []byte {
+	return box.Seal(nil, message, nonce24(nonce), key32(peerPublicKey), key32(myPrivateKey))
+}
+
+func (Reference) MarshalConvoExchange(deadDrop []byte, mode uint8, encryptedMessage []byte) []byte {
+	ex := &ConvoExchange{Mode: ExchangeMode(mode)}
+	copy(ex.DeadDrop[:], deadDrop)
+	copy(ex.EncryptedMessage[:], encryptedMessage)
+	return ex.Marshal()
+}
+
+func (Reference) MarshalIntroduction(rendezvous uint32, longTermKey []byte, scheduleDelay uint32, note []byte) []byte {
+	intro := &Introduction{Rendezvous: rendezvous, ScheduleDelay: scheduleDelay}
+	copy(intro.LongTermKey[:], longTermKey)
+	copy(intro.Note[:], note)
+	return intro.Marshal()
+}
+
+func (Reference) MarshalDialExchange(bucket uint32, encryptedIntro []byte) []byte {
+	ex := &DialExchange{Bucket: bucket}
+	copy(ex.EncryptedIntro[:], encryptedIntro)
+	return ex.Marshal()
+}
+
+func (Reference) SealOnion(message, nonce []byte, publicKeys, ephemeralKeys [][]byte) []byte {
+	pks := make([]*[32]byte, len(publicKeys))
+	eks := make([]*[32]byte, len(ephemeralKeys))
+	for i := range pks {
+		pks[i] = key32(publicKeys[i])
+		eks[i] = key32(ephemeralKeys[i])
+	}
+	onion, _ := onionbox.SealWithKeys(message, nonce24(nonce), pks, eks)
+	return onion
+}
+
+func (Reference) OpenReply(reply, nonce []byte, sharedKeys [][]byte) ([]byte, bool) {
+	keys := make([]*[32]byte, len(sharedKeys))
+	for i := range keys {
+		keys[i] = key32(sharedKeys[i])
+	}
+	return onionbox.Open(reply, nonce24(nonce), keys)
+}
+
+func (Reference) ConvoRoundMessage(round, epoch uint32, timestamp int64) []byte {
+	return ConvoRoundMessage(round, epoch, timestamp)
+}
+
+func (Reference) DialRoundMessage(round, buckets, epoch uint32, timestamp int64) []byte {
+	return DialRoundMessage(round, buckets, epoch, timestamp)
+}
+
+func (Reference) ParseEnvelope(data []byte) ([]byte, error) {
+	env := new(Envelope)
+	if err := json.Unmarshal(data, env); err != nil {
+		return nil, err
+	}
+	v, err := env.Open()
+	if err != nil {
+		return nil, err
+	}
+	env, err = Envelop(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(env)
+}
+
+func ReadVectors(path string) (*Vectors, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	v := new(Vectors)
+	if err := json.Unmarshal(data, v); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if v.Version != Version {
+		return nil, fmt.Errorf("%s: vectors are version %d, expecting %d", path, v.Version, Version)
+	}
+	return v, nil
+}
+
+type checker struct {
+	errs []error
+}
+
+func (c *checker) bytes(what string, got, want []byte) {
+	if !bytes.Equal(got, want) {
+		c.errs = append(c.errs, fmt.Errorf("%s: got %x, want %x", what, got, want))
+	}
+}
+
+func (c *checker) uint(what string, got, want uint32) {
+	if got != want {
+		c.errs = append(c.errs, fmt.Errorf("%s: got %d, want %d", what, got, want))
+	}
+}
+
+func (c *checker) announcement(e EnvelopeVector, impl Implementation, verifyKey []byte) {
+	env := new(Envelope)
+	if err := json.Unmarshal([]byte(e.Envelope), env); err != nil {
+		return
+	}
+	v, err := env.Open()
+	if err != nil {
+		return
+	}
+	var msg, sig []byte
+	switch a := v.(type) {
+	case *AnnounceConvoRound:
+		msg, sig = impl.ConvoRoundMessage(a.Round, a.Epoch, a.Timestamp), a.Signature
+	case *AnnounceDialRound:
+		msg, sig = impl.DialRoundMessage(a.Round, a.Buckets, a.Epoch, a.Timestamp), a.Signature
+	default:
+		return
+	}
+	if !ed25519.Verify(ed25519.PublicKey(verifyKey), msg, sig) {
+		c.errs = append(c.errs, fmt.Errorf("%s: signature doesn't verify over %x", e.Name, msg))
+	}
+}
+
+// Check runs impl against the vectors and returns every mismatch.
+func Check(v *Vectors, impl Implementation) []error {
+	c := new(checker)
+
+	for i, s := range v.Servers {
+		c.bytes(fmt.Sprintf("Servers[%d] public key", i), publicKey(s.Private), s.Public)
+	}
+
+	for _, n := range v.Nonces {
+		c.bytes(fmt.Sprintf("ForwardNonce(%d)", n.Round), impl.ForwardNonce(n.Round), n.Forward)
+		c.bytes(fmt.Sprintf("BackwardNonce(%d)", n.Round), impl.BackwardNonce(n.Round), n.Backward)
+		for role := range n.Convo {
+			c.bytes(fmt.Sprintf("ConvoNonce(%d, %d)", n.Round, role), impl.ConvoNonce(n.Round, byte(role)), n.Convo[role])
+		}
+	}
+
+	c.uint("ConvoRole(alice, bob)", uint32(impl.ConvoRole(v.Alice.Public, v.Bob.Public)), uint32(v.Roles.Alice))
+	c.uint("ConvoRole(bob, alice)", uint32(impl.ConvoRole(v.Bob.Public, v.Alice.Public)), uint32(v.Roles.Bob))
+
+	for _, d := range v.DeadDrops {
+		c.bytes(fmt.Sprintf("ConvoDeadDrop(alice, bob, %d)", d.Round), impl.ConvoDeadDrop(v.Alice.Private, v.Bob.Public, d.Round), d.DeadDrop)
+		c.bytes(fmt.Sprintf("ConvoDeadDrop(bob, alice, %d)", d.Round), impl.ConvoDeadDrop(v.Bob.Private, v.Alice.Public, d.Round), d.DeadDrop)
+	}
+	for _, d := range v.MailboxDrops {
+		c.bytes(fmt.Sprintf("MailboxDeadDrop(alice, bob, %d, %d)", d.SenderRole, d.Window), impl.MailboxDeadDrop(v.Alice.Private, v.Bob.Public, d.SenderRole, d.Window), d.DeadDrop)
+		c.bytes(fmt.Sprintf("MailboxDeadDrop(bob, alice, %d, %d)", d.SenderRole, d.Window), impl.MailboxDeadDrop(v.Bob.Private, v.Alice.Public, d.SenderRole, d.Window), d.DeadDrop)
+	}
+	for _, b := range v.DialBuckets {
+		c.uint(fmt.Sprintf("KeyDialBucket(%d)", b.Buckets), impl.KeyDialBucket(b.Key, b.Buckets), b.Bucket)
+	}
+
+	for _, e := range v.ConvoExchanges {
+		drop := impl.ConvoDeadDrop(v.Alice.Private, v.Bob.Public, e.Round)
+		nonce := impl.ConvoNonce(e.Round, v.Roles.Alice)
+		ctxt := impl.SealMessage(e.Message, nonce, v.Bob.Public, v.Alice.Private)
+		c.bytes(fmt.Sprintf("ConvoExchange(%d)", e.Round), impl.MarshalConvoExchange(drop, e.Mode, ctxt), e.Marshaled)
+	}
+	for _, i := range v.Introductions {
+		c.bytes("Introduction", impl.MarshalIntroduction(i.Rendezvous, i.LongTermKey, i.ScheduleDelay, i.Note), i.Marshaled)
+	}
+	for _, d := range v.DialExchanges {
+		ctxt := impl.SealOnion(d.Introduction, impl.ForwardNonce(d.Round), [][]byte{v.Bob.Public}, [][]byte{d.EphemeralKey})
+		bucket := impl.KeyDialBucket(v.Bob.Public, d.Buckets)
+		c.bytes(fmt.Sprintf("DialExchange(%d)", d.Round), impl.MarshalDialExchange(bucket, ctxt), d.Marshaled)
+	}
+
+	publicKeys := make([][]byte, len(v.Servers))
+	for i, s := range v.Servers {
+		publicKeys[i] = s.Public
+	}
+	for _, o := range v.Onions {
+		if len(o.Layers) != len(v.Servers)+1 {
+			c.errs = append(c.errs, fmt.Errorf("%s onion: expecting %d layers", o.Service, len(v.Servers)+1))
+			continue
+		}
+		ephemeralKeys := make([][]byte, len(o.EphemeralKeys))
+		for i, k := range o.EphemeralKeys {
+			ephemeralKeys[i] = k
+		}
+		message := o.Layers[len(o.Layers)-1]
+		onion := impl.SealOnion(message, impl.ForwardNonce(o.Round), publicKeys, ephemeralKeys)
+		c.bytes(fmt.Sprintf("%s onion", o.Service), onion, o.Layers[0])
+
+		if o.ReplyLayers != nil {
+			sharedKeys := make([][]byte, len(o.SharedKeys))
+			for i, k := range o.SharedKeys {
+				sharedKeys[i] = k
+			}
+			reply, ok := impl.OpenReply(o.ReplyLayers[0], impl.BackwardNonce(o.Round), sharedKeys)
+			if !ok {
+				c.errs = append(c.errs, fmt.Errorf("%s reply: failed to open", o.Service))
+			} else {
+				c.bytes(fmt.Sprintf("%s reply", o.Service), reply, o.Reply)
+			}
+		}
+	}
+
+	for _, e := range v.Envelopes {
+		data, err := impl.ParseEnvelope([]byte(e.Envelope))
+		if err != nil {
+			c.errs = append(c.errs, fmt.Errorf("%s envelope: %s", e.Name, err))
+			continue
+		}
+		c.bytes(fmt.Sprintf("%s envelope", e.Name), data, []byte(e.Envelope))
+		c.announcement(e, impl, v.VerifyKey)
+	}
+
+	return c.errs
+}
@@ -0,0 +1,64 @@
+package conformance
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite testdata/vectors.json")
+
+const vectorsPath = "testdata/vectors.json"
+
+func TestVectorsUnchanged(t *testing.T) {
+	v := Generate(make([]byte, 32), 3)
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = append(data, '\n')
+	if *update {
+		if err := ioutil.WriteFile(vectorsPath, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	golden, err := ioutil.ReadFile(vectorsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, golden) {
+		t.Fatalf("wire formats changed: bump Version and rerun with -update if that's intended")
+	}
+}
+
+func TestReference(t *testing.T) {
+	v, err := ReadVectors(vectorsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range Check(v, Reference{}) {
+		t.Error(err)
+	}
+}
+
+type brokenNonce struct {
+	Reference
+}
+
+func (brokenNonce) ConvoNonce(round uint32, role byte) []byte {
+	n := Reference{}.ConvoNonce(round, role)
+	n[4] = 1
+	return n
+}
+
+func TestCheckFindsMismatch(t *testing.T) {
+	v, err := ReadVectors(vectorsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := Check(v, brokenNonce{}); len(errs) == 0 {
+		t.Fatalf("expecting mismatches for a broken implementation")
+	}
+}
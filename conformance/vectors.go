@@ -0,0 +1,369 @@
+// Package conformance generates test vectors for the Vuvuzela wire
+// formats and checks implementations against them, so that clients
+// written in other languages interoperate byte for byte.
+//
+// Vectors are JSON. Byte strings are hex, except inside Envelope JSON,
+// which is exactly what goes over the websocket (byte strings there are
+// base64, as encoding/json writes them).
+package conformance
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+
+	. "github.com/davidlazar/vuvuzela"
+	"github.com/davidlazar/vuvuzela/onionbox"
+	"github.com/davidlazar/vuvuzela/rand"
+)
+
+// Version changes whenever the vectors change in a way that existing
+// implementations should notice.
+const Version = 2
+
+type Hex []byte
+
+func (h Hex) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(h)), nil
+}
+
+func (h *Hex) UnmarshalText(text []byte) error {
+	b, err := hex.DecodeString(string(text))
+	if err != nil {
+		return fmt.Errorf("hex decode error: %s", err)
+	}
+	*h = b
+	return nil
+}
+
+type KeyPair struct {
+	Public  Hex
+	Private Hex
+}
+
+type Vectors struct {
+	Version int
+
+	// Seed determines every key and message below.
+	Seed Hex
+
+	Servers   []KeyPair
+	Alice     KeyPair
+	Bob       KeyPair
+	VerifyKey Hex // the first server's ed25519 key, for announcements
+
+	Nonces         []NonceVector
+	Roles          RoleVector
+	DeadDrops      []DeadDropVector
+	MailboxDrops   []MailboxDropVector
+	DialBuckets    []DialBucketVector
+	ConvoExchanges []ConvoExchangeVector
+	Introductions  []IntroductionVector
+	DialExchanges  []DialExchangeVector
+	Onions         []OnionVector
+	Envelopes      []EnvelopeVector
+}
+
+type NonceVector struct {
+	Round    uint32
+	Forward  Hex
+	Backward Hex
+	Convo    [2]Hex // ConvoNonce for role 0 and role 1
+}
+
+type RoleVector struct {
+	Alice byte
+	Bob   byte
+}
+
+// DeadDropVector is the same for Alice talking to Bob and Bob talking
+// to Alice.
+type DeadDropVector struct {
+	Round    uint32
+	DeadDrop Hex
+}
+
+type MailboxDropVector struct {
+	Window     uint32
+	SenderRole byte
+	DeadDrop   Hex
+}
+
+type DialBucketVector struct {
+	Key     Hex
+	Buckets uint32
+	Bucket  uint32
+}
+
+// ConvoExchangeVector is Alice's exchange for Bob: Message sealed to Bob
+// with Alice's ConvoNonce, in the dead drop for Round.
+type ConvoExchangeVector struct {
+	Round     uint32
+	Mode      uint8
+	Message   Hex
+	Marshaled Hex
+}
+
+type IntroductionVector struct {
+	Rendezvous    uint32
+	LongTermKey   Hex
+	ScheduleDelay uint32
+	Note          Hex
+	Marshaled     Hex
+}
+
+// DialExchangeVector is Alice dialing Bob: the marshaled Introduction
+// is sealed to Bob as a one-layer onion with EphemeralKey.
+type DialExchangeVector struct {
+	Round        uint32
+	Buckets      uint32
+	Introduction Hex
+	EphemeralKey Hex
+	Marshaled    Hex
+}
+
+// OnionVector follows one onion through the servers. Layers[i] is what
+// server i receives, and the last entry is the message the last server
+// sees. For convo onions, ReplyLayers[i] is the reply as server i sends
+// it back, so ReplyLayers[0] is what the client gets.
+type OnionVector struct {
+	Service       string
+	Round         uint32
+	EphemeralKeys []Hex
+	SharedKeys    []Hex
+	Layers        []Hex
+	Reply         Hex   `json:",omitempty"`
+	ReplyLayers   []Hex `json:",omitempty"`
+}
+
+// EnvelopeVector is an envelope exactly as it's sent.
+type EnvelopeVector struct {
+	Name     string
+	Envelope string
+}
+
+var testRounds = []uint32{1, 7, 65536, 0xfffffffe}
+
+type keyReader struct {
+	r io.Reader
+}
+
+func (kr *keyReader) boxKey() (*BoxKey, *BoxKey) {
+	pub, priv, err := box.GenerateKey(kr.r)
+	if err != nil {
+		panic(err)
+	}
+	return (*BoxKey)(pub), (*BoxKey)(priv)
+}
+
+func (kr *keyReader) bytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(kr.r, b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func keyPair(pub, priv *BoxKey) KeyPair {
+	return KeyPair{Public: Hex(pub[:]), Private: Hex(priv[:])}
+}
+
+func hexKeys(keys []*[32]byte) []Hex {
+	hs := make([]Hex, len(keys))
+	for i, k := range keys {
+		hs[i] = Hex(k[:])
+	}
+	return hs
+}
+
+// Generate makes vectors for a chain of numServers servers. The same
+// seed always gives the same vectors.
+func Generate(seed []byte, numServers int) *Vectors {
+	var key [32]byte
+	copy(key[:], seed)
+	kr := &keyReader{rand.NewSalsa20Rand(bytes.NewReader(key[:]))}
+
+	v := &Vectors{
+		Version: Version,
+		Seed:    Hex(seed),
+	}
+	serverKeys := make(BoxKeys, numServers)
+	for i := range serverKeys {
+		pub, priv := kr.boxKey()
+		serverKeys[i] = pub
+		v.Servers = append(v.Servers, keyPair(pub, priv))
+	}
+	alicePublic, alicePrivate := kr.boxKey()
+	bobPublic, bobPrivate := kr.boxKey()
+	v.Alice = keyPair(alicePublic, alicePrivate)
+	v.Bob = keyPair(bobPublic, bobPrivate)
+	verifyKey, signingKey := SigningKeyFromSeed(kr.bytes(32))
+	v.VerifyKey = Hex(verifyKey[:])
+
+	for _, round := range testRounds {
+		v.Nonces = append(v.Nonces, NonceVector{
+			Round:    round,
+			Forward:  Hex(ForwardNonce(round)[:]),
+			Backward: Hex(BackwardNonce(round)[:]),
+			Convo:    [2]Hex{Hex(ConvoNonce(round, 0)[:]), Hex(ConvoNonce(round, 1)[:])},
+		})
+		drop := ConvoDeadDrop(alicePrivate, bobPublic, round)
+		v.DeadDrops = append(v.DeadDrops, DeadDropVector{Round: round, DeadDrop: Hex(drop[:])})
+	}
+
+	aliceRole := ConvoRole(alicePublic, bobPublic)
+	v.Roles = RoleVector{Alice: aliceRole, Bob: ConvoRole(bobPublic, alicePublic)}
+	for _, window := range []uint32{0, 3} {
+		for _, role := range []byte{0, 1} {
+			drop := MailboxDeadDrop(alicePrivate, bobPublic, role, window)
+			v.MailboxDrops = append(v.MailboxDrops, MailboxDropVector{
+				Window:     window,
+				SenderRole: role,
+				DeadDrop:   Hex(drop[:]),
+			})
+		}
+	}
+
+	for _, buckets := range []uint32{1, 7, 1024} {
+		v.DialBuckets = append(v.DialBuckets, DialBucketVector{
+			Key:     Hex(bobPublic[:]),
+			Buckets: buckets,
+			Bucket:  KeyDialBucket(bobPublic, buckets),
+		})
+	}
+
+	var convoOnion []byte
+	for i, mode := range []ExchangeMode{ExchangeSwap, ExchangeDeposit} {
+		round := testRounds[i]
+		msg := kr.bytes(SizeMessage)
+		ex := &ConvoExchange{
+			DeadDrop: ConvoDeadDrop(alicePrivate, bobPublic, round),
+			Mode:     mode,
+		}
+		ctxt := box.Seal(nil, msg, ConvoNonce(round, aliceRole), bobPublic.Key(), alicePrivate.Key())
+		copy(ex.EncryptedMessage[:], ctxt)
+		v.ConvoExchanges = append(v.ConvoExchanges, ConvoExchangeVector{
+			Round:     round,
+			Mode:      uint8(mode),
+			Message:   Hex(msg),
+			Marshaled: Hex(ex.Marshal()),
+		})
+		if convoOnion == nil {
+			convoOnion = ex.Marshal()
+		}
+	}
+
+	intro := &Introduction{
+		Rendezvous:    testRounds[1] + 4,
+		LongTermKey:   *alicePublic,
+		ScheduleDelay: 50,
+	}
+	copy(intro.Note[:], "about tomorrow")
+	v.Introductions = append(v.Introductions, IntroductionVector{
+		Rendezvous:    intro.Rendezvous,
+		LongTermKey:   Hex(intro.LongTermKey[:]),
+		ScheduleDelay: intro.ScheduleDelay,
+		Note:          Hex(intro.Note[:]),
+		Marshaled:     Hex(intro.Marshal()),
+	})
+
+	dialRound, buckets := testRounds[1], uint32(7)
+	eph := new([32]byte)
+	copy(eph[:], kr.bytes(32))
+	ctxt, _ := onionbox.SealWithKeys(intro.Marshal(), ForwardNonce(dialRound), BoxKeys{bobPublic}.Keys(), []*[32]byte{eph})
+	dex := &DialExchange{Bucket: KeyDialBucket(bobPublic, buckets)}
+	copy(dex.EncryptedIntro[:], ctxt)
+	v.DialExchanges = append(v.DialExchanges, DialExchangeVector{
+		Round:        dialRound,
+		Buckets:      buckets,
+		Introduction: Hex(intro.Marshal()),
+		EphemeralKey: Hex(eph[:]),
+		Marshaled:    Hex(dex.Marshal()),
+	})
+
+	convo := onionVector(kr, "convo", testRounds[0], convoOnion, serverKeys)
+	reply := kr.bytes(SizeEncryptedMessage)
+	convo.Reply = Hex(reply)
+	convo.ReplyLayers = make([]Hex, numServers)
+	for i := numServers - 1; i >= 0; i-- {
+		var shared [32]byte
+		copy(shared[:], convo.SharedKeys[i])
+		reply = box.SealAfterPrecomputation(nil, reply, BackwardNonce(convo.Round), &shared)
+		convo.ReplyLayers[i] = Hex(reply)
+	}
+	v.Onions = append(v.Onions, convo)
+	v.Onions = append(v.Onions, onionVector(kr, "dial", dialRound, dex.Marshal(), serverKeys))
+
+	var ts int64 = 1500000000
+	convoAnnounce := &AnnounceConvoRound{Round: testRounds[0], Epoch: 1, Timestamp: ts}
+	convoAnnounce.Signature = signingKey.Sign(ConvoRoundMessage(convoAnnounce.Round, 1, ts))
+	dialAnnounce := &AnnounceDialRound{Round: dialRound, Buckets: buckets, Epoch: 1, Timestamp: ts}
+	dialAnnounce.Signature = signingKey.Sign(DialRoundMessage(dialRound, buckets, 1, ts))
+	var bucket [SizeEncryptedIntro]byte
+	copy(bucket[:], ctxt)
+
+	envelopes := []struct {
+		name string
+		v    interface{}
+	}{
+		{"ConvoRequest", &ConvoRequest{Round: convo.Round, Onion: convo.Layers[0]}},
+		{"ConvoResponse", &ConvoResponse{Round: convo.Round, Onion: convo.ReplyLayers[0]}},
+		{"ConvoError", &ConvoError{Round: convo.Round, Err: "server overloaded", RetryAfter: 2}},
+		{"DialRequest", &DialRequest{Round: dialRound, Onion: v.Onions[1].Layers[0]}},
+		{"DialBucket", &DialBucket{Round: dialRound, Intros: [][SizeEncryptedIntro]byte{bucket}}},
+		{"DialBucketRequest", &DialBucketRequest{Round: dialRound}},
+		{"AnnounceConvoRound", convoAnnounce},
+		{"AnnounceDialRound", dialAnnounce},
+	}
+	for _, e := range envelopes {
+		env, err := Envelop(e.v)
+		if err != nil {
+			panic(err)
+		}
+		data, err := json.Marshal(env)
+		if err != nil {
+			panic(err)
+		}
+		v.Envelopes = append(v.Envelopes, EnvelopeVector{Name: e.name, Envelope: string(data)})
+	}
+
+	return v
+}
+
+func onionVector(kr *keyReader, service string, round uint32, message []byte, serverKeys BoxKeys) OnionVector {
+	ephemeralKeys := make([]*[32]byte, len(serverKeys))
+	for i := range ephemeralKeys {
+		ephemeralKeys[i] = new([32]byte)
+		copy(ephemeralKeys[i][:], kr.bytes(32))
+	}
+	onion, sharedKeys := onionbox.SealWithKeys(message, ForwardNonce(round), serverKeys.Keys(), ephemeralKeys)
+
+	ov := OnionVector{
+		Service:       service,
+		Round:         round,
+		EphemeralKeys: hexKeys(ephemeralKeys),
+		SharedKeys:    hexKeys(sharedKeys),
+	}
+	layer := onion
+	for i := range serverKeys {
+		ov.Layers = append(ov.Layers, Hex(layer))
+		var msg []byte
+		msg, _ = box.OpenAfterPrecomputation(nil, layer[32:], ForwardNonce(round), sharedKeys[i])
+		layer = msg
+	}
+	ov.Layers = append(ov.Layers, Hex(layer))
+	return ov
+}
+
+// publicKey is curve25519 base point multiplication, for checking key pairs.
+func publicKey(private []byte) []byte {
+	var pub, priv [32]byte
+	copy(priv[:], private)
+	curve25519.ScalarBaseMult(&pub, &priv)
+	return pub[:]
+}
@@ -4,11 +4,13 @@ import (
 	"encoding/binary"
 	"fmt"
 	"sync"
+	"sync/atomic"
 
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/nacl/box"
 
 	. "github.com/davidlazar/vuvuzela/internal"
+	"github.com/davidlazar/vuvuzela/internal/workpool"
 	"github.com/davidlazar/vuvuzela/rand"
 	"github.com/davidlazar/vuvuzela/vrpc"
 )
@@ -18,35 +20,79 @@ type ConvoService struct {
 	rounds   map[uint32]*ConvoRound
 
 	Idle *sync.Mutex
+	// number of NewRound calls waiting for Idle
+	waiting int32
+	paused  int32
 
+	// noiseMu guards the noise parameters, which can be changed
+	// between rounds with SetNoise.
+	noiseMu   sync.Mutex
 	LaplaceMu float64
 	LaplaceB  float64
 
+	// Noise for mailbox deposits and pickups, added by all but the last
+	// server. Fake pickups collect this server's own fake deposits in
+	// later rounds, so they hit mail just like real ones.
+	MailboxMu float64
+	MailboxB  float64
+	fakeDrops []fakeDrop
+
+	// How long the last server keeps deposited mail (0 disables mailboxes).
+	MailboxRounds int
+
+	mailboxMu      sync.Mutex
+	mailboxes      map[DeadDrop][]*mailboxEntry
+	mailboxExpires map[uint32][]DeadDrop
+
+	pkiMu      sync.RWMutex
 	PKI        *PKI
 	ServerName string
 	PrivateKey *BoxKey
+	SigningKey *SigningKey
 	Client     *vrpc.Client
 	LastServer bool
 
+	// Transcript, if set, gets an entry for every round.
+	Transcript *Transcript
+
+	// SignedRounds, if set, makes sure round numbers only increase.
+	SignedRounds *SignedRounds
+
+	// Auditor, if set, checks the previous server's noise.
+	Auditor *NoiseAuditor
+
+	// Workers, if set, open the onions instead of this process.
+	Workers *Workers
+
 	AccessCounts chan *AccessCount
 }
 
 type ConvoRound struct {
+	// guards status and numIncoming, which the admin reads
+	sync.Mutex
 	srv    *ConvoService
 	status convoStatus
 
+	// set while this round holds srv.Idle
+	holdsIdle int32
+
 	numIncoming   int
 	sharedKeys    []*[32]byte
 	incoming      [][]byte
 	incomingIndex []int
+	// leaf hashes of the onions as received, for the transcript
+	incomingLeaves [][32]byte
 
 	replies [][]byte
 
-	numFakeSingles int
-	numFakeDoubles int
+	numFakeSingles  int
+	numFakeDoubles  int
+	numFakeDeposits int
+	numFakePickups  int
 
-	noise   [][]byte
-	noiseWg sync.WaitGroup
+	noise       [][]byte
+	noiseWg     sync.WaitGroup
+	noiseCommit *noiseCommit
 }
 
 type convoStatus int
@@ -57,14 +103,44 @@ const (
 	convoRoundClosed
 )
 
+func (s convoStatus) String() string {
+	switch s {
+	case convoRoundNew:
+		return "new"
+	case convoRoundOpen:
+		return "open"
+	case convoRoundClosed:
+		return "closed"
+	}
+	return fmt.Sprintf("convoStatus(%d)", int(s))
+}
+
 type AccessCount struct {
-	Singles int64
-	Doubles int64
+	Singles  int64
+	Doubles  int64
+	Deposits int64
+	Pickups  int64
+}
+
+type fakeDrop struct {
+	id    DeadDrop
+	round uint32
+}
+
+type mailboxEntry struct {
+	message []byte
+	expires uint32
 }
 
+// Caps the mail waiting in one dead drop, so a single mailbox can't eat
+// the last server's memory.
+const maxMailboxEntries = 32
+
 func InitConvoService(srv *ConvoService) {
 	srv.rounds = make(map[uint32]*ConvoRound)
 	srv.AccessCounts = make(chan *AccessCount, 8)
+	srv.mailboxes = make(map[DeadDrop][]*mailboxEntry)
+	srv.mailboxExpires = make(map[uint32][]DeadDrop)
 }
 
 func (srv *ConvoService) getRound(round uint32, expectedStatus convoStatus) (*ConvoRound, error) {
@@ -74,49 +150,100 @@ func (srv *ConvoService) getRound(round uint32, expectedStatus convoStatus) (*Co
 	if !ok {
 		return nil, fmt.Errorf("round %d not found", round)
 	}
-	if r.status != expectedStatus {
-		return r, fmt.Errorf("round %d: status %v, expecting %v", round, r.status, expectedStatus)
+	r.Lock()
+	status := r.status
+	r.Unlock()
+	if status != expectedStatus {
+		return r, fmt.Errorf("round %d: status %v, expecting %v", round, status, expectedStatus)
 	}
 	return r, nil
 }
 
-func (srv *ConvoService) NewRound(Round uint32, _ *struct{}) error {
+func (r *ConvoRound) setStatus(status convoStatus) {
+	r.Lock()
+	r.status = status
+	r.Unlock()
+}
+
+func (srv *ConvoService) NewRound(Round uint32, sig *RoundSignature) error {
 	log.WithFields(log.Fields{"service": "convo", "rpc": "NewRound", "round": Round}).Info()
 
+	if atomic.LoadInt32(&srv.paused) != 0 {
+		return fmt.Errorf("convo rounds are paused")
+	}
+
 	// wait for the service to become idle before starting a new round
 	// TODO temporary hack
+	atomic.AddInt32(&srv.waiting, 1)
 	srv.Idle.Lock()
+	atomic.AddInt32(&srv.waiting, -1)
 
 	srv.roundsMu.Lock()
 	defer srv.roundsMu.Unlock()
 
 	_, exists := srv.rounds[Round]
 	if exists {
+		srv.Idle.Unlock()
 		return fmt.Errorf("round %d already exists", Round)
 	}
+	if srv.Workers != nil {
+		if err := srv.Workers.Begin("convo", Round); err != nil {
+			srv.Idle.Unlock()
+			return err
+		}
+	}
+	// the last step that can fail, so a failed round can be retried
+	if err := srv.SignedRounds.advance("convo", Round); err != nil {
+		srv.Idle.Unlock()
+		return err
+	}
 
 	round := &ConvoRound{
-		srv: srv,
+		srv:       srv,
+		holdsIdle: 1,
 	}
 	srv.rounds[Round] = round
+	pki := srv.pki()
 
 	if !srv.LastServer {
+		srv.noiseMu.Lock()
 		round.numFakeSingles = cappedFlooredLaplace(srv.LaplaceMu, srv.LaplaceB)
 		round.numFakeDoubles = cappedFlooredLaplace(srv.LaplaceMu, srv.LaplaceB)
 		round.numFakeDoubles += round.numFakeDoubles % 2 // ensure numFakeDoubles is even
-		round.noise = make([][]byte, round.numFakeSingles+round.numFakeDoubles)
+		var deposits, pickups []DeadDrop
+		if srv.MailboxMu > 0 {
+			round.numFakeDeposits = cappedFlooredLaplace(srv.MailboxMu, srv.MailboxB)
+			round.numFakePickups = cappedFlooredLaplace(srv.MailboxMu, srv.MailboxB)
+			deposits, pickups = srv.fakeMail(Round, round.numFakeDeposits, round.numFakePickups)
+			round.numFakePickups = len(pickups)
+		}
+		srv.noiseMu.Unlock()
+		round.noise = make([][]byte, round.numFakeSingles+round.numFakeDoubles+round.numFakeDeposits+round.numFakePickups)
+		if srv.Client != nil {
+			round.noiseCommit = newNoiseCommit(srv.ServerName, "convo", Round, len(round.noise), srv.SigningKey)
+			round.noiseCommit.send(srv.Client)
+		}
 
 		nonce := ForwardNonce(Round)
-		nextKeys := srv.PKI.NextServerKeys(srv.ServerName).Keys()
+		nextKeys := pki.NextServerKeys(srv.ServerName).Keys()
 		round.noiseWg.Add(1)
 		go func() {
+			doublesEnd := round.numFakeSingles + round.numFakeDoubles
+			depositsEnd := doublesEnd + round.numFakeDeposits
 			FillWithFakeSingles(round.noise[:round.numFakeSingles], nonce, nextKeys)
-			FillWithFakeDoubles(round.noise[round.numFakeSingles:], nonce, nextKeys)
+			FillWithFakeDoubles(round.noise[round.numFakeSingles:doublesEnd], nonce, nextKeys)
+			FillWithFakeDeposits(round.noise[doublesEnd:depositsEnd], deposits, nonce, nextKeys)
+			FillWithFakePickups(round.noise[depositsEnd:], pickups, nonce, nextKeys)
 			round.noiseWg.Done()
 		}()
 	}
 
-	round.status = convoRoundNew
+	round.setStatus(convoRoundNew)
+	srv.Auditor.roundStarted("convo", Round)
+
+	*sig = *signRound(srv.SigningKey, pki.Epoch, func(ts int64) []byte {
+		return ConvoRoundMessage(Round, pki.Epoch, ts)
+	})
 	return nil
 }
 
@@ -133,10 +260,15 @@ func (srv *ConvoService) Open(args *ConvoOpenArgs, _ *struct{}) error {
 		return err
 	}
 
+	round.Lock()
 	round.numIncoming = args.NumIncoming
+	round.Unlock()
 	round.sharedKeys = make([]*[32]byte, round.numIncoming)
 	round.incoming = make([][]byte, round.numIncoming)
-	round.status = convoRoundOpen
+	if srv.Transcript != nil {
+		round.incomingLeaves = make([][32]byte, round.numIncoming)
+	}
+	round.setStatus(convoRoundOpen)
 
 	return nil
 }
@@ -156,17 +288,33 @@ func (srv *ConvoService) Add(args *ConvoAddArgs, _ *struct{}) error {
 	}
 
 	nonce := ForwardNonce(args.Round)
-	expectedOnionSize := srv.PKI.IncomingOnionOverhead(srv.ServerName) + SizeConvoExchange
+	expectedOnionSize := srv.pki().IncomingOnionOverhead(srv.ServerName) + SizeConvoExchange
 
 	if args.Offset+len(args.Onions) > round.numIncoming {
 		return fmt.Errorf("overflowing onions (offset=%d, onions=%d, incoming=%d)", args.Offset, len(args.Onions), round.numIncoming)
 	}
 
+	var opened *WorkerOpenResult
+	if srv.Workers != nil {
+		opened, err = srv.Workers.Open("convo", args.Round, expectedOnionSize, args.Onions, true)
+		if err != nil {
+			return err
+		}
+	}
+
 	for k, onion := range args.Onions {
 		i := args.Offset + k
 		round.sharedKeys[i] = new([32]byte)
+		if round.incomingLeaves != nil {
+			round.incomingLeaves[i] = MerkleLeaf(onion)
+		}
 
-		if len(onion) == expectedOnionSize {
+		if len(onion) == expectedOnionSize && opened != nil {
+			*round.sharedKeys[i] = opened.Keys[k]
+			if m := opened.Messages[k]; len(m) > 0 {
+				round.incoming[i] = m
+			}
+		} else if len(onion) == expectedOnionSize {
 			var theirPublic [32]byte
 			copy(theirPublic[:], onion[0:32])
 
@@ -220,6 +368,20 @@ func (srv *ConvoService) Close(Round uint32, _ *struct{}) error {
 	}
 
 	srv.filterIncoming(round)
+	valid := len(round.incoming)
+	srv.Auditor.roundClosed("convo", Round, round.numIncoming, valid)
+
+	var entry *TranscriptEntry
+	if srv.Transcript != nil {
+		entry = &TranscriptEntry{
+			Service:      "convo",
+			Round:        Round,
+			Incoming:     round.numIncoming,
+			Valid:        valid,
+			IncomingRoot: MerkleRoot(round.incomingLeaves),
+		}
+		round.incomingLeaves = nil
+	}
 
 	if !srv.LastServer {
 		round.noiseWg.Wait()
@@ -230,32 +392,54 @@ func (srv *ConvoService) Close(Round uint32, _ *struct{}) error {
 		shuffler := NewShuffler(rand.Reader, len(outgoing))
 		shuffler.Shuffle(outgoing)
 
-		if err := NewConvoRound(srv.Client, Round); err != nil {
+		if entry != nil {
+			entry.Noise = len(outgoing) - entry.Valid
+			entry.Outgoing = len(outgoing)
+			entry.OutgoingRoot = merkleRootOf(outgoing)
+			srv.Transcript.record(entry)
+		}
+
+		if _, err := NewConvoRound(srv.Client, Round); err != nil {
 			return fmt.Errorf("NewConvoRound: %s", err)
 		}
-		srv.Idle.Unlock()
+		round.releaseIdle()
 
 		replies, err := RunConvoRound(srv.Client, Round, outgoing)
 		if err != nil {
 			return fmt.Errorf("RunConvoRound: %s", err)
 		}
+		if entry != nil {
+			go srv.Transcript.exchange(srv.Client, entry)
+		}
+		if round.noiseCommit != nil {
+			go func() {
+				upstream := srv.Transcript.upstream(srv.pki().PreviousServerName(srv.ServerName), "convo", Round)
+				round.noiseCommit.reveal(srv.Client, valid, upstream)
+			}()
+		}
 
 		shuffler.Unshuffle(replies)
 		round.replies = replies[:round.numIncoming]
 	} else {
+		if entry != nil {
+			srv.Transcript.record(entry)
+		}
 		exchanges := make([]*ConvoExchange, len(round.incoming))
-		ParallelFor(len(round.incoming), func(p *P) {
-			for i, ok := p.Next(); ok; i, ok = p.Next() {
-				exchanges[i] = new(ConvoExchange)
-				if err := exchanges[i].Unmarshal(round.incoming[i]); err != nil {
-					log.WithFields(log.Fields{"bug": true, "call": "ConvoExchange.Unmarshal"}).Error(err)
-				}
+		workpool.For("convo/unmarshal", len(round.incoming), func(i int) {
+			exchanges[i] = new(ConvoExchange)
+			if err := exchanges[i].Unmarshal(round.incoming[i]); err != nil {
+				log.WithFields(log.Fields{"bug": true, "call": "ConvoExchange.Unmarshal"}).Error(err)
 			}
 		})
 
-		var singles, doubles int64
+		var singles, doubles, deposits, pickups int64
 		deadDrops := make(map[DeadDrop][]int)
 		for i, ex := range exchanges {
+			if srv.isDeposit(ex) {
+				srv.deposit(Round, ex)
+				deposits++
+				continue
+			}
 			drop := deadDrops[ex.DeadDrop]
 			if len(drop) == 0 {
 				singles++
@@ -267,30 +451,52 @@ func (srv *ConvoService) Close(Round uint32, _ *struct{}) error {
 			}
 		}
 
+		mail := make(map[int][]byte)
+		if srv.MailboxRounds > 0 {
+			for id, drop := range deadDrops {
+				if len(drop) != 1 {
+					continue
+				}
+				if m := srv.pickup(id); m != nil {
+					mail[drop[0]] = m
+					pickups++
+				}
+			}
+			srv.expireMail(Round)
+		}
+
 		round.replies = make([][]byte, len(round.incoming))
-		ParallelFor(len(exchanges), func(p *P) {
-			for i, ok := p.Next(); ok; i, ok = p.Next() {
-				ex := exchanges[i]
-				drop := deadDrops[ex.DeadDrop]
-				if len(drop) == 1 {
+		workpool.For("convo/exchange", len(exchanges), func(i int) {
+			ex := exchanges[i]
+			if srv.isDeposit(ex) {
+				round.replies[i] = ex.EncryptedMessage[:]
+				return
+			}
+			drop := deadDrops[ex.DeadDrop]
+			if len(drop) == 1 {
+				if m, ok := mail[i]; ok {
+					round.replies[i] = m
+				} else {
 					round.replies[i] = ex.EncryptedMessage[:]
 				}
-				if len(drop) == 2 {
-					var k int
-					if i == drop[0] {
-						k = drop[1]
-					} else {
-						k = drop[0]
-					}
-					round.replies[i] = exchanges[k].EncryptedMessage[:]
+			}
+			if len(drop) == 2 {
+				var k int
+				if i == drop[0] {
+					k = drop[1]
+				} else {
+					k = drop[0]
 				}
+				round.replies[i] = exchanges[k].EncryptedMessage[:]
 			}
 		})
-		srv.Idle.Unlock()
+		round.releaseIdle()
 
 		ac := &AccessCount{
-			Singles: singles,
-			Doubles: doubles,
+			Singles:  singles,
+			Doubles:  doubles,
+			Deposits: deposits,
+			Pickups:  pickups,
 		}
 		select {
 		case srv.AccessCounts <- ac:
@@ -298,10 +504,114 @@ func (srv *ConvoService) Close(Round uint32, _ *struct{}) error {
 		}
 	}
 
-	round.status = convoRoundClosed
+	round.setStatus(convoRoundClosed)
 	return nil
 }
 
+// releaseIdle unlocks srv.Idle if this round still holds it. Both Close
+// and an operator's Abort can release it, but only once.
+func (r *ConvoRound) releaseIdle() {
+	if atomic.CompareAndSwapInt32(&r.holdsIdle, 1, 0) {
+		r.srv.Idle.Unlock()
+	}
+}
+
+func (srv *ConvoService) pki() *PKI {
+	srv.pkiMu.RLock()
+	defer srv.pkiMu.RUnlock()
+	return srv.PKI
+}
+
+func (srv *ConvoService) SetPKI(pki *PKI) {
+	srv.pkiMu.Lock()
+	srv.PKI = pki
+	srv.pkiMu.Unlock()
+}
+
+// fakeMail picks random dead drops for this round's fake deposits and
+// up to numPickups earlier fake deposits, oldest first, that the last
+// server still keeps. Must be called with noiseMu held.
+func (srv *ConvoService) fakeMail(round uint32, numDeposits, numPickups int) (deposits, pickups []DeadDrop) {
+	for len(srv.fakeDrops) > 0 && srv.fakeDrops[0].round+uint32(srv.MailboxRounds) <= round {
+		srv.fakeDrops = srv.fakeDrops[1:]
+	}
+	for len(pickups) < numPickups && len(srv.fakeDrops) > 0 && srv.fakeDrops[0].round < round {
+		pickups = append(pickups, srv.fakeDrops[0].id)
+		srv.fakeDrops = srv.fakeDrops[1:]
+	}
+	if srv.MailboxRounds > 0 {
+		deposits = make([]DeadDrop, numDeposits)
+		for i := range deposits {
+			rand.Read(deposits[i][:])
+			srv.fakeDrops = append(srv.fakeDrops, fakeDrop{deposits[i], round})
+		}
+	}
+	return
+}
+
+func (srv *ConvoService) isDeposit(ex *ConvoExchange) bool {
+	return srv.MailboxRounds > 0 && ex.Mode == ExchangeDeposit
+}
+
+func (srv *ConvoService) deposit(round uint32, ex *ConvoExchange) {
+	srv.mailboxMu.Lock()
+	defer srv.mailboxMu.Unlock()
+
+	entries := srv.mailboxes[ex.DeadDrop]
+	if len(entries) >= maxMailboxEntries {
+		return
+	}
+	expires := round + uint32(srv.MailboxRounds)
+	srv.mailboxes[ex.DeadDrop] = append(entries, &mailboxEntry{
+		message: ex.EncryptedMessage[:],
+		expires: expires,
+	})
+	srv.mailboxExpires[expires] = append(srv.mailboxExpires[expires], ex.DeadDrop)
+}
+
+func (srv *ConvoService) pickup(id DeadDrop) []byte {
+	srv.mailboxMu.Lock()
+	defer srv.mailboxMu.Unlock()
+
+	entries := srv.mailboxes[id]
+	if len(entries) == 0 {
+		return nil
+	}
+	m := entries[0].message
+	if len(entries) == 1 {
+		delete(srv.mailboxes, id)
+	} else {
+		srv.mailboxes[id] = entries[1:]
+	}
+	return m
+}
+
+func (srv *ConvoService) expireMail(round uint32) {
+	srv.mailboxMu.Lock()
+	defer srv.mailboxMu.Unlock()
+
+	for expires, ids := range srv.mailboxExpires {
+		if expires > round {
+			continue
+		}
+		for _, id := range ids {
+			entries := srv.mailboxes[id]
+			live := entries[:0]
+			for _, e := range entries {
+				if e.expires > round {
+					live = append(live, e)
+				}
+			}
+			if len(live) == 0 {
+				delete(srv.mailboxes, id)
+			} else {
+				srv.mailboxes[id] = live
+			}
+		}
+		delete(srv.mailboxExpires, expires)
+	}
+}
+
 type ConvoGetArgs struct {
 	Round  uint32
 	Offset int
@@ -321,7 +631,7 @@ func (srv *ConvoService) Get(args *ConvoGetArgs, result *ConvoGetResult) error {
 	}
 
 	nonce := BackwardNonce(args.Round)
-	outgoingOnionSize := srv.PKI.OutgoingOnionOverhead(srv.ServerName) + SizeEncryptedMessage
+	outgoingOnionSize := srv.pki().OutgoingOnionOverhead(srv.ServerName) + SizeEncryptedMessage
 
 	result.Onions = make([][]byte, args.Count)
 	for k := range result.Onions {
@@ -351,8 +661,50 @@ func (srv *ConvoService) Delete(Round uint32, _ *struct{}) error {
 	return nil
 }
 
-func NewConvoRound(client *vrpc.Client, round uint32) error {
-	return client.Call("ConvoService.NewRound", round, nil)
+type ConvoStatusResult struct {
+	// Backlogs holds the number of rounds queued or in progress at each
+	// server, starting with the one that was asked.
+	Backlogs []int
+}
+
+// Status reports backpressure from this server and the rest of the chain,
+// so the entry server can admit fewer onions when the chain falls behind.
+func (srv *ConvoService) Status(Round uint32, result *ConvoStatusResult) error {
+	srv.roundsMu.RLock()
+	backlog := len(srv.rounds)
+	srv.roundsMu.RUnlock()
+	backlog += int(atomic.LoadInt32(&srv.waiting))
+
+	result.Backlogs = []int{backlog}
+	if !srv.LastServer {
+		next := new(ConvoStatusResult)
+		if err := srv.Client.Call("ConvoService.Status", Round, next); err != nil {
+			return fmt.Errorf("Status: %s", err)
+		}
+		result.Backlogs = append(result.Backlogs, next.Backlogs...)
+	}
+	return nil
+}
+
+// ConvoBacklog returns the largest backlog in the chain.
+func ConvoBacklog(client *vrpc.Client, round uint32) (int, error) {
+	result := new(ConvoStatusResult)
+	if err := client.Call("ConvoService.Status", round, result); err != nil {
+		return 0, err
+	}
+	max := 0
+	for _, b := range result.Backlogs {
+		if b > max {
+			max = b
+		}
+	}
+	return max, nil
+}
+
+func NewConvoRound(client *vrpc.Client, round uint32) (*RoundSignature, error) {
+	sig := new(RoundSignature)
+	err := client.Call("ConvoService.NewRound", round, sig)
+	return sig, err
 }
 
 func RunConvoRound(client *vrpc.Client, round uint32, onions [][]byte) ([][]byte, error) {
@@ -367,18 +719,16 @@ func RunConvoRound(client *vrpc.Client, round uint32, onions [][]byte) ([][]byte
 	spans := Spans(len(onions), 4000)
 	calls := make([]*vrpc.Call, len(spans))
 
-	ParallelFor(len(calls), func(p *P) {
-		for i, ok := p.Next(); ok; i, ok = p.Next() {
-			span := spans[i]
-			calls[i] = &vrpc.Call{
-				Method: "ConvoService.Add",
-				Args: &ConvoAddArgs{
-					Round:  round,
-					Offset: span.Start,
-					Onions: onions[span.Start : span.Start+span.Count],
-				},
-				Reply: nil,
-			}
+	workpool.For("convo/add", len(calls), func(i int) {
+		span := spans[i]
+		calls[i] = &vrpc.Call{
+			Method: "ConvoService.Add",
+			Args: &ConvoAddArgs{
+				Round:  round,
+				Offset: span.Start,
+				Onions: onions[span.Start : span.Start+span.Count],
+			},
+			Reply: nil,
 		}
 	})
 
@@ -390,18 +740,16 @@ func RunConvoRound(client *vrpc.Client, round uint32, onions [][]byte) ([][]byte
 		return nil, fmt.Errorf("Close: %s", err)
 	}
 
-	ParallelFor(len(calls), func(p *P) {
-		for i, ok := p.Next(); ok; i, ok = p.Next() {
-			span := spans[i]
-			calls[i] = &vrpc.Call{
-				Method: "ConvoService.Get",
-				Args: &ConvoGetArgs{
-					Round:  round,
-					Offset: span.Start,
-					Count:  span.Count,
-				},
-				Reply: new(ConvoGetResult),
-			}
+	workpool.For("convo/get", len(calls), func(i int) {
+		span := spans[i]
+		calls[i] = &vrpc.Call{
+			Method: "ConvoService.Get",
+			Args: &ConvoGetArgs{
+				Round:  round,
+				Offset: span.Start,
+				Count:  span.Count,
+			},
+			Reply: new(ConvoGetResult),
 		}
 	})
 
@@ -410,11 +758,9 @@ func RunConvoRound(client *vrpc.Client, round uint32, onions [][]byte) ([][]byte
 	}
 
 	replies := make([][]byte, len(onions))
-	ParallelFor(len(calls), func(p *P) {
-		for i, ok := p.Next(); ok; i, ok = p.Next() {
-			span := spans[i]
-			copy(replies[span.Start:span.Start+span.Count], calls[i].Reply.(*ConvoGetResult).Onions)
-		}
+	workpool.For("convo/replies", len(calls), func(i int) {
+		span := spans[i]
+		copy(replies[span.Start:span.Start+span.Count], calls[i].Reply.(*ConvoGetResult).Onions)
 	})
 
 	if err := client.Call("ConvoService.Delete", round, nil); err != nil {
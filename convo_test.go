@@ -0,0 +1,264 @@
+package vuvuzela
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConvoExchangeMarshal(t *testing.T) {
+	ex := &ConvoExchange{Mode: ExchangeDeposit}
+	data := ex.Marshal()
+	if len(data) != SizeConvoExchange {
+		t.Fatalf("expecting %d bytes, got %d", SizeConvoExchange, len(data))
+	}
+	xex := new(ConvoExchange)
+	if err := xex.Unmarshal(data); err != nil {
+		t.Fatal(err)
+	}
+	if xex.Mode != ExchangeDeposit {
+		t.Fatalf("mode not preserved")
+	}
+}
+
+func TestMailbox(t *testing.T) {
+	srv := &ConvoService{MailboxRounds: 10}
+	InitConvoService(srv)
+
+	ex := &ConvoExchange{Mode: ExchangeDeposit}
+	ex.DeadDrop[0] = 1
+	ex.EncryptedMessage[0] = 42
+	if !srv.isDeposit(ex) {
+		t.Fatalf("expecting deposit")
+	}
+	srv.deposit(5, ex)
+
+	srv.expireMail(14)
+	if m := srv.pickup(ex.DeadDrop); m == nil || !bytes.Equal(m, ex.EncryptedMessage[:]) {
+		t.Fatalf("expecting deposited mail")
+	}
+	if m := srv.pickup(ex.DeadDrop); m != nil {
+		t.Fatalf("mail picked up twice")
+	}
+
+	srv.deposit(5, ex)
+	srv.expireMail(15)
+	if m := srv.pickup(ex.DeadDrop); m != nil {
+		t.Fatalf("expecting mail to expire")
+	}
+	if len(srv.mailboxExpires) != 0 {
+		t.Fatalf("expiry index not cleaned up")
+	}
+}
+
+func TestServerAdmin(t *testing.T) {
+	var idle sync.Mutex
+	convo := &ConvoService{
+		Idle:       &idle,
+		PKI:        testPKI,
+		ServerName: "openstack2",
+		LastServer: true,
+	}
+	InitConvoService(convo)
+	dial := &DialService{Idle: &idle, PKI: testPKI}
+	InitDialService(dial)
+	admin := &ServerAdmin{Token: "secret", Convo: convo, Dial: dial}
+
+	reply := new(AdminReply)
+	if err := admin.Pause(&AdminArgs{Token: "wrong"}, reply); err == nil {
+		t.Fatalf("expecting bad token to be rejected")
+	}
+
+	sig := new(RoundSignature)
+	if err := convo.NewRound(1, sig); err != nil {
+		t.Fatal(err)
+	}
+	// Round 1 never closes, so it holds Idle until it's aborted.
+	if err := admin.Abort(&AdminArgs{Token: "secret", Service: "convo", Round: 1}, reply); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		done <- convo.NewRound(2, sig)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("NewRound still blocked after Abort")
+	}
+	if _, err := convo.getRound(1, convoRoundNew); err == nil {
+		t.Fatalf("expecting aborted round to be gone")
+	}
+
+	if err := admin.Pause(&AdminArgs{Token: "secret", Service: "convo"}, reply); err != nil {
+		t.Fatal(err)
+	}
+	if err := convo.NewRound(3, sig); err == nil {
+		t.Fatalf("expecting NewRound to fail while paused")
+	}
+
+	args := &AdminArgs{Token: "secret", Service: "dial", Mu: 5, B: 1}
+	if err := admin.SetNoise(args, reply); err != nil {
+		t.Fatal(err)
+	}
+	if dial.LaplaceMu != 5 || dial.LaplaceB != 1 {
+		t.Fatalf("noise not updated")
+	}
+}
+
+func TestServerAdminRounds(t *testing.T) {
+	var convoIdle, dialIdle sync.Mutex
+	convo := &ConvoService{
+		Idle:       &convoIdle,
+		PKI:        testPKI,
+		ServerName: "openstack2",
+		LastServer: true,
+	}
+	InitConvoService(convo)
+	dial := &DialService{Idle: &dialIdle, PKI: testPKI, ServerName: "openstack2", LastServer: true}
+	InitDialService(dial)
+	admin := &ServerAdmin{Token: "secret", Convo: convo, Dial: dial}
+
+	// Rounds runs alongside the rounds it reports on (see go test -race).
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := admin.Rounds(&AdminArgs{Token: "secret"}, new(AdminReply)); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for round := uint32(1); round <= 5; round++ {
+		if err := convo.NewRound(round, new(RoundSignature)); err != nil {
+			t.Fatal(err)
+		}
+		if err := convo.Open(&ConvoOpenArgs{Round: round}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := convo.Close(round, nil); err != nil {
+			t.Fatal(err)
+		}
+		<-convo.AccessCounts
+
+		if err := dial.NewRound(round, new(RoundSignature)); err != nil {
+			t.Fatal(err)
+		}
+		if err := dial.Add(&DialAddArgs{Round: round}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := dial.Close(round, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	reply := new(AdminReply)
+	if err := admin.Rounds(&AdminArgs{Token: "secret"}, reply); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range reply.Rounds {
+		if r.Service == "dial" {
+			t.Fatalf("closed dial round listed: %+v", r)
+		}
+	}
+}
+
+func TestCheckAdminAddr(t *testing.T) {
+	for addr, ok := range map[string]bool{
+		"localhost:2721":   true,
+		"127.0.0.1:2721":   true,
+		"[::1]:2721":       true,
+		":2721":            false,
+		"0.0.0.0:2721":     false,
+		"10.0.0.5:2721":    false,
+		"example.com:2721": false,
+		"localhost":        false,
+	} {
+		if err := CheckAdminAddr(addr); (err == nil) != ok {
+			t.Errorf("CheckAdminAddr(%q) = %v", addr, err)
+		}
+	}
+}
+
+func TestFakePickups(t *testing.T) {
+	pki, privateKeys := testChain(t, 2)
+	pki.MailboxRounds = 10
+
+	var idleA, idleB sync.Mutex
+	a := &ConvoService{
+		Idle:          &idleA,
+		MailboxMu:     5,
+		MailboxRounds: pki.MailboxRounds,
+		PKI:           pki,
+		ServerName:    "a",
+		PrivateKey:    privateKeys[0],
+	}
+	InitConvoService(a)
+	b := &ConvoService{
+		Idle:          &idleB,
+		MailboxRounds: pki.MailboxRounds,
+		PKI:           pki,
+		ServerName:    "b",
+		PrivateKey:    privateKeys[1],
+		LastServer:    true,
+	}
+	InitConvoService(b)
+
+	// runRound passes a's noise for round to b and returns b's counts.
+	runRound := func(round uint32) (*ConvoRound, *AccessCount) {
+		if err := a.NewRound(round, new(RoundSignature)); err != nil {
+			t.Fatal(err)
+		}
+		r := a.rounds[round]
+		r.noiseWg.Wait()
+		r.releaseIdle()
+
+		if err := b.NewRound(round, new(RoundSignature)); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Open(&ConvoOpenArgs{Round: round, NumIncoming: len(r.noise)}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Add(&ConvoAddArgs{Round: round, Onions: r.noise}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Close(round, nil); err != nil {
+			t.Fatal(err)
+		}
+		return r, <-b.AccessCounts
+	}
+
+	r, ac := runRound(1)
+	if r.numFakeDeposits != 5 || r.numFakePickups != 0 {
+		t.Fatalf("round 1: %d fake deposits, %d fake pickups", r.numFakeDeposits, r.numFakePickups)
+	}
+	if ac.Deposits != 5 || ac.Pickups != 0 {
+		t.Fatalf("round 1: %+v", ac)
+	}
+
+	r, ac = runRound(2)
+	if r.numFakePickups != 5 || ac.Pickups != 5 || ac.Deposits != 5 {
+		t.Fatalf("round 2: %d fake pickups, %+v", r.numFakePickups, ac)
+	}
+
+	// Round 2's deposits have expired by round 12.
+	r, ac = runRound(12)
+	if r.numFakePickups != 0 || ac.Pickups != 0 {
+		t.Fatalf("round 12: %d fake pickups, %+v", r.numFakePickups, ac)
+	}
+}
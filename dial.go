@@ -4,11 +4,13 @@ import (
 	"encoding/binary"
 	"fmt"
 	"sync"
+	"sync/atomic"
 
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/nacl/box"
 
 	. "github.com/davidlazar/vuvuzela/internal"
+	"github.com/davidlazar/vuvuzela/internal/workpool"
 	"github.com/davidlazar/vuvuzela/rand"
 	"github.com/davidlazar/vuvuzela/vrpc"
 )
@@ -17,26 +19,49 @@ type DialService struct {
 	roundsMu sync.RWMutex
 	rounds   map[uint32]*DialRound
 
-	Idle *sync.Mutex
+	Idle   *sync.Mutex
+	paused int32
 
+	noiseMu   sync.Mutex
 	LaplaceMu float64
 	LaplaceB  float64
 
+	pkiMu      sync.RWMutex
 	PKI        *PKI
 	ServerName string
 	PrivateKey *BoxKey
+	SigningKey *SigningKey
 	Client     *vrpc.Client
 	LastServer bool
+
+	// Transcript, if set, gets an entry for every round.
+	Transcript *Transcript
+
+	// SignedRounds, if set, makes sure round numbers only increase.
+	SignedRounds *SignedRounds
+
+	// Auditor, if set, checks the previous server's noise.
+	Auditor *NoiseAuditor
+
+	// Workers, if set, open the onions instead of this process.
+	Workers *Workers
 }
 
 type DialRound struct {
 	sync.Mutex
+	srv *DialService
+
+	status    dialStatus
+	holdsIdle int32
+	incoming  [][]byte
 
-	status   dialStatus
-	incoming [][]byte
+	// for the transcript
+	numIncoming    int
+	incomingLeaves [][32]byte
 
-	noise   [][]byte
-	noiseWg sync.WaitGroup
+	noise       [][]byte
+	noiseWg     sync.WaitGroup
+	noiseCommit *noiseCommit
 }
 
 type dialStatus int
@@ -46,6 +71,16 @@ const (
 	dialRoundClosed
 )
 
+func (s dialStatus) String() string {
+	switch s {
+	case dialRoundOpen:
+		return "open"
+	case dialRoundClosed:
+		return "closed"
+	}
+	return fmt.Sprintf("dialStatus(%d)", int(s))
+}
+
 func InitDialService(srv *DialService) {
 	srv.rounds = make(map[uint32]*DialRound)
 }
@@ -57,14 +92,27 @@ func (srv *DialService) getRound(round uint32, expectedStatus dialStatus) (*Dial
 	if !ok {
 		return nil, fmt.Errorf("round %d not found", round)
 	}
-	if r.status != expectedStatus {
-		return r, fmt.Errorf("round %d: status %v, expecting %v", round, r.status, expectedStatus)
+	r.Lock()
+	status := r.status
+	r.Unlock()
+	if status != expectedStatus {
+		return r, fmt.Errorf("round %d: status %v, expecting %v", round, status, expectedStatus)
 	}
 	return r, nil
 }
 
-func (srv *DialService) NewRound(Round uint32, _ *struct{}) error {
+func (r *DialRound) setStatus(status dialStatus) {
+	r.Lock()
+	r.status = status
+	r.Unlock()
+}
+
+func (srv *DialService) NewRound(Round uint32, sig *RoundSignature) error {
 	log.WithFields(log.Fields{"service": "dial", "rpc": "NewRound", "round": Round}).Info()
+
+	if atomic.LoadInt32(&srv.paused) != 0 {
+		return fmt.Errorf("dial rounds are paused")
+	}
 	srv.Idle.Lock()
 
 	srv.roundsMu.Lock()
@@ -72,32 +120,62 @@ func (srv *DialService) NewRound(Round uint32, _ *struct{}) error {
 
 	_, exists := srv.rounds[Round]
 	if exists {
+		srv.Idle.Unlock()
 		return fmt.Errorf("round %d already exists", Round)
 	}
+	if srv.Workers != nil {
+		if err := srv.Workers.Begin("dial", Round); err != nil {
+			srv.Idle.Unlock()
+			return err
+		}
+	}
+	// the last step that can fail, so a failed round can be retried
+	if err := srv.SignedRounds.advance("dial", Round); err != nil {
+		srv.Idle.Unlock()
+		return err
+	}
 
-	round := &DialRound{}
+	round := &DialRound{
+		srv:       srv,
+		holdsIdle: 1,
+	}
 	srv.rounds[Round] = round
+	pki := srv.pki()
+
+	srv.noiseMu.Lock()
+	mu, scale := srv.LaplaceMu, srv.LaplaceB
+	srv.noiseMu.Unlock()
+
+	// NOTE: unlike the convo protocol, the last server also adds noise
+	noiseTotal := 0
+	noiseCounts := make([]int, TotalDialBuckets)
+	for b := range noiseCounts {
+		bmu := cappedFlooredLaplace(mu, scale)
+		noiseCounts[b] = bmu
+		noiseTotal += bmu
+	}
+	if !srv.LastServer && srv.Client != nil {
+		round.noiseCommit = newNoiseCommit(srv.ServerName, "dial", Round, noiseTotal, srv.SigningKey)
+		round.noiseCommit.send(srv.Client)
+	}
 
 	round.noiseWg.Add(1)
 	go func() {
-		// NOTE: unlike the convo protocol, the last server also adds noise
-		noiseTotal := 0
-		noiseCounts := make([]int, TotalDialBuckets)
-		for b := range noiseCounts {
-			bmu := cappedFlooredLaplace(srv.LaplaceMu, srv.LaplaceB)
-			noiseCounts[b] = bmu
-			noiseTotal += bmu
-		}
 		round.noise = make([][]byte, noiseTotal)
 
 		nonce := ForwardNonce(Round)
-		nextKeys := srv.PKI.NextServerKeys(srv.ServerName).Keys()
+		nextKeys := pki.NextServerKeys(srv.ServerName).Keys()
 
 		FillWithFakeIntroductions(round.noise, noiseCounts, nonce, nextKeys)
 		round.noiseWg.Done()
 	}()
 
-	round.status = dialRoundOpen
+	round.setStatus(dialRoundOpen)
+	srv.Auditor.roundStarted("dial", Round)
+
+	*sig = *signRound(srv.SigningKey, pki.Epoch, func(ts int64) []byte {
+		return DialRoundMessage(Round, TotalDialBuckets, pki.Epoch, ts)
+	})
 	return nil
 }
 
@@ -116,10 +194,29 @@ func (srv *DialService) Add(args *DialAddArgs, _ *struct{}) error {
 
 	nonce := ForwardNonce(args.Round)
 	messages := make([][]byte, 0, len(args.Onions))
-	expectedOnionSize := srv.PKI.IncomingOnionOverhead(srv.ServerName) + SizeDialExchange
+	expectedOnionSize := srv.pki().IncomingOnionOverhead(srv.ServerName) + SizeDialExchange
+
+	var leaves [][32]byte
+	if srv.Transcript != nil {
+		leaves = make([][32]byte, len(args.Onions))
+	}
+	var opened *WorkerOpenResult
+	if srv.Workers != nil {
+		opened, err = srv.Workers.Open("dial", args.Round, expectedOnionSize, args.Onions, false)
+		if err != nil {
+			return err
+		}
+	}
 
-	for _, onion := range args.Onions {
-		if len(onion) == expectedOnionSize {
+	for i, onion := range args.Onions {
+		if leaves != nil {
+			leaves[i] = MerkleLeaf(onion)
+		}
+		if opened != nil {
+			if m := opened.Messages[i]; len(m) > 0 {
+				messages = append(messages, m)
+			}
+		} else if len(onion) == expectedOnionSize {
 			var theirPublic [32]byte
 			copy(theirPublic[:], onion[0:32])
 
@@ -132,6 +229,8 @@ func (srv *DialService) Add(args *DialAddArgs, _ *struct{}) error {
 
 	round.Lock()
 	round.incoming = append(round.incoming, messages...)
+	round.numIncoming += len(args.Onions)
+	round.incomingLeaves = append(round.incomingLeaves, leaves...)
 	round.Unlock()
 
 	return nil
@@ -161,6 +260,8 @@ func (srv *DialService) Close(Round uint32, _ *struct{}) error {
 	}
 
 	srv.filterIncoming(round)
+	valid := len(round.incoming)
+	srv.Auditor.roundClosed("dial", Round, round.numIncoming, valid)
 
 	round.noiseWg.Wait()
 	round.incoming = append(round.incoming, round.noise...)
@@ -168,25 +269,68 @@ func (srv *DialService) Close(Round uint32, _ *struct{}) error {
 	shuffler := NewShuffler(rand.Reader, len(round.incoming))
 	shuffler.Shuffle(round.incoming)
 
+	var entry *TranscriptEntry
+	if srv.Transcript != nil {
+		entry = &TranscriptEntry{
+			Service:      "dial",
+			Round:        Round,
+			Incoming:     round.numIncoming,
+			Valid:        valid,
+			Noise:        len(round.incoming) - valid,
+			Outgoing:     len(round.incoming),
+			IncomingRoot: MerkleRoot(round.incomingLeaves),
+			OutgoingRoot: merkleRootOf(round.incoming),
+		}
+		round.incomingLeaves = nil
+		srv.Transcript.record(entry)
+	}
+
 	if !srv.LastServer {
-		if err := NewDialRound(srv.Client, Round); err != nil {
+		if _, err := NewDialRound(srv.Client, Round); err != nil {
 			return fmt.Errorf("NewDialRound: %s", err)
 		}
-		srv.Idle.Unlock()
+		round.releaseIdle()
 
 		if err := RunDialRound(srv.Client, Round, round.incoming); err != nil {
 			return fmt.Errorf("RunDialRound: %s", err)
 		}
 		round.incoming = nil
+		if entry != nil {
+			go srv.Transcript.exchange(srv.Client, entry)
+		}
+		if round.noiseCommit != nil {
+			go func() {
+				upstream := srv.Transcript.upstream(srv.pki().PreviousServerName(srv.ServerName), "dial", Round)
+				round.noiseCommit.reveal(srv.Client, valid, upstream)
+			}()
+		}
 	} else {
-		srv.Idle.Unlock()
+		round.releaseIdle()
 	}
 	round.noise = nil
 
-	round.status = dialRoundClosed
+	round.setStatus(dialRoundClosed)
 	return nil
 }
 
+func (r *DialRound) releaseIdle() {
+	if atomic.CompareAndSwapInt32(&r.holdsIdle, 1, 0) {
+		r.srv.Idle.Unlock()
+	}
+}
+
+func (srv *DialService) pki() *PKI {
+	srv.pkiMu.RLock()
+	defer srv.pkiMu.RUnlock()
+	return srv.PKI
+}
+
+func (srv *DialService) SetPKI(pki *PKI) {
+	srv.pkiMu.Lock()
+	srv.PKI = pki
+	srv.pkiMu.Unlock()
+}
+
 type DialBucketsArgs struct {
 	Round uint32
 }
@@ -229,25 +373,25 @@ func (srv *DialService) Buckets(args *DialBucketsArgs, result *DialBucketsResult
 
 // TODO we should probably have a corresponding Delete rpc
 
-func NewDialRound(client *vrpc.Client, round uint32) error {
-	return client.Call("DialService.NewRound", round, nil)
+func NewDialRound(client *vrpc.Client, round uint32) (*RoundSignature, error) {
+	sig := new(RoundSignature)
+	err := client.Call("DialService.NewRound", round, sig)
+	return sig, err
 }
 
 func RunDialRound(client *vrpc.Client, round uint32, onions [][]byte) error {
 	spans := Spans(len(onions), 4000)
 	calls := make([]*vrpc.Call, len(spans))
 
-	ParallelFor(len(calls), func(p *P) {
-		for i, ok := p.Next(); ok; i, ok = p.Next() {
-			span := spans[i]
-			calls[i] = &vrpc.Call{
-				Method: "DialService.Add",
-				Args: &DialAddArgs{
-					Round:  round,
-					Onions: onions[span.Start : span.Start+span.Count],
-				},
-				Reply: nil,
-			}
+	workpool.For("dial/add", len(calls), func(i int) {
+		span := spans[i]
+		calls[i] = &vrpc.Call{
+			Method: "DialService.Add",
+			Args: &DialAddArgs{
+				Round:  round,
+				Onions: onions[span.Start : span.Start+span.Count],
+			},
+			Reply: nil,
 		}
 	})
 
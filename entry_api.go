@@ -2,8 +2,11 @@
 package vuvuzela
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"time"
 )
 
 //go:generate stringer -type=MsgType
@@ -22,6 +25,9 @@ const (
 	MsgDialBucket
 	MsgAnnounceConvoRound
 	MsgAnnounceDialRound
+
+	// from client to server
+	MsgDialBucketRequest
 )
 
 type Envelope struct {
@@ -36,12 +42,16 @@ func (e *Envelope) Open() (interface{}, error) {
 		v = new(ConvoRequest)
 	case MsgDialRequest:
 		v = new(DialRequest)
+	case MsgDialBucketRequest:
+		v = new(DialBucketRequest)
 	case MsgBadRequestError:
 		v = new(BadRequestError)
 	case MsgConvoError:
 		v = new(ConvoError)
 	case MsgConvoResponse:
 		v = new(ConvoResponse)
+	case MsgDialError:
+		v = new(DialError)
 	case MsgDialBucket:
 		v = new(DialBucket)
 	case MsgAnnounceConvoRound:
@@ -64,6 +74,8 @@ func Envelop(v interface{}) (*Envelope, error) {
 		t = MsgConvoRequest
 	case *DialRequest:
 		t = MsgDialRequest
+	case *DialBucketRequest:
+		t = MsgDialBucketRequest
 	case *BadRequestError:
 		t = MsgBadRequestError
 	case *ConvoError:
@@ -91,6 +103,29 @@ func Envelop(v interface{}) (*Envelope, error) {
 	}, nil
 }
 
+// Clients that can't use websockets talk to the entry server over plain
+// HTTP instead: they POST to HTTPConnectPath?publickey= to get an
+// HTTPSession, then long-poll HTTPRecvPath?session=&after= for an
+// HTTPBatch and POST each Envelope they send to HTTPSendPath?session=.
+const (
+	HTTPConnectPath = "/http/connect"
+	HTTPSendPath    = "/http/send"
+	HTTPRecvPath    = "/http/recv"
+	HTTPClosePath   = "/http/close"
+)
+
+type HTTPSession struct {
+	Session string
+}
+
+// An HTTPBatch answers a poll. Envelopes[i] has sequence number First+i,
+// starting from 1. The entry server sends envelopes again until a later
+// poll acknowledges them with after= the last sequence number seen.
+type HTTPBatch struct {
+	First     uint64
+	Envelopes []json.RawMessage
+}
+
 type ConvoRequest struct {
 	Round uint32
 	Onion []byte
@@ -101,6 +136,12 @@ type DialRequest struct {
 	Onion []byte
 }
 
+// DialBucketRequest asks the entry server for the client's dial bucket
+// from a recent round that it missed.
+type DialBucketRequest struct {
+	Round uint32
+}
+
 type BadRequestError struct {
 	Err string
 }
@@ -112,6 +153,10 @@ func (e *BadRequestError) Error() string {
 type ConvoError struct {
 	Round uint32
 	Err   string
+
+	// RetryAfter asks the client to sit out this many rounds when the
+	// entry server is shedding load.
+	RetryAfter uint32 `json:",omitempty"`
 }
 
 func (e *ConvoError) Error() string {
@@ -135,13 +180,70 @@ func (e *DialError) Error() string {
 type DialBucket struct {
 	Round  uint32
 	Intros [][SizeEncryptedIntro]byte
+
+	// Retained is set when the bucket answers a DialBucketRequest
+	// instead of a DialRequest.
+	Retained bool `json:",omitempty"`
 }
 
+// Round announcements are signed by the first server, so a misbehaving
+// entry server can't replay old round numbers to clients.
 type AnnounceConvoRound struct {
-	Round uint32
+	Round     uint32
+	Epoch     uint32
+	Timestamp int64
+	Signature []byte
 }
 
 type AnnounceDialRound struct {
-	Round   uint32
-	Buckets uint32
+	Round     uint32
+	Buckets   uint32
+	Epoch     uint32
+	Timestamp int64
+	Signature []byte
+}
+
+// RoundSignature is a server's reply to NewRound.
+type RoundSignature struct {
+	Epoch     uint32
+	Timestamp int64
+	Signature []byte
+}
+
+func ConvoRoundMessage(round, epoch uint32, timestamp int64) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("vuvuzela convo round")
+	binary.Write(buf, binary.BigEndian, round)
+	binary.Write(buf, binary.BigEndian, epoch)
+	binary.Write(buf, binary.BigEndian, timestamp)
+	return buf.Bytes()
+}
+
+func DialRoundMessage(round, buckets, epoch uint32, timestamp int64) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("vuvuzela dial round")
+	binary.Write(buf, binary.BigEndian, round)
+	binary.Write(buf, binary.BigEndian, buckets)
+	binary.Write(buf, binary.BigEndian, epoch)
+	binary.Write(buf, binary.BigEndian, timestamp)
+	return buf.Bytes()
+}
+
+func signRound(key *SigningKey, epoch uint32, message func(int64) []byte) *RoundSignature {
+	sig := &RoundSignature{
+		Epoch:     epoch,
+		Timestamp: time.Now().Unix(),
+	}
+	if key != nil {
+		sig.Signature = key.Sign(message(sig.Timestamp))
+	}
+	return sig
+}
+
+func (a *AnnounceConvoRound) Verify(key *VerifyKey) bool {
+	return key.Verify(ConvoRoundMessage(a.Round, a.Epoch, a.Timestamp), a.Signature)
+}
+
+func (a *AnnounceDialRound) Verify(key *VerifyKey) bool {
+	return key.Verify(DialRoundMessage(a.Round, a.Buckets, a.Epoch, a.Timestamp), a.Signature)
 }
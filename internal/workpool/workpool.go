@@ -0,0 +1,234 @@
+// Package workpool runs data-parallel loops on a persistent set of
+// goroutines.
+//
+// The goroutine that calls For or Do always works on its own loop, and
+// idle pool workers join in, so loops make progress when the pool is busy
+// and loops can nest. Chunks start large and shrink as the loop runs out
+// of work (guided scheduling), which keeps the overhead low for cheap
+// items without leaving one worker with a long tail at the end.
+package workpool
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Pool struct {
+	size    int
+	helpers chan *loop
+	done    chan struct{}
+
+	statsMu sync.Mutex
+	stats   map[string]*Stats
+}
+
+// Stats summarizes the loops run under one name.
+type Stats struct {
+	Name    string
+	Calls   int64
+	Items   int64
+	Chunks  int64
+	Helpers int64 // pool workers that joined a loop
+	Errors  int64
+	Elapsed time.Duration
+}
+
+// Default has a worker per CPU.
+var Default = New(runtime.NumCPU())
+
+// New starts a pool with the given number of workers, counting the
+// goroutine that calls For.
+func New(size int) *Pool {
+	if size < 1 {
+		size = 1
+	}
+	p := &Pool{
+		size:    size,
+		helpers: make(chan *loop),
+		done:    make(chan struct{}),
+		stats:   make(map[string]*Stats),
+	}
+	for i := 1; i < size; i++ {
+		go p.worker()
+	}
+	return p
+}
+
+// Close stops the pool's workers once they finish what they're doing.
+func (p *Pool) Close() {
+	close(p.done)
+}
+
+func (p *Pool) worker() {
+	for {
+		select {
+		case l := <-p.helpers:
+			l.run()
+			l.wg.Done()
+		case <-p.done:
+			return
+		}
+	}
+}
+
+type loop struct {
+	ctx  context.Context
+	f    func(i int) error
+	each func(i int) // replaces f for loops that can't fail
+	n    int64
+	next int64
+
+	// share is the number of goroutines the remaining work is split among
+	share int64
+
+	stopped int32
+	errMu   sync.Mutex
+	errs    Errors
+
+	chunks int64
+	wg     sync.WaitGroup
+}
+
+// minChunk keeps chunks from getting so small that claiming them costs
+// more than the items.
+const minChunk = 4
+
+func (l *loop) run() {
+	for atomic.LoadInt32(&l.stopped) == 0 {
+		if err := l.ctx.Err(); err != nil {
+			l.fail(err)
+			return
+		}
+		size := (l.n - atomic.LoadInt64(&l.next)) / (2 * l.share)
+		if size < minChunk {
+			size = minChunk
+		}
+		start := atomic.AddInt64(&l.next, size) - size
+		if start >= l.n {
+			return
+		}
+		end := start + size
+		if end > l.n {
+			end = l.n
+		}
+		atomic.AddInt64(&l.chunks, 1)
+		if l.each != nil {
+			for i := start; i < end; i++ {
+				l.each(int(i))
+			}
+			continue
+		}
+		for i := start; i < end; i++ {
+			if err := l.f(int(i)); err != nil {
+				l.fail(err)
+				return
+			}
+		}
+	}
+}
+
+func (l *loop) fail(err error) {
+	atomic.StoreInt32(&l.stopped, 1)
+	l.errMu.Lock()
+	l.errs = append(l.errs, err)
+	l.errMu.Unlock()
+}
+
+// Errors holds the errors from a loop. Once an item fails the loop stops
+// handing out work, so there is at most one error per worker.
+type Errors []error
+
+func (e Errors) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more errors)", e[0], len(e)-1)
+}
+
+// Do calls f(i) for every i in [0, n) and waits for the calls to finish.
+// If f returns an error or ctx is done, Do stops starting new items and
+// returns an Errors. name groups the loop's Stats.
+func (p *Pool) Do(ctx context.Context, name string, n int, f func(i int) error) error {
+	return p.do(&loop{ctx: ctx, f: f, n: int64(n)}, name)
+}
+
+// For is Do for loops that can't fail or be cancelled.
+func (p *Pool) For(name string, n int, f func(i int)) {
+	p.do(&loop{ctx: context.Background(), each: f, n: int64(n)}, name)
+}
+
+func (p *Pool) do(l *loop, name string) error {
+	start := time.Now()
+	n := int(l.n)
+
+	// Don't wake workers for less than a chunk each.
+	helpers := (n+minChunk-1)/minChunk - 1
+	if helpers > p.size-1 {
+		helpers = p.size - 1
+	}
+	if helpers < 0 {
+		helpers = 0
+	}
+	l.share = int64(helpers + 1)
+	joined := 0
+recruit:
+	for ; joined < helpers; joined++ {
+		l.wg.Add(1)
+		select {
+		case p.helpers <- l:
+		default:
+			// Everyone is busy; we'll do it ourselves.
+			l.wg.Done()
+			break recruit
+		}
+	}
+	l.run()
+	l.wg.Wait()
+
+	p.record(name, n, l, joined, time.Since(start))
+	if len(l.errs) > 0 {
+		return l.errs
+	}
+	return nil
+}
+
+func (p *Pool) record(name string, n int, l *loop, helpers int, elapsed time.Duration) {
+	p.statsMu.Lock()
+	defer p.statsMu.Unlock()
+	s := p.stats[name]
+	if s == nil {
+		s = &Stats{Name: name}
+		p.stats[name] = s
+	}
+	s.Calls++
+	s.Items += int64(n)
+	s.Chunks += atomic.LoadInt64(&l.chunks)
+	s.Helpers += int64(helpers)
+	s.Errors += int64(len(l.errs))
+	s.Elapsed += elapsed
+}
+
+// Stats returns the stats for each loop name, sorted by name.
+func (p *Pool) Stats() []Stats {
+	p.statsMu.Lock()
+	defer p.statsMu.Unlock()
+	stats := make([]Stats, 0, len(p.stats))
+	for _, s := range p.stats {
+		stats = append(stats, *s)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats
+}
+
+func Do(ctx context.Context, name string, n int, f func(i int) error) error {
+	return Default.Do(ctx, name, n, f)
+}
+
+func For(name string, n int, f func(i int)) {
+	Default.For(name, n, f)
+}
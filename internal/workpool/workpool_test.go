@@ -0,0 +1,173 @@
+package workpool
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFor(t *testing.T) {
+	p := New(4)
+	defer p.Close()
+
+	for _, n := range []int{0, 1, 3, 4, 5, 100, 10007} {
+		counts := make([]int32, n)
+		p.For("test", n, func(i int) {
+			atomic.AddInt32(&counts[i], 1)
+		})
+		for i, c := range counts {
+			if c != 1 {
+				t.Fatalf("n=%d: item %d ran %d times", n, i, c)
+			}
+		}
+	}
+
+	stats := p.Stats()
+	if len(stats) != 1 || stats[0].Calls != 7 || stats[0].Items != 10120 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	p := New(4)
+	defer p.Close()
+
+	var ran int32
+	errBad := errors.New("bad item")
+	err := p.Do(context.Background(), "test", 100000, func(i int) error {
+		atomic.AddInt32(&ran, 1)
+		if i == 10 {
+			return errBad
+		}
+		return nil
+	})
+	errs, ok := err.(Errors)
+	if !ok || len(errs) != 1 || errs[0] != errBad {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ran == 100000 {
+		t.Fatalf("expecting the loop to stop early")
+	}
+	if s := p.Stats()[0]; s.Errors != 1 {
+		t.Fatalf("expecting the error to be counted: %+v", s)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	p := New(4)
+	defer p.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var ran int32
+	err := p.Do(ctx, "test", 100000, func(i int) error {
+		if atomic.AddInt32(&ran, 1) == 100 {
+			cancel()
+		}
+		return nil
+	})
+	if errs, ok := err.(Errors); !ok || errs[0] != context.Canceled {
+		t.Fatalf("expecting context.Canceled, got %v", err)
+	}
+	if ran == 100000 {
+		t.Fatalf("expecting the loop to stop early")
+	}
+}
+
+// Loops inside loops can't wait on each other for workers.
+func TestNested(t *testing.T) {
+	p := New(2)
+	defer p.Close()
+
+	var total int32
+	p.For("outer", 16, func(i int) {
+		p.For("inner", 16, func(j int) {
+			atomic.AddInt32(&total, 1)
+		})
+	})
+	if total != 256 {
+		t.Fatalf("expecting 256 items, got %d", total)
+	}
+}
+
+// parallelFor is the ParallelFor (by Jelle van den Hooff) that this
+// package replaced, kept for the benchmarks.
+func parallelFor(n int, f func(i int)) {
+	step := n / runtime.NumCPU() / 100
+	if step < 10 {
+		step = 10
+	}
+	var current int64
+	var wg sync.WaitGroup
+	wg.Add(runtime.NumCPU())
+	for w := 0; w < runtime.NumCPU(); w++ {
+		go func() {
+			defer wg.Done()
+			for {
+				base := atomic.AddInt64(&current, int64(step)) - int64(step)
+				if base >= int64(n) {
+					return
+				}
+				end := base + int64(step)
+				if end > int64(n) {
+					end = int64(n)
+				}
+				for i := base; i < end; i++ {
+					f(int(i))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func cheap(out []int) func(i int) {
+	return func(i int) {
+		out[i] = i * i
+	}
+}
+
+func hash(out [][32]byte) func(i int) {
+	var data [256]byte
+	return func(i int) {
+		out[i] = sha256.Sum256(data[:])
+	}
+}
+
+func BenchmarkWorkpool(b *testing.B) {
+	for _, n := range []int{10, 1000, 100000} {
+		out := make([]int, n)
+		b.Run(fmt.Sprintf("cheap-%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				For("bench", n, cheap(out))
+			}
+		})
+		hashes := make([][32]byte, n)
+		b.Run(fmt.Sprintf("hash-%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				For("bench", n, hash(hashes))
+			}
+		})
+	}
+}
+
+func BenchmarkParallelFor(b *testing.B) {
+	for _, n := range []int{10, 1000, 100000} {
+		out := make([]int, n)
+		b.Run(fmt.Sprintf("cheap-%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				parallelFor(n, cheap(out))
+			}
+		})
+		hashes := make([][32]byte, n)
+		b.Run(fmt.Sprintf("hash-%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				parallelFor(n, hash(hashes))
+			}
+		})
+	}
+}
@@ -4,9 +4,9 @@ package vuvuzela
 
 import "fmt"
 
-const _MsgType_name = "MsgConvoRequestMsgDialRequestMsgBadRequestErrorMsgConvoErrorMsgConvoResponseMsgDialErrorMsgDialBucketMsgAnnounceConvoRoundMsgAnnounceDialRound"
+const _MsgType_name = "MsgConvoRequestMsgDialRequestMsgBadRequestErrorMsgConvoErrorMsgConvoResponseMsgDialErrorMsgDialBucketMsgAnnounceConvoRoundMsgAnnounceDialRoundMsgDialBucketRequest"
 
-var _MsgType_index = [...]uint8{0, 15, 29, 47, 60, 76, 88, 101, 122, 142}
+var _MsgType_index = [...]uint8{0, 15, 29, 47, 60, 76, 88, 101, 122, 142, 162}
 
 func (i MsgType) String() string {
 	if i >= MsgType(len(_MsgType_index)-1) {
@@ -3,35 +3,61 @@ package vuvuzela
 import (
 	"encoding/binary"
 
-	. "github.com/davidlazar/vuvuzela/internal"
+	"github.com/davidlazar/vuvuzela/internal/workpool"
 	"github.com/davidlazar/vuvuzela/onionbox"
 	"github.com/davidlazar/vuvuzela/rand"
 )
 
 func FillWithFakeSingles(dest [][]byte, nonce *[24]byte, nextKeys []*[32]byte) {
-	ParallelFor(len(dest), func(p *P) {
-		for i, ok := p.Next(); ok; i, ok = p.Next() {
-			var exchange [SizeConvoExchange]byte
-			rand.Read(exchange[:])
-			onion, _ := onionbox.Seal(exchange[:], nonce, nextKeys)
-			dest[i] = onion
-		}
+	workpool.For("noise/singles", len(dest), func(i int) {
+		var exchange [SizeConvoExchange]byte
+		rand.Read(exchange[:])
+		exchange[16] = byte(ExchangeSwap)
+		onion, _ := onionbox.Seal(exchange[:], nonce, nextKeys)
+		dest[i] = onion
 	})
 }
 
 func FillWithFakeDoubles(dest [][]byte, nonce *[24]byte, nextKeys []*[32]byte) {
-	ParallelFor(len(dest)/2, func(p *P) {
-		for i, ok := p.Next(); ok; i, ok = p.Next() {
-			var exchange1 [SizeConvoExchange]byte
-			var exchange2 [SizeConvoExchange]byte
-			rand.Read(exchange1[:])
-			copy(exchange2[0:16], exchange1[0:16])
-			rand.Read(exchange2[16:])
-			onion1, _ := onionbox.Seal(exchange1[:], nonce, nextKeys)
-			onion2, _ := onionbox.Seal(exchange2[:], nonce, nextKeys)
-			dest[i*2] = onion1
-			dest[i*2+1] = onion2
+	workpool.For("noise/doubles", len(dest)/2, func(i int) {
+		var exchange1 [SizeConvoExchange]byte
+		var exchange2 [SizeConvoExchange]byte
+		rand.Read(exchange1[:])
+		copy(exchange2[0:16], exchange1[0:16])
+		rand.Read(exchange2[16:])
+		exchange1[16] = byte(ExchangeSwap)
+		exchange2[16] = byte(ExchangeSwap)
+		onion1, _ := onionbox.Seal(exchange1[:], nonce, nextKeys)
+		onion2, _ := onionbox.Seal(exchange2[:], nonce, nextKeys)
+		dest[i*2] = onion1
+		dest[i*2+1] = onion2
+	})
+}
+
+// FillWithFakeDeposits leaves mail in the given dead drops. With fewer
+// drops than dest, the rest go to random ones.
+func FillWithFakeDeposits(dest [][]byte, drops []DeadDrop, nonce *[24]byte, nextKeys []*[32]byte) {
+	workpool.For("noise/deposits", len(dest), func(i int) {
+		var exchange [SizeConvoExchange]byte
+		rand.Read(exchange[:])
+		if i < len(drops) {
+			copy(exchange[0:16], drops[i][:])
 		}
+		exchange[16] = byte(ExchangeDeposit)
+		onion, _ := onionbox.Seal(exchange[:], nonce, nextKeys)
+		dest[i] = onion
+	})
+}
+
+// FillWithFakePickups checks the mailboxes of the given dead drops.
+func FillWithFakePickups(dest [][]byte, drops []DeadDrop, nonce *[24]byte, nextKeys []*[32]byte) {
+	workpool.For("noise/pickups", len(dest), func(i int) {
+		var exchange [SizeConvoExchange]byte
+		rand.Read(exchange[:])
+		copy(exchange[0:16], drops[i][:])
+		exchange[16] = byte(ExchangeSwap)
+		onion, _ := onionbox.Seal(exchange[:], nonce, nextKeys)
+		dest[i] = onion
 	})
 }
 
@@ -45,13 +71,11 @@ func FillWithFakeIntroductions(dest [][]byte, noiseCounts []int, nonce *[24]byte
 		}
 	}
 
-	ParallelFor(len(dest), func(p *P) {
-		for i, ok := p.Next(); ok; i, ok = p.Next() {
-			var exchange [SizeDialExchange]byte
-			binary.BigEndian.PutUint32(exchange[0:4], uint32(buckets[i]))
-			rand.Read(exchange[4:])
-			onion, _ := onionbox.Seal(exchange[:], nonce, nextKeys)
-			dest[i] = onion
-		}
+	workpool.For("noise/intros", len(dest), func(i int) {
+		var exchange [SizeDialExchange]byte
+		binary.BigEndian.PutUint32(exchange[0:4], uint32(buckets[i]))
+		rand.Read(exchange[4:])
+		onion, _ := onionbox.Seal(exchange[:], nonce, nextKeys)
+		dest[i] = onion
 	})
 }
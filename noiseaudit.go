@@ -0,0 +1,487 @@
+package vuvuzela
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/davidlazar/vuvuzela/vrpc"
+)
+
+// Noise auditing lets the next server in the chain catch a server that
+// skips its noise. In NewRound, before it has seen any of the round's
+// onions, a server commits to the total number of noise onions it will
+// add. After the round it reveals the total and how many real onions it
+// forwarded, along with the transcript entry its own predecessor signed
+// for the round. The next server checks that the real onions match what
+// the predecessor says it sent, that real and noise onions add up to
+// what it received, and that every onion it received opened.
+//
+// Only totals are checked. The split between fake singles and doubles
+// stays secret, so the audit doesn't show how the noise was spread over
+// dead drops. The first server's real count has nothing to be checked
+// against, since the entry server doesn't sign what it sends. The last
+// server's dial noise isn't audited at all: no server comes after it.
+//
+// The commitment is sent before NewRound returns, so it reaches the next
+// server before this server can start the next server's round.
+
+// A NoiseCommitment binds a server to its noise total for a round.
+type NoiseCommitment struct {
+	Server    string
+	Service   string
+	Round     uint32
+	Digest    []byte
+	Signature []byte `json:",omitempty"`
+}
+
+// A NoiseReveal opens a NoiseCommitment after the round.
+type NoiseReveal struct {
+	Server  string
+	Service string
+	Round   uint32
+	Valid   int // real onions forwarded
+	Noise   int
+	Salt    []byte
+
+	// Upstream is the transcript entry the revealing server got from
+	// its own predecessor, which says how many onions it was sent.
+	Upstream *TranscriptEntry `json:",omitempty"`
+
+	Signature []byte `json:",omitempty"`
+}
+
+func noiseDigest(server, service string, round uint32, noise int, salt []byte) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("vuvuzela noise")
+	writeString(buf, server)
+	writeString(buf, service)
+	binary.Write(buf, binary.BigEndian, round)
+	binary.Write(buf, binary.BigEndian, uint64(noise))
+	buf.Write(salt)
+	h := sha256.Sum256(buf.Bytes())
+	return h[:]
+}
+
+func (c *NoiseCommitment) signedData() []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("vuvuzela noise commitment")
+	writeString(buf, c.Server)
+	writeString(buf, c.Service)
+	binary.Write(buf, binary.BigEndian, c.Round)
+	buf.Write(c.Digest)
+	return buf.Bytes()
+}
+
+func (r *NoiseReveal) signedData() []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("vuvuzela noise reveal")
+	writeString(buf, r.Server)
+	writeString(buf, r.Service)
+	binary.Write(buf, binary.BigEndian, r.Round)
+	binary.Write(buf, binary.BigEndian, uint64(r.Valid))
+	binary.Write(buf, binary.BigEndian, uint64(r.Noise))
+	buf.Write(r.Salt)
+	if r.Upstream != nil {
+		buf.Write(r.Upstream.Hash())
+	}
+	return buf.Bytes()
+}
+
+// noiseCommit is the committing side of one round.
+type noiseCommit struct {
+	server  string
+	service string
+	round   uint32
+	noise   int
+	salt    []byte
+	key     *SigningKey
+}
+
+func newNoiseCommit(server, service string, round uint32, noise int, key *SigningKey) *noiseCommit {
+	salt := make([]byte, 32)
+	rand.Read(salt)
+	return &noiseCommit{
+		server:  server,
+		service: service,
+		round:   round,
+		noise:   noise,
+		salt:    salt,
+		key:     key,
+	}
+}
+
+func (nc *noiseCommit) logger(call string) *log.Entry {
+	return log.WithFields(log.Fields{"service": nc.service, "round": nc.round, "call": call})
+}
+
+func (nc *noiseCommit) commitment() *NoiseCommitment {
+	c := &NoiseCommitment{
+		Server:  nc.server,
+		Service: nc.service,
+		Round:   nc.round,
+		Digest:  noiseDigest(nc.server, nc.service, nc.round, nc.noise, nc.salt),
+	}
+	if nc.key != nil {
+		c.Signature = nc.key.Sign(c.signedData())
+	}
+	return c
+}
+
+// send gives the commitment to the next server. Errors are logged: an
+// unreachable auditor shouldn't stop the round.
+func (nc *noiseCommit) send(client *vrpc.Client) {
+	if err := client.Call("NoiseService.Commit", nc.commitment(), nil); err != nil {
+		nc.logger("NoiseService.Commit").Error(err)
+	}
+}
+
+func (nc *noiseCommit) opening(valid int, upstream *TranscriptEntry) *NoiseReveal {
+	r := &NoiseReveal{
+		Server:   nc.server,
+		Service:  nc.service,
+		Round:    nc.round,
+		Valid:    valid,
+		Noise:    nc.noise,
+		Salt:     nc.salt,
+		Upstream: upstream,
+	}
+	if nc.key != nil {
+		r.Signature = nc.key.Sign(r.signedData())
+	}
+	return r
+}
+
+func (nc *noiseCommit) reveal(client *vrpc.Client, valid int, upstream *TranscriptEntry) {
+	if err := client.Call("NoiseService.Reveal", nc.opening(valid, upstream), nil); err != nil {
+		nc.logger("NoiseService.Reveal").Error(err)
+	}
+}
+
+// NoiseAuditStats summarizes the audit of the previous server's noise
+// for one service.
+type NoiseAuditStats struct {
+	Service     string
+	Server      string
+	Rounds      int // rounds audited
+	Failures    int
+	TotalNoise  int
+	LastProblem string `json:",omitempty"`
+}
+
+func (s *NoiseAuditStats) MeanNoise() float64 {
+	if s.Rounds == 0 {
+		return 0
+	}
+	return float64(s.TotalNoise) / float64(s.Rounds)
+}
+
+const (
+	// rounds kept waiting for a reveal
+	noiseAuditRounds = 64
+
+	// how often to log a summary, in audited rounds
+	noiseAuditReport = 100
+)
+
+type auditKey struct {
+	service string
+	round   uint32
+}
+
+type auditRound struct {
+	started    bool
+	lateCommit bool
+	commit     *NoiseCommitment
+	reveal     *NoiseReveal
+
+	closed   bool
+	incoming int
+	valid    int
+
+	done bool
+}
+
+// NoiseAuditor checks the previous server's noise. It is fed by
+// NoiseService and by the convo and dial services' round lifecycle.
+type NoiseAuditor struct {
+	// Previous is the server whose noise is audited, and VerifyKey,
+	// if set, must have signed its commitments and reveals.
+	Previous  string
+	VerifyKey *VerifyKey
+
+	// Upstream is the server before Previous, whose signed transcript
+	// entries bound Previous's real onions, or empty if Previous is the
+	// first server. SetPKI fills it in.
+	Upstream    string
+	UpstreamKey *VerifyKey
+
+	// MinMeanNoise, by service, is the least average noise per round
+	// that doesn't draw a warning in the periodic summary.
+	MinMeanNoise map[string]float64
+
+	mu     sync.Mutex
+	rounds map[auditKey]*auditRound
+	newest map[string]uint32
+	stats  map[string]*NoiseAuditStats
+}
+
+func NewNoiseAuditor(previous string, verifyKey *VerifyKey) *NoiseAuditor {
+	return &NoiseAuditor{
+		Previous:     previous,
+		VerifyKey:    verifyKey,
+		MinMeanNoise: make(map[string]float64),
+		rounds:       make(map[auditKey]*auditRound),
+		newest:       make(map[string]uint32),
+		stats:        make(map[string]*NoiseAuditStats),
+	}
+}
+
+// SetPKI picks up a new verify key for the previous server.
+func (a *NoiseAuditor) SetPKI(pki *PKI) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if s, ok := pki.Servers[a.Previous]; ok {
+		a.VerifyKey = s.VerifyKey
+	}
+	a.Upstream = pki.PreviousServerName(a.Previous)
+	a.UpstreamKey = nil
+	if a.Upstream != "" {
+		a.UpstreamKey = pki.Servers[a.Upstream].VerifyKey
+	}
+}
+
+func (a *NoiseAuditor) round(service string, round uint32) *auditRound {
+	key := auditKey{service, round}
+	r, ok := a.rounds[key]
+	if !ok {
+		r = new(auditRound)
+		a.rounds[key] = r
+	}
+	if round > a.newest[service] {
+		a.newest[service] = round
+		a.prune(service)
+	}
+	return r
+}
+
+// prune drops old rounds. A closed round that was never revealed counts
+// as a failure.
+func (a *NoiseAuditor) prune(service string) {
+	newest := a.newest[service]
+	if newest < noiseAuditRounds {
+		return
+	}
+	for key, r := range a.rounds {
+		if key.service != service || key.round > newest-noiseAuditRounds {
+			continue
+		}
+		if r.closed && !r.done {
+			a.finish(service, key.round, r, nil, []string{"no reveal"})
+		}
+		delete(a.rounds, key)
+	}
+}
+
+func (a *NoiseAuditor) roundStarted(service string, round uint32) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.round(service, round).started = true
+}
+
+// roundClosed records what this server received from the previous one.
+func (a *NoiseAuditor) roundClosed(service string, round uint32, incoming, valid int) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	r := a.round(service, round)
+	r.closed = true
+	r.incoming = incoming
+	r.valid = valid
+	a.check(service, round, r)
+}
+
+func (a *NoiseAuditor) commit(c *NoiseCommitment) error {
+	if c.Server != a.Previous {
+		return fmt.Errorf("expecting noise commitments from %q, not %q", a.Previous, c.Server)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.VerifyKey != nil && !a.VerifyKey.Verify(c.signedData(), c.Signature) {
+		return fmt.Errorf("bad signature on noise commitment")
+	}
+	r := a.round(c.Service, c.Round)
+	if r.commit != nil {
+		return fmt.Errorf("round %d: already committed", c.Round)
+	}
+	r.commit = c
+	// A commitment made after the previous server started sending us
+	// the round could depend on the round's onions.
+	r.lateCommit = r.started
+	return nil
+}
+
+func (a *NoiseAuditor) reveal(rv *NoiseReveal) error {
+	if rv.Server != a.Previous {
+		return fmt.Errorf("expecting noise reveals from %q, not %q", a.Previous, rv.Server)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.VerifyKey != nil && !a.VerifyKey.Verify(rv.signedData(), rv.Signature) {
+		return fmt.Errorf("bad signature on noise reveal")
+	}
+	r := a.round(rv.Service, rv.Round)
+	if r.reveal != nil {
+		return fmt.Errorf("round %d: already revealed", rv.Round)
+	}
+	r.reveal = rv
+	a.check(rv.Service, rv.Round, r)
+	return nil
+}
+
+// check audits a round once it is closed and revealed.
+func (a *NoiseAuditor) check(service string, round uint32, r *auditRound) {
+	if r.done || !r.closed || r.reveal == nil {
+		return
+	}
+	rv := r.reveal
+
+	var problems []string
+	switch {
+	case r.commit == nil:
+		problems = append(problems, "no commitment")
+	case r.lateCommit:
+		problems = append(problems, "commitment arrived after the round started")
+	case !bytes.Equal(r.commit.Digest, noiseDigest(rv.Server, rv.Service, rv.Round, rv.Noise, rv.Salt)):
+		problems = append(problems, "reveal doesn't match commitment")
+	}
+	if rv.Valid < 0 || rv.Noise < 0 {
+		problems = append(problems, fmt.Sprintf("negative counts: %d real, %d noise", rv.Valid, rv.Noise))
+	}
+	if p := a.checkUpstream(service, round, rv); p != "" {
+		problems = append(problems, p)
+	}
+	if rv.Valid+rv.Noise != r.incoming {
+		problems = append(problems, fmt.Sprintf("claims %d real + %d noise onions, sent %d", rv.Valid, rv.Noise, r.incoming))
+	}
+	if r.valid < r.incoming {
+		problems = append(problems, fmt.Sprintf("%d of %d onions didn't open or were replays", r.incoming-r.valid, r.incoming))
+	}
+	a.finish(service, round, r, rv, problems)
+}
+
+// checkUpstream compares the real onions Previous claims to have forwarded
+// with what its predecessor signed for sending it. Every onion from an
+// honest server opens, so a server that forwarded fewer either dropped
+// some or is passing off missing noise as real onions.
+func (a *NoiseAuditor) checkUpstream(service string, round uint32, rv *NoiseReveal) string {
+	if a.Upstream == "" {
+		return ""
+	}
+	up := rv.Upstream
+	switch {
+	case up == nil:
+		return fmt.Sprintf("no transcript entry from %s", a.Upstream)
+	case up.Server != a.Upstream || up.Service != service || up.Round != round:
+		return fmt.Sprintf("transcript entry is for %s %s round %d", up.Server, up.Service, up.Round)
+	case a.UpstreamKey != nil && !up.Verify(a.UpstreamKey):
+		return fmt.Sprintf("bad signature on transcript entry from %s", a.Upstream)
+	case rv.Valid != up.Outgoing:
+		return fmt.Sprintf("claims %d real onions, but %s sent it %d", rv.Valid, a.Upstream, up.Outgoing)
+	}
+	return ""
+}
+
+func (a *NoiseAuditor) finish(service string, round uint32, r *auditRound, rv *NoiseReveal, problems []string) {
+	r.done = true
+
+	s, ok := a.stats[service]
+	if !ok {
+		s = &NoiseAuditStats{Service: service, Server: a.Previous}
+		a.stats[service] = s
+	}
+	s.Rounds++
+	if rv != nil {
+		s.TotalNoise += rv.Noise
+	}
+
+	rlog := log.WithFields(log.Fields{"service": service, "round": round, "call": "NoiseAudit", "server": a.Previous})
+	if len(problems) > 0 {
+		s.Failures++
+		s.LastProblem = fmt.Sprintf("round %d: %s", round, problems[0])
+		for _, p := range problems {
+			rlog.Warn(p)
+		}
+	} else {
+		rlog.WithField("noise", rv.Noise).Debug("ok")
+	}
+
+	if s.Rounds%noiseAuditReport == 0 {
+		slog := log.WithFields(log.Fields{
+			"service":  service,
+			"call":     "NoiseAudit",
+			"server":   a.Previous,
+			"rounds":   s.Rounds,
+			"failures": s.Failures,
+			"mean":     fmt.Sprintf("%.1f", s.MeanNoise()),
+		})
+		if min := a.MinMeanNoise[service]; min > 0 && s.MeanNoise() < min {
+			slog.Warnf("mean noise below %.1f", min)
+		} else {
+			slog.Info("summary")
+		}
+	}
+}
+
+// Stats returns the audit totals for each service.
+func (a *NoiseAuditor) Stats() []NoiseAuditStats {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	stats := make([]NoiseAuditStats, 0, len(a.stats))
+	for _, s := range a.stats {
+		stats = append(stats, *s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Service < stats[j].Service
+	})
+	return stats
+}
+
+// NoiseService receives the previous server's noise commitments and
+// reveals. With no Auditor (on the first server) it ignores them.
+type NoiseService struct {
+	Auditor *NoiseAuditor
+}
+
+func (srv *NoiseService) Commit(c *NoiseCommitment, _ *struct{}) error {
+	if srv.Auditor == nil {
+		return nil
+	}
+	return srv.Auditor.commit(c)
+}
+
+func (srv *NoiseService) Reveal(r *NoiseReveal, _ *struct{}) error {
+	if srv.Auditor == nil {
+		return nil
+	}
+	return srv.Auditor.reveal(r)
+}
@@ -0,0 +1,142 @@
+package vuvuzela
+
+import (
+	"crypto/rand"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/davidlazar/vuvuzela/onionbox"
+)
+
+func TestNoiseAudit(t *testing.T) {
+	// c audits b, whose real onions are bounded by what a sent it.
+	pki, privateKeys := testChain(t, 3)
+	verifyKey, signingKey, _ := GenerateSigningKey(rand.Reader)
+	pki.Servers["b"].VerifyKey = verifyKey
+	upstreamVerifyKey, upstreamKey, _ := GenerateSigningKey(rand.Reader)
+	pki.Servers["a"].VerifyKey = upstreamVerifyKey
+
+	auditor := NewNoiseAuditor("b", verifyKey)
+	auditor.SetPKI(pki)
+	noise := &NoiseService{Auditor: auditor}
+
+	var idle sync.Mutex
+	srv := &ConvoService{
+		Idle:       &idle,
+		PKI:        pki,
+		ServerName: "c",
+		PrivateKey: privateKeys[2],
+		LastServer: true,
+		Auditor:    auditor,
+	}
+	InitConvoService(srv)
+
+	upstream := func(round uint32, outgoing int) *TranscriptEntry {
+		e := &TranscriptEntry{Server: "a", Service: "convo", Round: round, Outgoing: outgoing}
+		e.Signature = upstreamKey.Sign(e.signedData())
+		return e
+	}
+
+	// runRound has server b commit to 2 noise onions (late if
+	// commitLate), send sent onions to c, and reveal valid real ones
+	// along with up.
+	runRound := func(round uint32, sent, valid int, up *TranscriptEntry, commitLate bool) {
+		nc := newNoiseCommit("b", "convo", round, 2, signingKey)
+		if !commitLate {
+			if err := noise.Commit(nc.commitment(), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := srv.NewRound(round, new(RoundSignature)); err != nil {
+			t.Fatal(err)
+		}
+		if commitLate {
+			if err := noise.Commit(nc.commitment(), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		onions := make([][]byte, sent)
+		for i := range onions {
+			ex := make([]byte, SizeConvoExchange)
+			rand.Read(ex)
+			onions[i], _ = onionbox.Seal(ex, ForwardNonce(round), BoxKeys{pki.Servers["c"].PublicKey}.Keys())
+		}
+		if err := srv.Open(&ConvoOpenArgs{Round: round, NumIncoming: sent}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := srv.Add(&ConvoAddArgs{Round: round, Onions: onions}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := srv.Close(round, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := noise.Reveal(nc.opening(valid, up), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := func() NoiseAuditStats {
+		s := auditor.Stats()
+		if len(s) != 1 {
+			t.Fatalf("expecting stats for one service, got %d", len(s))
+		}
+		return s[0]
+	}
+
+	runRound(1, 5, 3, upstream(1, 3), false)
+	if s := stats(); s.Rounds != 1 || s.Failures != 0 || s.TotalNoise != 2 {
+		t.Fatalf("honest round: %+v", s)
+	}
+
+	// Claims 3 real and 2 noise onions but only sent the real ones.
+	runRound(2, 3, 3, upstream(2, 3), false)
+	if s := stats(); s.Failures != 1 || !strings.Contains(s.LastProblem, "sent 3") {
+		t.Fatalf("missing noise not detected: %+v", s)
+	}
+
+	// Adds no noise and passes off 2 of a's onions as noise.
+	runRound(3, 5, 3, upstream(3, 5), false)
+	if s := stats(); s.Failures != 2 || !strings.Contains(s.LastProblem, "a sent it 5") {
+		t.Fatalf("noise passed off as real onions not detected: %+v", s)
+	}
+
+	runRound(4, 5, 3, nil, false)
+	if s := stats(); s.Failures != 3 || !strings.Contains(s.LastProblem, "no transcript entry") {
+		t.Fatalf("missing upstream entry not detected: %+v", s)
+	}
+
+	forgedUp := upstream(5, 3)
+	forgedUp.Outgoing = 2
+	runRound(5, 4, 2, forgedUp, false)
+	if s := stats(); s.Failures != 4 || !strings.Contains(s.LastProblem, "bad signature") {
+		t.Fatalf("forged upstream entry not detected: %+v", s)
+	}
+
+	runRound(6, 5, 3, upstream(6, 3), true)
+	if s := stats(); s.Failures != 5 || !strings.Contains(s.LastProblem, "after the round started") {
+		t.Fatalf("late commitment not detected: %+v", s)
+	}
+
+	// Revealing a different total than committed.
+	nc := newNoiseCommit("b", "convo", 7, 2, signingKey)
+	noise.Commit(nc.commitment(), nil)
+	nc.noise = 3
+	auditor.roundClosed("convo", 7, 5, 5)
+	noise.Reveal(nc.opening(2, upstream(7, 2)), nil)
+	if s := stats(); s.Failures != 6 || !strings.Contains(s.LastProblem, "doesn't match") {
+		t.Fatalf("changed total not detected: %+v", s)
+	}
+
+	nc = newNoiseCommit("b", "convo", 8, -2, signingKey)
+	noise.Commit(nc.commitment(), nil)
+	auditor.roundClosed("convo", 8, 3, 3)
+	noise.Reveal(nc.opening(5, upstream(8, 5)), nil)
+	if s := stats(); s.Failures != 7 || !strings.Contains(s.LastProblem, "negative") {
+		t.Fatalf("negative noise not detected: %+v", s)
+	}
+
+	forged := newNoiseCommit("b", "convo", 9, 2, nil).commitment()
+	if err := noise.Commit(forged, nil); err == nil {
+		t.Fatalf("expecting unsigned commitment to be rejected")
+	}
+}
@@ -1,6 +1,7 @@
 package onionbox
 
 import (
+	"golang.org/x/crypto/curve25519"
 	"golang.org/x/crypto/nacl/box"
 
 	"github.com/davidlazar/vuvuzela/rand"
@@ -10,15 +11,27 @@ import (
 const Overhead = 32 + box.Overhead
 
 func Seal(message []byte, nonce *[24]byte, publicKeys []*[32]byte) ([]byte, []*[32]byte) {
-	onion := message
-	sharedKeys := make([]*[32]byte, len(publicKeys))
-	for i := len(publicKeys) - 1; i >= 0; i-- {
-		myPublicKey, myPrivateKey, err := box.GenerateKey(rand.Reader)
+	ephemeralKeys := make([]*[32]byte, len(publicKeys))
+	for i := range ephemeralKeys {
+		_, myPrivateKey, err := box.GenerateKey(rand.Reader)
 		if err != nil {
 			panic(err)
 		}
+		ephemeralKeys[i] = myPrivateKey
+	}
+	return SealWithKeys(message, nonce, publicKeys, ephemeralKeys)
+}
+
+// SealWithKeys is Seal with the ephemeral private key for each layer
+// given instead of generated. It's for test vectors: never reuse the keys.
+func SealWithKeys(message []byte, nonce *[24]byte, publicKeys, ephemeralKeys []*[32]byte) ([]byte, []*[32]byte) {
+	onion := message
+	sharedKeys := make([]*[32]byte, len(publicKeys))
+	for i := len(publicKeys) - 1; i >= 0; i-- {
+		var myPublicKey [32]byte
+		curve25519.ScalarBaseMult(&myPublicKey, ephemeralKeys[i])
 		sharedKeys[i] = new([32]byte)
-		box.Precompute(sharedKeys[i], (*[32]byte)(publicKeys[i]), myPrivateKey)
+		box.Precompute(sharedKeys[i], (*[32]byte)(publicKeys[i]), ephemeralKeys[i])
 
 		onion = box.SealAfterPrecomputation(myPublicKey[:], onion, nonce, sharedKeys[i])
 	}
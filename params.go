@@ -7,10 +7,36 @@ import (
 const (
 	SizeMessage = 240
 
+	// SizeIntroNote is the room for the caller's note in an Introduction.
+	SizeIntroNote = 48
+
 	// Eventually this might be dynamic, but one bucket is usually
 	// sufficient if users don't dial very often.
 	TotalDialBuckets = 1
 
+	// Mailbox dead drops change every MailboxWindow rounds. Clients look
+	// for mail in every window the last server still keeps (see
+	// PKI.MailboxLookback).
+	MailboxWindow = 32
+
+	// After a dial, peers ease into their conversation over this many
+	// rounds instead of all starting to exchange at once.
+	ScheduleRamp = 8
+
+	// Introductions can't delay a conversation's start by more than
+	// this many rounds.
+	MaxScheduleDelay = 1000
+
+	// The entry server keeps this many rounds of dial buckets for
+	// clients that reconnect, and clients always fetch all of them.
+	DialHistoryRounds = 32
+
+	// An HTTP long-poll returns after this long even if there is
+	// nothing to deliver, and the entry server ends sessions that go
+	// HTTPSessionTimeout without polling.
+	HTTPPollWait       = 25 * time.Second
+	HTTPSessionTimeout = 60 * time.Second
+
 	DialWait           = 10 * time.Second
 	DefaultReceiveWait = 5 * time.Second
 
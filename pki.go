@@ -1,19 +1,22 @@
 package vuvuzela
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"net"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/nacl/box"
 
-	. "github.com/davidlazar/vuvuzela/internal"
 	"github.com/davidlazar/vuvuzela/onionbox"
 )
 
 type ServerInfo struct {
 	Address   string
 	PublicKey *BoxKey
+	VerifyKey *VerifyKey `json:",omitempty"`
 }
 
 type PKI struct {
@@ -21,29 +24,79 @@ type PKI struct {
 	Servers     map[string]*ServerInfo
 	ServerOrder []string
 	EntryServer string
+
+	// Epoch changes whenever the servers or their keys do. Round
+	// announcements are signed for a specific epoch.
+	Epoch uint32 `json:",omitempty"`
+
+	// MailboxRounds is how long the last server keeps mailbox deposits
+	// (0 disables mailboxes). Clients look back far enough to find them.
+	MailboxRounds int `json:",omitempty"`
 }
 
 func ReadPKI(jsonPath string) *PKI {
+	pki, err := LoadPKI(jsonPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return pki
+}
+
+// LoadPKI is like ReadPKI but returns errors instead of exiting, for
+// reloading the PKI in a running server.
+func LoadPKI(jsonPath string) (*PKI, error) {
+	data, err := ioutil.ReadFile(jsonPath)
+	if err != nil {
+		return nil, err
+	}
 	pki := new(PKI)
-	ReadJSONFile(jsonPath, pki)
+	if err := json.Unmarshal(data, pki); err != nil {
+		return nil, fmt.Errorf("%q: %s", jsonPath, err)
+	}
 	if len(pki.ServerOrder) == 0 {
-		log.Fatalf("%q: ServerOrder must contain at least one server", jsonPath)
+		return nil, fmt.Errorf("%q: ServerOrder must contain at least one server", jsonPath)
+	}
+	if pki.MailboxRounds < 0 {
+		return nil, fmt.Errorf("%q: MailboxRounds must not be negative", jsonPath)
 	}
 	for _, s := range pki.ServerOrder {
 		info, ok := pki.Servers[s]
 		if !ok {
-			log.Fatalf("%q: server %q not found", jsonPath, s)
+			return nil, fmt.Errorf("%q: server %q not found", jsonPath, s)
 		}
 		addr := info.Address
 		if addr == "" {
-			log.Fatalf("%q: server %q does not specify an Address", jsonPath, s)
+			return nil, fmt.Errorf("%q: server %q does not specify an Address", jsonPath, s)
 		}
 
 		if strings.IndexByte(addr, ':') == -1 {
 			info.Address = net.JoinHostPort(addr, DefaultServerPort)
 		}
 	}
-	return pki
+	return pki, nil
+}
+
+// SameServers returns an error if the server chain differs between the
+// two PKIs, other than in keys.
+func SameServers(old, new *PKI) error {
+	if len(old.ServerOrder) != len(new.ServerOrder) {
+		return fmt.Errorf("number of servers changed (restart required)")
+	}
+	for i, s := range old.ServerOrder {
+		if new.ServerOrder[i] != s {
+			return fmt.Errorf("server order changed (restart required)")
+		}
+		if new.Servers[s].Address != old.Servers[s].Address {
+			return fmt.Errorf("address of %q changed (restart required)", s)
+		}
+	}
+	if new.EntryServer != old.EntryServer {
+		return fmt.Errorf("entry server changed (restart required)")
+	}
+	if new.MailboxRounds != old.MailboxRounds {
+		return fmt.Errorf("MailboxRounds changed (restart required)")
+	}
+	return nil
 }
 
 func (pki *PKI) ServerKeys() BoxKeys {
@@ -55,11 +108,24 @@ func (pki *PKI) ServerKeys() BoxKeys {
 	return keys
 }
 
+// MailboxLookback is how many mailbox windows, counting the current one,
+// can still hold mail on the last server.
+func (pki *PKI) MailboxLookback() uint32 {
+	return (uint32(pki.MailboxRounds)+MailboxWindow-1)/MailboxWindow + 1
+}
+
 func (pki *PKI) FirstServer() string {
 	s := pki.ServerOrder[0]
 	return pki.Servers[s].Address
 }
 
+// FirstServerVerifyKey returns the key that signs round announcements,
+// or nil if the first server doesn't sign them.
+func (pki *PKI) FirstServerVerifyKey() *VerifyKey {
+	s := pki.ServerOrder[0]
+	return pki.Servers[s].VerifyKey
+}
+
 func (pki *PKI) LastServer() string {
 	s := pki.ServerOrder[len(pki.ServerOrder)-1]
 	return pki.Servers[s].Address
@@ -86,6 +152,16 @@ func (pki *PKI) NextServer(serverName string) string {
 	}
 }
 
+// PreviousServerName returns the name of the server before serverName,
+// or "" for the first server.
+func (pki *PKI) PreviousServerName(serverName string) string {
+	i := pki.Index(serverName)
+	if i == 0 {
+		return ""
+	}
+	return pki.ServerOrder[i-1]
+}
+
 func (pki *PKI) NextServerKeys(serverName string) BoxKeys {
 	i := pki.Index(serverName)
 	var keys []*BoxKey
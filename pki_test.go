@@ -39,3 +39,17 @@ func TestNextKeys(t *testing.T) {
 		t.Fatalf("wrong key")
 	}
 }
+
+func TestMailboxLookback(t *testing.T) {
+	for _, rounds := range []int{0, 1, 31, 32, 33, 256} {
+		pki := &PKI{MailboxRounds: rounds}
+		lookback := pki.MailboxLookback()
+		for deposit := uint32(1000); deposit < 1000+MailboxWindow; deposit++ {
+			for r := deposit; r < deposit+uint32(rounds); r++ {
+				if back := r/MailboxWindow - deposit/MailboxWindow; back >= lookback {
+					t.Fatalf("MailboxRounds=%d: mail from round %d is still kept in round %d, %d windows back, but lookback is %d", rounds, deposit, r, back, lookback)
+				}
+			}
+		}
+	}
+}
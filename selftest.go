@@ -0,0 +1,141 @@
+package vuvuzela
+
+import (
+	"bytes"
+	"fmt"
+
+	"golang.org/x/crypto/nacl/box"
+
+	"github.com/davidlazar/vuvuzela/onionbox"
+	"github.com/davidlazar/vuvuzela/rand"
+)
+
+// SelfTestError identifies the server that broke a self-test onion.
+type SelfTestError struct {
+	Service string
+	Server  string
+	Hop     int
+	Err     string
+}
+
+func (e *SelfTestError) Error() string {
+	if e.Hop < 0 {
+		return fmt.Sprintf("%s self-test failed (%s): %s", e.Service, e.Server, e.Err)
+	}
+	return fmt.Sprintf("%s self-test failed at hop %d (%s): %s", e.Service, e.Hop, e.Server, e.Err)
+}
+
+// A ConvoProbe is a known onion that the entry server mixes into a convo
+// round. It uses a fresh dead drop, so the last server treats it as a
+// single and returns the probe's own message. Peeling the reply one layer
+// at a time pinpoints the first server that mangled it.
+type ConvoProbe struct {
+	Onion []byte
+
+	round      uint32
+	pki        *PKI
+	message    []byte
+	sharedKeys []*[32]byte
+}
+
+func NewConvoProbe(pki *PKI, round uint32) *ConvoProbe {
+	exchange := new(ConvoExchange)
+	rand.Read(exchange.DeadDrop[:])
+	rand.Read(exchange.EncryptedMessage[:])
+
+	onion, sharedKeys := onionbox.Seal(exchange.Marshal(), ForwardNonce(round), pki.ServerKeys().Keys())
+	return &ConvoProbe{
+		Onion:      onion,
+		round:      round,
+		pki:        pki,
+		message:    exchange.EncryptedMessage[:],
+		sharedKeys: sharedKeys,
+	}
+}
+
+func (p *ConvoProbe) Check(reply []byte) error {
+	nonce := BackwardNonce(p.round)
+	expectedSize := len(p.sharedKeys)*box.Overhead + SizeEncryptedMessage
+	if len(reply) != expectedSize {
+		return &SelfTestError{
+			Service: "convo",
+			Server:  p.pki.ServerOrder[0],
+			Hop:     0,
+			Err:     fmt.Sprintf("reply has size %d, expecting %d", len(reply), expectedSize),
+		}
+	}
+
+	msg := reply
+	for i, key := range p.sharedKeys {
+		var ok bool
+		msg, ok = box.OpenAfterPrecomputation(nil, msg, nonce, key)
+		if !ok {
+			// Servers reply with random bytes when they fail to open
+			// an onion, so a bad key or a dropped onion shows up here.
+			return &SelfTestError{
+				Service: "convo",
+				Server:  p.pki.ServerOrder[i],
+				Hop:     i,
+				Err:     "reply layer does not decrypt (wrong key, or onion dropped on the way in)",
+			}
+		}
+	}
+
+	if !bytes.Equal(msg, p.message) {
+		last := len(p.sharedKeys) - 1
+		return &SelfTestError{
+			Service: "convo",
+			Server:  p.pki.ServerOrder[last],
+			Hop:     last,
+			Err:     "dead drop returned the wrong message",
+		}
+	}
+	return nil
+}
+
+// A DialProbe is a known introduction that should come back out of the
+// last server in the expected bucket.
+type DialProbe struct {
+	Onion []byte
+
+	pki      *PKI
+	exchange *DialExchange
+}
+
+func NewDialProbe(pki *PKI, round uint32, buckets uint32) *DialProbe {
+	exchange := new(DialExchange)
+	exchange.Bucket = round % buckets
+	rand.Read(exchange.EncryptedIntro[:])
+
+	onion, _ := onionbox.Seal(exchange.Marshal(), ForwardNonce(round), pki.ServerKeys().Keys())
+	return &DialProbe{
+		Onion:    onion,
+		pki:      pki,
+		exchange: exchange,
+	}
+}
+
+func (p *DialProbe) Check(buckets [][][SizeEncryptedIntro]byte) error {
+	last := len(p.pki.ServerOrder) - 1
+	if p.exchange.Bucket >= uint32(len(buckets)) {
+		return &SelfTestError{
+			Service: "dial",
+			Server:  p.pki.ServerOrder[last],
+			Hop:     last,
+			Err:     fmt.Sprintf("missing bucket %d (got %d buckets)", p.exchange.Bucket, len(buckets)),
+		}
+	}
+	for _, intro := range buckets[p.exchange.Bucket] {
+		if intro == p.exchange.EncryptedIntro {
+			return nil
+		}
+	}
+	// Dial rounds have no reply path, so we can't tell which hop lost the
+	// probe. A passing convo self-test rules out bad keys and addresses.
+	return &SelfTestError{
+		Service: "dial",
+		Server:  fmt.Sprintf("%s..%s", p.pki.ServerOrder[0], p.pki.ServerOrder[last]),
+		Hop:     -1,
+		Err:     fmt.Sprintf("probe introduction missing from bucket %d", p.exchange.Bucket),
+	}
+}
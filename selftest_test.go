@@ -0,0 +1,99 @@
+package vuvuzela
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+func testChain(t *testing.T, n int) (*PKI, []*BoxKey) {
+	pki := &PKI{
+		Servers: make(map[string]*ServerInfo),
+	}
+	privateKeys := make([]*BoxKey, n)
+	for i := 0; i < n; i++ {
+		public, private, err := GenerateBoxKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := string('a' + rune(i))
+		pki.Servers[name] = &ServerInfo{PublicKey: public}
+		pki.ServerOrder = append(pki.ServerOrder, name)
+		privateKeys[i] = private
+	}
+	return pki, privateKeys
+}
+
+// simulateConvo runs an onion through servers that behave like
+// ConvoService for a round containing a single onion.
+func simulateConvo(onion []byte, round uint32, privateKeys []*BoxKey) []byte {
+	sharedKeys := make([]*[32]byte, len(privateKeys))
+	msg := onion
+	failed := -1
+	for i, priv := range privateKeys {
+		var theirPublic [32]byte
+		copy(theirPublic[:], msg[0:32])
+		sharedKeys[i] = new([32]byte)
+		box.Precompute(sharedKeys[i], &theirPublic, priv.Key())
+		var ok bool
+		msg, ok = box.OpenAfterPrecomputation(nil, msg[32:], ForwardNonce(round), sharedKeys[i])
+		if !ok {
+			failed = i
+			break
+		}
+	}
+
+	var reply []byte
+	if failed == -1 {
+		ex := new(ConvoExchange)
+		ex.Unmarshal(msg)
+		reply = ex.EncryptedMessage[:]
+	}
+	for i := len(privateKeys) - 1; i >= 0; i-- {
+		if failed != -1 && i > failed {
+			continue
+		}
+		if i == failed {
+			reply = make([]byte, (len(privateKeys)-i)*box.Overhead+SizeEncryptedMessage)
+			rand.Read(reply)
+			continue
+		}
+		reply = box.SealAfterPrecomputation(nil, reply, BackwardNonce(round), sharedKeys[i])
+	}
+	return reply
+}
+
+func TestConvoProbe(t *testing.T) {
+	pki, privateKeys := testChain(t, 3)
+
+	probe := NewConvoProbe(pki, 7)
+	if err := probe.Check(simulateConvo(probe.Onion, 7, privateKeys)); err != nil {
+		t.Fatalf("expecting probe to pass: %s", err)
+	}
+
+	_, wrongKey, _ := GenerateBoxKey(rand.Reader)
+	privateKeys[1] = wrongKey
+	probe = NewConvoProbe(pki, 8)
+	err := probe.Check(simulateConvo(probe.Onion, 8, privateKeys))
+	if err == nil {
+		t.Fatalf("expecting probe to fail")
+	}
+	if e := err.(*SelfTestError); e.Hop != 1 || e.Server != "b" {
+		t.Fatalf("expecting failure at hop 1 (b), got: %s", err)
+	}
+}
+
+func TestDialProbe(t *testing.T) {
+	pki, _ := testChain(t, 2)
+
+	probe := NewDialProbe(pki, 3, 1)
+	buckets := make([][][SizeEncryptedIntro]byte, 1)
+	if err := probe.Check(buckets); err == nil {
+		t.Fatalf("expecting probe to fail on empty buckets")
+	}
+	buckets[0] = append(buckets[0], probe.exchange.EncryptedIntro)
+	if err := probe.Check(buckets); err != nil {
+		t.Fatalf("expecting probe to pass: %s", err)
+	}
+}
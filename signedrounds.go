@@ -0,0 +1,70 @@
+package vuvuzela
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// SignedRounds remembers the highest round a server has signed for each
+// service. Round numbers must strictly increase, so an entry server
+// can't get an old round signed again with a fresh timestamp, even
+// across restarts if the rounds are kept in a file.
+type SignedRounds struct {
+	mu   sync.Mutex
+	path string
+	last map[string]uint32
+}
+
+// OpenSignedRounds reads the rounds kept at path, if it exists. With an
+// empty path the rounds are only kept in memory.
+func OpenSignedRounds(path string) (*SignedRounds, error) {
+	s := &SignedRounds{
+		path: path,
+		last: make(map[string]uint32),
+	}
+	if path == "" {
+		return s, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.last); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return s, nil
+}
+
+// advance records that round is about to be signed, failing if it
+// doesn't come after every round signed so far. A nil *SignedRounds
+// allows any round.
+func (s *SignedRounds) advance(service string, round uint32) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if last, ok := s.last[service]; ok && round <= last {
+		return fmt.Errorf("round %d: already signed %s round %d", round, service, last)
+	}
+	s.last[service] = round
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(s.last)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,58 @@
+package vuvuzela
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestSignedRounds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vuvuzela-rounds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "a.rounds")
+
+	rounds, err := OpenSignedRounds(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pki, privateKeys := testChain(t, 1)
+	var idle sync.Mutex
+	srv := &DialService{
+		Idle:         &idle,
+		PKI:          pki,
+		ServerName:   "a",
+		PrivateKey:   privateKeys[0],
+		LastServer:   true,
+		SignedRounds: rounds,
+	}
+	InitDialService(srv)
+
+	if err := srv.NewRound(10, new(RoundSignature)); err != nil {
+		t.Fatal(err)
+	}
+	srv.rounds = make(map[uint32]*DialRound)
+	idle.Unlock()
+	if err := srv.NewRound(9, new(RoundSignature)); err == nil {
+		t.Fatalf("signed an earlier round")
+	}
+	if err := rounds.advance("convo", 9); err != nil {
+		t.Fatalf("services should be independent: %s", err)
+	}
+
+	// After a restart, round 10 still can't be signed again.
+	reopened, err := OpenSignedRounds(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.advance("dial", 10); err == nil {
+		t.Fatalf("signed round 10 twice across a restart")
+	}
+	if err := reopened.advance("dial", 11); err != nil {
+		t.Fatal(err)
+	}
+}
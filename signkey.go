@@ -0,0 +1,81 @@
+package vuvuzela
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/davidlazar/go-crypto/encoding/base32"
+)
+
+// VerifyKey and SigningKey are an ed25519 key pair. Servers use them to
+// sign round announcements.
+type VerifyKey [ed25519.PublicKeySize]byte
+
+type SigningKey [ed25519.PrivateKeySize]byte
+
+func GenerateSigningKey(rand io.Reader) (verifyKey *VerifyKey, signingKey *SigningKey, err error) {
+	pub, priv, err := ed25519.GenerateKey(rand)
+	if err != nil {
+		return nil, nil, err
+	}
+	verifyKey = new(VerifyKey)
+	signingKey = new(SigningKey)
+	copy(verifyKey[:], pub)
+	copy(signingKey[:], priv)
+	return
+}
+
+// SigningKeyFromSeed deterministically derives a key pair from a 32-byte seed.
+func SigningKeyFromSeed(seed []byte) (*VerifyKey, *SigningKey) {
+	priv := ed25519.NewKeyFromSeed(seed)
+	verifyKey := new(VerifyKey)
+	signingKey := new(SigningKey)
+	copy(verifyKey[:], priv.Public().(ed25519.PublicKey))
+	copy(signingKey[:], priv)
+	return verifyKey, signingKey
+}
+
+func (k *SigningKey) Sign(message []byte) []byte {
+	return ed25519.Sign(ed25519.PrivateKey(k[:]), message)
+}
+
+func (k *VerifyKey) Verify(message, sig []byte) bool {
+	return ed25519.Verify(ed25519.PublicKey(k[:]), message, sig)
+}
+
+func (k *VerifyKey) String() string {
+	return base32.EncodeToString(k[:])
+}
+
+func (k *VerifyKey) MarshalJSON() ([]byte, error) {
+	return json.Marshal(k.String())
+}
+
+func (k *VerifyKey) UnmarshalJSON(b []byte) error {
+	return unmarshalKeyJSON(b, k[:])
+}
+
+func (k *SigningKey) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base32.EncodeToString(k[:]))
+}
+
+func (k *SigningKey) UnmarshalJSON(b []byte) error {
+	return unmarshalKeyJSON(b, k[:])
+}
+
+func unmarshalKeyJSON(b []byte, key []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	bs, err := base32.DecodeString(s)
+	if err != nil {
+		return fmt.Errorf("base32 decode error: %s", err)
+	}
+	if copy(key, bs) < len(key) {
+		return fmt.Errorf("short key")
+	}
+	return nil
+}
@@ -0,0 +1,516 @@
+package vuvuzela
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/davidlazar/vuvuzela/internal/workpool"
+	"github.com/davidlazar/vuvuzela/vrpc"
+)
+
+// A TranscriptEntry summarizes what a server received and forwarded in
+// one round, without the messages themselves. Each server's entries form
+// a hash chain, and each entry is signed with the server's SigningKey.
+//
+// The roots are Merkle roots over the sorted leaf hashes of the onions,
+// so they don't depend on the order the onions arrived in. A server's
+// OutgoingRoot should equal the next server's IncomingRoot.
+type TranscriptEntry struct {
+	Server  string
+	Service string // "convo" or "dial"
+	Round   uint32
+	Seq     uint64
+	Prev    []byte // hash of the server's previous entry
+
+	Incoming int // onions received
+	Valid    int // onions that opened and weren't replays
+	Noise    int // fake onions added
+	Outgoing int // onions forwarded (or, for dial, put in buckets)
+
+	IncomingRoot []byte
+	OutgoingRoot []byte `json:",omitempty"`
+
+	Signature []byte `json:",omitempty"`
+}
+
+// A TranscriptRecord is one line of a transcript file: either one of the
+// server's own entries or an entry it got from a neighbor.
+type TranscriptRecord struct {
+	Own      *TranscriptEntry `json:",omitempty"`
+	Neighbor *TranscriptEntry `json:",omitempty"`
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	binary.Write(buf, binary.BigEndian, uint16(len(s)))
+	buf.WriteString(s)
+}
+
+func (e *TranscriptEntry) signedData() []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("vuvuzela transcript")
+	writeString(buf, e.Server)
+	writeString(buf, e.Service)
+	binary.Write(buf, binary.BigEndian, e.Round)
+	binary.Write(buf, binary.BigEndian, e.Seq)
+	var prev, in, out [32]byte
+	copy(prev[:], e.Prev)
+	copy(in[:], e.IncomingRoot)
+	copy(out[:], e.OutgoingRoot)
+	buf.Write(prev[:])
+	for _, n := range []int{e.Incoming, e.Valid, e.Noise, e.Outgoing} {
+		binary.Write(buf, binary.BigEndian, uint64(n))
+	}
+	buf.Write(in[:])
+	buf.Write(out[:])
+	return buf.Bytes()
+}
+
+func (e *TranscriptEntry) Hash() []byte {
+	h := sha256.Sum256(e.signedData())
+	return h[:]
+}
+
+func (e *TranscriptEntry) Verify(key *VerifyKey) bool {
+	return key.Verify(e.signedData(), e.Signature)
+}
+
+func MerkleLeaf(data []byte) [32]byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(data)
+	var leaf [32]byte
+	copy(leaf[:], h.Sum(nil))
+	return leaf
+}
+
+// MerkleRoot sorts the leaves and builds an RFC 6962 style tree.
+func MerkleRoot(leaves [][32]byte) []byte {
+	sorted := append([][32]byte(nil), leaves...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i][:], sorted[j][:]) < 0
+	})
+	if len(sorted) == 0 {
+		h := sha256.Sum256(nil)
+		return h[:]
+	}
+	root := merkleTree(sorted)
+	return root[:]
+}
+
+func merkleTree(leaves [][32]byte) [32]byte {
+	if len(leaves) == 1 {
+		return leaves[0]
+	}
+	k := 1
+	for k*2 < len(leaves) {
+		k *= 2
+	}
+	left, right := merkleTree(leaves[:k]), merkleTree(leaves[k:])
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left[:])
+	h.Write(right[:])
+	var node [32]byte
+	copy(node[:], h.Sum(nil))
+	return node
+}
+
+func merkleRootOf(onions [][]byte) []byte {
+	leaves := make([][32]byte, len(onions))
+	workpool.For("transcript/leaves", len(onions), func(i int) {
+		leaves[i] = MerkleLeaf(onions[i])
+	})
+	return MerkleRoot(leaves)
+}
+
+// Transcript is a server's append-only transcript file.
+type Transcript struct {
+	mu     sync.Mutex
+	f      *os.File
+	server string
+	key    *SigningKey
+	seq    uint64
+	last   []byte
+
+	// recent own entries, for answering neighbors
+	recent map[string]*TranscriptEntry
+
+	// neighbor entries for the rounds in recent, by server
+	neighbors map[string]*TranscriptEntry
+	// closed when the neighbor entry with the same key arrives
+	arrivals map[string]chan struct{}
+}
+
+const transcriptRecent = 64
+
+func transcriptKey(service string, round uint32) string {
+	return fmt.Sprintf("%s/%d", service, round)
+}
+
+// OpenTranscript opens the transcript at path for appending, picking up
+// the hash chain where it left off. Entries are unsigned if key is nil.
+func OpenTranscript(path, server string, key *SigningKey) (*Transcript, error) {
+	records, err := ReadTranscript(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	t := &Transcript{
+		server:    server,
+		key:       key,
+		recent:    make(map[string]*TranscriptEntry),
+		neighbors: make(map[string]*TranscriptEntry),
+		arrivals:  make(map[string]chan struct{}),
+	}
+	for _, r := range records {
+		if r.Own != nil && r.Own.Server == server {
+			t.seq = r.Own.Seq
+			t.last = r.Own.Hash()
+		}
+	}
+	t.f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func ReadTranscript(path string) ([]*TranscriptRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []*TranscriptRecord
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		r := new(TranscriptRecord)
+		if err := json.Unmarshal(scanner.Bytes(), r); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+		records = append(records, r)
+	}
+	return records, scanner.Err()
+}
+
+func (t *Transcript) write(r *TranscriptRecord) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if _, err := t.f.Write(data); err != nil {
+		return err
+	}
+	return t.f.Sync()
+}
+
+// Append chains, signs, and writes one of our own entries.
+func (t *Transcript) Append(e *TranscriptEntry) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e.Server = t.server
+	e.Seq = t.seq + 1
+	e.Prev = t.last
+	if t.key != nil {
+		e.Signature = t.key.Sign(e.signedData())
+	}
+	if err := t.write(&TranscriptRecord{Own: e}); err != nil {
+		return err
+	}
+	t.seq = e.Seq
+	t.last = e.Hash()
+
+	k := transcriptKey(e.Service, e.Round)
+	t.recent[k] = e
+	if len(t.recent) > transcriptRecent {
+		for key, old := range t.recent {
+			if old.Seq+transcriptRecent < e.Seq {
+				delete(t.recent, key)
+			}
+		}
+		for key, n := range t.neighbors {
+			if t.recent[transcriptKey(n.Service, n.Round)] == nil {
+				delete(t.neighbors, key)
+				delete(t.arrivals, key)
+			}
+		}
+	}
+	return nil
+}
+
+// addNeighbor keeps one entry per neighbor for each of our recent rounds,
+// so a neighbor can't grow the transcript without bound.
+func (t *Transcript) addNeighbor(e *TranscriptEntry) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	k := transcriptKey(e.Service, e.Round)
+	if t.recent[k] == nil {
+		return fmt.Errorf("%s round %d: no such round", e.Service, e.Round)
+	}
+	nk := e.Server + "/" + k
+	if t.neighbors[nk] != nil {
+		return fmt.Errorf("%s round %d: already have %s's entry", e.Service, e.Round, e.Server)
+	}
+	if err := t.write(&TranscriptRecord{Neighbor: e}); err != nil {
+		return err
+	}
+	t.neighbors[nk] = e
+	if c, ok := t.arrivals[nk]; ok {
+		close(c)
+		delete(t.arrivals, nk)
+	}
+	return nil
+}
+
+// upstreamWait is how long a noise reveal waits for the previous server's
+// transcript entry, which it sends once our part of the round is done.
+const upstreamWait = 10 * time.Second
+
+// upstream returns server's entry for the round, waiting for it to
+// arrive. It returns nil without a transcript or a server.
+func (t *Transcript) upstream(server, service string, round uint32) *TranscriptEntry {
+	if t == nil || server == "" {
+		return nil
+	}
+	nk := server + "/" + transcriptKey(service, round)
+	t.mu.Lock()
+	e := t.neighbors[nk]
+	c, ok := t.arrivals[nk]
+	if e == nil && !ok {
+		c = make(chan struct{})
+		t.arrivals[nk] = c
+	}
+	t.mu.Unlock()
+	if e != nil {
+		return e
+	}
+
+	select {
+	case <-c:
+	case <-time.After(upstreamWait):
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.neighbors[nk]
+}
+
+func (t *Transcript) entry(service string, round uint32) *TranscriptEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.recent[transcriptKey(service, round)]
+}
+
+// exchange sends our entry to the next server and keeps its entry for
+// the same round.
+func (t *Transcript) exchange(client *vrpc.Client, e *TranscriptEntry) {
+	theirs := new(TranscriptEntry)
+	if err := client.Call("TranscriptService.Exchange", e, theirs); err != nil {
+		log.WithFields(log.Fields{"service": e.Service, "round": e.Round, "call": "TranscriptService.Exchange"}).Error(err)
+		return
+	}
+	if theirs.Server == "" {
+		return
+	}
+	if err := t.addNeighbor(theirs); err != nil {
+		log.WithFields(log.Fields{"service": e.Service, "round": e.Round, "call": "addNeighbor"}).Error(err)
+	}
+}
+
+// record appends e, logging errors: a failing transcript shouldn't stop
+// the round.
+func (t *Transcript) record(e *TranscriptEntry) {
+	if err := t.Append(e); err != nil {
+		log.WithFields(log.Fields{"service": e.Service, "round": e.Round, "call": "Transcript.Append"}).Error(err)
+	}
+}
+
+// TranscriptService lets the previous server in the chain swap
+// transcript entries with us. With no Transcript it accepts and ignores
+// entries, so neighbors can keep transcripts on their own.
+type TranscriptService struct {
+	Transcript *Transcript
+
+	pkiMu      sync.RWMutex
+	PKI        *PKI
+	ServerName string
+}
+
+func (srv *TranscriptService) SetPKI(pki *PKI) {
+	if srv == nil {
+		return
+	}
+	srv.pkiMu.Lock()
+	srv.PKI = pki
+	srv.pkiMu.Unlock()
+}
+
+// checkNeighbor makes sure e comes from the previous server in the PKI
+// and, if that server has a VerifyKey, that it signed e.
+func (srv *TranscriptService) checkNeighbor(e *TranscriptEntry) error {
+	srv.pkiMu.RLock()
+	pki := srv.PKI
+	srv.pkiMu.RUnlock()
+
+	i := pki.Index(srv.ServerName)
+	if i == 0 || pki.ServerOrder[i-1] != e.Server {
+		return fmt.Errorf("not expecting transcript entries from %q", e.Server)
+	}
+	if key := pki.Servers[e.Server].VerifyKey; key != nil && !e.Verify(key) {
+		return fmt.Errorf("bad signature on transcript entry from %q", e.Server)
+	}
+	return nil
+}
+
+func (srv *TranscriptService) Exchange(theirs *TranscriptEntry, ours *TranscriptEntry) error {
+	if srv.Transcript == nil {
+		return nil
+	}
+	if err := srv.checkNeighbor(theirs); err != nil {
+		return err
+	}
+	if err := srv.Transcript.addNeighbor(theirs); err != nil {
+		return err
+	}
+	if e := srv.Transcript.entry(theirs.Service, theirs.Round); e != nil {
+		*ours = *e
+	}
+	return nil
+}
+
+type transcriptID struct {
+	server  string
+	service string
+	round   uint32
+}
+
+// CheckTranscripts looks for problems in the transcripts of one or more
+// servers: broken hash chains, bad signatures, a server that gave its
+// neighbor a different entry than it logged, and adjacent servers that
+// disagree about the onions that passed between them.
+func CheckTranscripts(pki *PKI, logs [][]*TranscriptRecord) []error {
+	var errs []error
+	problem := func(format string, v ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, v...))
+	}
+
+	verify := func(e *TranscriptEntry, where string) bool {
+		info, ok := pki.Servers[e.Server]
+		if !ok {
+			problem("%s: unknown server %q", where, e.Server)
+			return false
+		}
+		if info.VerifyKey == nil {
+			return true
+		}
+		if !e.Verify(info.VerifyKey) {
+			problem("%s: bad signature", where)
+			return false
+		}
+		return true
+	}
+
+	own := make(map[transcriptID]*TranscriptEntry)
+	neighbors := make(map[transcriptID]*TranscriptEntry)
+	for i, records := range logs {
+		var prev *TranscriptEntry
+		for line, r := range records {
+			where := fmt.Sprintf("log %d line %d", i+1, line+1)
+			if r.Neighbor != nil {
+				e := r.Neighbor
+				if verify(e, where) {
+					neighbors[transcriptID{e.Server, e.Service, e.Round}] = e
+				}
+				continue
+			}
+			e := r.Own
+			if e == nil {
+				problem("%s: empty record", where)
+				continue
+			}
+			where = fmt.Sprintf("%s (%s %s round %d)", where, e.Server, e.Service, e.Round)
+			if prev != nil && e.Server != prev.Server {
+				problem("%s: entries from %s and %s in one log", where, prev.Server, e.Server)
+			}
+			if prev != nil && (e.Seq != prev.Seq+1 || !bytes.Equal(e.Prev, prev.Hash())) {
+				problem("%s: hash chain broken after seq %d", where, prev.Seq)
+			}
+			if prev == nil && e.Seq == 1 && len(e.Prev) != 0 {
+				problem("%s: first entry has a previous hash", where)
+			}
+			prev = e
+			verify(e, where)
+
+			if e.Valid > e.Incoming {
+				problem("%s: %d valid onions out of %d", where, e.Valid, e.Incoming)
+			}
+			if e.OutgoingRoot != nil && e.Outgoing != e.Valid+e.Noise {
+				problem("%s: forwarded %d onions, expecting %d valid + %d noise", where, e.Outgoing, e.Valid, e.Noise)
+			}
+
+			id := transcriptID{e.Server, e.Service, e.Round}
+			if other, ok := own[id]; ok && !bytes.Equal(other.Hash(), e.Hash()) {
+				problem("%s: conflicting entries for the same round", where)
+			}
+			own[id] = e
+		}
+	}
+
+	for id, n := range neighbors {
+		if e, ok := own[id]; ok && !bytes.Equal(e.Hash(), n.Hash()) {
+			problem("%s %s round %d: entry given to neighbor differs from the logged entry", id.server, id.service, id.round)
+		}
+	}
+	lookup := func(id transcriptID) *TranscriptEntry {
+		if e, ok := own[id]; ok {
+			return e
+		}
+		return neighbors[id]
+	}
+
+	var ids []transcriptID
+	for id := range own {
+		ids = append(ids, id)
+	}
+	for id := range neighbors {
+		if _, ok := own[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if ids[i].round != ids[j].round {
+			return ids[i].round < ids[j].round
+		}
+		if ids[i].service != ids[j].service {
+			return ids[i].service < ids[j].service
+		}
+		return pki.Index(ids[i].server) < pki.Index(ids[j].server)
+	})
+	for _, id := range ids {
+		i := pki.Index(id.server)
+		if i < 0 || i+1 >= len(pki.ServerOrder) {
+			continue
+		}
+		e := lookup(id)
+		next := lookup(transcriptID{pki.ServerOrder[i+1], id.service, id.round})
+		if next == nil {
+			continue
+		}
+		if e.Outgoing != next.Incoming || !bytes.Equal(e.OutgoingRoot, next.IncomingRoot) {
+			problem("%s round %d: %s forwarded %d onions (root %x), %s received %d (root %x)",
+				id.service, id.round, e.Server, e.Outgoing, e.OutgoingRoot, next.Server, next.Incoming, next.IncomingRoot)
+		}
+	}
+	return errs
+}
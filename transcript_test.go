@@ -0,0 +1,196 @@
+package vuvuzela
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestConvoTranscript(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vuvuzela-transcript")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pki, privateKeys := testChain(t, 1)
+	path := filepath.Join(dir, "a.transcript")
+	transcript, err := OpenTranscript(path, "a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var idle sync.Mutex
+	srv := &ConvoService{
+		Idle:       &idle,
+		PKI:        pki,
+		ServerName: "a",
+		PrivateKey: privateKeys[0],
+		LastServer: true,
+		Transcript: transcript,
+	}
+	InitConvoService(srv)
+
+	onions := make([][]byte, 3)
+	for i := range onions {
+		onions[i] = make([]byte, pki.IncomingOnionOverhead("a")+SizeConvoExchange)
+		rand.Read(onions[i])
+	}
+	if err := srv.NewRound(5, new(RoundSignature)); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Open(&ConvoOpenArgs{Round: 5, NumIncoming: len(onions)}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Add(&ConvoAddArgs{Round: 5, Onions: onions}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Close(5, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := ReadTranscript(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Own == nil {
+		t.Fatalf("expecting one entry, got %d records", len(records))
+	}
+	e := records[0].Own
+	if e.Round != 5 || e.Incoming != 3 || e.Valid != 0 || e.Seq != 1 {
+		t.Fatalf("unexpected entry: %+v", e)
+	}
+	// Reversed order, same root.
+	leaves := [][32]byte{MerkleLeaf(onions[2]), MerkleLeaf(onions[1]), MerkleLeaf(onions[0])}
+	if string(e.IncomingRoot) != string(MerkleRoot(leaves)) {
+		t.Fatalf("wrong incoming root")
+	}
+
+	again, err := OpenTranscript(path, "a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := &TranscriptEntry{Service: "convo", Round: 6, IncomingRoot: MerkleRoot(nil)}
+	if err := again.Append(next); err != nil {
+		t.Fatal(err)
+	}
+	if next.Seq != 2 || string(next.Prev) != string(e.Hash()) {
+		t.Fatalf("hash chain not continued after reopening")
+	}
+}
+
+func TestCheckTranscripts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vuvuzela-transcript")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pki, _ := testChain(t, 2)
+	var transcripts []*Transcript
+	var paths []string
+	for _, name := range pki.ServerOrder {
+		verifyKey, signingKey, _ := GenerateSigningKey(rand.Reader)
+		pki.Servers[name].VerifyKey = verifyKey
+		path := filepath.Join(dir, name+".transcript")
+		tr, err := OpenTranscript(path, name, signingKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		transcripts = append(transcripts, tr)
+		paths = append(paths, path)
+	}
+
+	batch := [][]byte{[]byte("onion 1"), []byte("onion 2")}
+	root := merkleRootOf(batch)
+	a := &TranscriptEntry{Service: "dial", Round: 9, Incoming: 1, Valid: 1, Noise: 1, Outgoing: 2, IncomingRoot: root, OutgoingRoot: root}
+	b := &TranscriptEntry{Service: "dial", Round: 9, Incoming: 2, Valid: 2, Outgoing: 2, IncomingRoot: root, OutgoingRoot: root}
+	transcripts[0].record(a)
+	transcripts[1].record(b)
+	theirs := new(TranscriptEntry)
+	srv := &TranscriptService{Transcript: transcripts[1], PKI: pki, ServerName: "b"}
+	if err := srv.Exchange(a, theirs); err != nil {
+		t.Fatal(err)
+	}
+	transcripts[0].addNeighbor(theirs)
+
+	if err := srv.Exchange(a, new(TranscriptEntry)); err == nil {
+		t.Fatalf("expecting a second entry for the round to be rejected")
+	}
+	unseen := *a
+	unseen.Round = 10
+	unseen.Signature = transcripts[0].key.Sign(unseen.signedData())
+	if err := srv.Exchange(&unseen, new(TranscriptEntry)); err == nil {
+		t.Fatalf("expecting an entry for an unseen round to be rejected")
+	}
+	forgedA := *a
+	forgedA.Noise = 100
+	if err := (&TranscriptService{Transcript: transcripts[1], PKI: pki, ServerName: "b"}).checkNeighbor(&forgedA); err == nil {
+		t.Fatalf("expecting a bad signature to be rejected")
+	}
+	if err := (&TranscriptService{Transcript: transcripts[0], PKI: pki, ServerName: "a"}).checkNeighbor(b); err == nil {
+		t.Fatalf("expecting entries from the next server to be rejected")
+	}
+
+	read := func() [][]*TranscriptRecord {
+		var logs [][]*TranscriptRecord
+		for _, path := range paths {
+			records, err := ReadTranscript(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			logs = append(logs, records)
+		}
+		return logs
+	}
+	if errs := CheckTranscripts(pki, read()); len(errs) != 0 {
+		t.Fatalf("unexpected problems: %v", errs)
+	}
+
+	// b claims to have received a different batch.
+	logs := read()
+	forged := *logs[1][0].Own
+	forged.IncomingRoot = merkleRootOf(batch[:1])
+	forged.Incoming = 1
+	logs[1][0].Own = &forged
+	if errs := CheckTranscripts(pki, logs); len(errs) < 2 {
+		t.Fatalf("expecting bad signature and hop mismatch, got %v", errs)
+	}
+
+	// Only a's log: the neighbor entry from b is still checked.
+	if errs := CheckTranscripts(pki, read()[:1]); len(errs) != 0 {
+		t.Fatalf("unexpected problems: %v", errs)
+	}
+}
+
+func TestTranscriptUpstream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vuvuzela-transcript")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tr, err := OpenTranscript(filepath.Join(dir, "b.transcript"), "b", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.record(&TranscriptEntry{Service: "dial", Round: 3})
+
+	got := make(chan *TranscriptEntry)
+	go func() {
+		got <- tr.upstream("a", "dial", 3)
+	}()
+	e := &TranscriptEntry{Server: "a", Service: "dial", Round: 3, Outgoing: 7}
+	if err := tr.addNeighbor(e); err != nil {
+		t.Fatal(err)
+	}
+	if up := <-got; up != e {
+		t.Fatalf("wrong upstream entry: %+v", up)
+	}
+	if (*Transcript)(nil).upstream("a", "dial", 3) != nil || tr.upstream("", "dial", 3) != nil {
+		t.Fatalf("expecting nil without a transcript or a previous server")
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// A buffer is the scrollback of one conversation, or of the log pane.
+type buffer struct {
+	lines []string
+
+	// seen is how many lines the user has seen; the rest are unread.
+	seen int
+
+	// mark is the first line that was unread when the buffer was put on
+	// screen, or 0 for no marker.
+	mark int
+
+	// scroll is how many lines the view is scrolled up from the bottom.
+	scroll int
+}
+
+const (
+	maxBufferLines = 5000
+	maxLogLines    = 500
+)
+
+func (b *buffer) add(text string, max int) {
+	added := strings.Split(strings.TrimRight(text, "\n"), "\n")
+	b.lines = append(b.lines, added...)
+	if b.scroll > 0 {
+		// Keep the view still while the user reads back.
+		b.scroll += len(added)
+	}
+	if over := len(b.lines) - max; over > 0 {
+		b.lines = append([]string(nil), b.lines[over:]...)
+		b.seen -= over
+		if b.seen < 0 {
+			b.seen = 0
+		}
+		b.mark -= over
+		if b.mark < 0 {
+			b.mark = 0
+		}
+	}
+	if b.scroll > len(b.lines) {
+		b.scroll = len(b.lines)
+	}
+}
+
+func (b *buffer) unread() int {
+	return len(b.lines) - b.seen
+}
+
+// scrollBy moves the view up (positive n) or down, within the buffer.
+func (b *buffer) scrollBy(n int) {
+	b.scroll += n
+	if b.scroll > len(b.lines)-1 {
+		b.scroll = len(b.lines) - 1
+	}
+	if b.scroll < 0 {
+		b.scroll = 0
+	}
+}
+
+// visible returns the lines that fill a view of the given size, ending
+// at the scroll position, with marker before b.mark.
+func (b *buffer) visible(width, height int, marker string) []string {
+	end := len(b.lines) - b.scroll
+	rows := 0
+	var out []string
+	for i := end - 1; i >= 0 && rows < height; i-- {
+		out = append(out, b.lines[i])
+		rows += wrappedRows(b.lines[i], width)
+		if i == b.mark && b.mark > 0 && rows < height {
+			out = append(out, marker)
+			rows++
+		}
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out
+}
+
+func wrappedRows(line string, width int) int {
+	n := utf8.RuneCountInString(line)
+	if width <= 0 || n <= width {
+		return 1
+	}
+	return (n + width - 1) / width
+}
+
+// buffer returns the named buffer, creating it if needed. The caller
+// must hold gc.bufMu.
+func (gc *GuiClient) buffer(name string) *buffer {
+	if gc.buffers == nil {
+		gc.buffers = make(map[string]*buffer)
+	}
+	b := gc.buffers[name]
+	if b == nil {
+		b = new(buffer)
+		gc.buffers[name] = b
+	}
+	return b
+}
+
+// PeerPrintf writes to peer's conversation buffer, which is marked
+// unread if it isn't the one on screen.
+func (gc *GuiClient) PeerPrintf(peer string, format string, v ...interface{}) {
+	if gc.gui == nil {
+		log.WithFields(log.Fields{"peer": peer}).Info(strings.TrimSpace(fmt.Sprintf(format, v...)))
+		return
+	}
+	gc.bufMu.Lock()
+	b := gc.buffer(peer)
+	b.add(fmt.Sprintf(format, v...), maxBufferLines)
+	if peer == gc.shownBuffer {
+		b.seen = len(b.lines)
+	}
+	gc.bufMu.Unlock()
+	gc.gui.Flush()
+}
+
+// showBuffer puts peer's buffer on screen, marking where the unread
+// lines start until the user switches away again.
+func (gc *GuiClient) showBuffer(peer string) {
+	gc.bufMu.Lock()
+	defer gc.bufMu.Unlock()
+	if old := gc.buffers[gc.shownBuffer]; old != nil {
+		old.seen = len(old.lines)
+		old.mark = 0
+	}
+	b := gc.buffer(peer)
+	if b.unread() > 0 {
+		b.mark = b.seen
+	}
+	b.seen = len(b.lines)
+	gc.shownBuffer = peer
+}
+
+func (gc *GuiClient) logLine(line string) {
+	gc.bufMu.Lock()
+	gc.logBuffer.add(line, maxLogLines)
+	gc.bufMu.Unlock()
+	gc.gui.Flush()
+}
+
+func (gc *GuiClient) scrollShown(pages int) {
+	gc.bufMu.Lock()
+	b := gc.buffer(gc.shownBuffer)
+	b.scrollBy(pages * gc.pageSize)
+	gc.bufMu.Unlock()
+}
+
+type bufferEntry struct {
+	name   string
+	unread int
+}
+
+// bufferList returns the conversations in the order of the list pane:
+// our own first, then the rest by name.
+func (gc *GuiClient) bufferList() []bufferEntry {
+	gc.Lock()
+	names := make([]string, 0, len(gc.conversations))
+	for name := range gc.conversations {
+		if name != gc.myName {
+			names = append(names, name)
+		}
+	}
+	gc.Unlock()
+	sort.Strings(names)
+	names = append([]string{gc.myName}, names...)
+
+	gc.bufMu.Lock()
+	defer gc.bufMu.Unlock()
+	list := make([]bufferEntry, len(names))
+	for i, name := range names {
+		list[i].name = name
+		if b := gc.buffers[name]; b != nil && name != gc.shownBuffer {
+			list[i].unread = b.unread()
+		}
+	}
+	return list
+}
+
+// cycleConversation switches to the next (or with -1, the previous)
+// conversation in the list.
+func (gc *GuiClient) cycleConversation(step int) {
+	list := gc.bufferList()
+	gc.bufMu.Lock()
+	shown := gc.shownBuffer
+	gc.bufMu.Unlock()
+	for i, e := range list {
+		if e.name == shown {
+			next := list[(i+step+len(list))%len(list)]
+			gc.switchConversation(next.name)
+			return
+		}
+	}
+}
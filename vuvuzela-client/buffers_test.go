@@ -0,0 +1,70 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBufferScrollback(t *testing.T) {
+	b := new(buffer)
+	for _, s := range []string{"a", "b", "c"} {
+		b.add(s+"\n", maxBufferLines)
+	}
+	b.seen = 2
+	b.mark = b.seen
+
+	got := b.visible(10, 3, "--")
+	if want := []string{"b", "--", "c"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("visible: got %q, want %q", got, want)
+	}
+
+	b.scrollBy(1)
+	b.add("d", maxBufferLines)
+	got = b.visible(10, 2, "")
+	if want := []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("scrolled view moved: got %q, want %q", got, want)
+	}
+	if b.unread() != 2 {
+		t.Fatalf("expecting 2 unread lines, got %d", b.unread())
+	}
+
+	b.scrollBy(-100)
+	if got := b.visible(10, 2, "--"); !reflect.DeepEqual(got, []string{"c", "d"}) {
+		t.Fatalf("visible after scrolling down: %q", got)
+	}
+
+	// A long line takes several rows.
+	b.add("0123456789", maxBufferLines)
+	if got := b.visible(5, 2, "--"); !reflect.DeepEqual(got, []string{"0123456789"}) {
+		t.Fatalf("wrapped: got %q", got)
+	}
+
+	for i := 0; i < 10; i++ {
+		b.add("x", 4)
+	}
+	if len(b.lines) != 4 || b.seen != 0 || b.mark != 0 {
+		t.Fatalf("trim: %d lines, seen=%d mark=%d", len(b.lines), b.seen, b.mark)
+	}
+}
+
+func TestHandleLine(t *testing.T) {
+	convo := &Conversation{peerName: "bob"}
+	gc := &GuiClient{selectedConvo: convo}
+	convo.gui = gc
+
+	for _, line := range []string{"/nosuchcommand hi", "  ", "/talk"} {
+		if err := gc.handleLine(line); err != nil {
+			t.Fatalf("%q: %s", line, err)
+		}
+	}
+	if len(convo.outQueue) != 0 {
+		t.Fatalf("commands were sent as text: %q", convo.outQueue)
+	}
+
+	gc.handleLine("hello")
+	gc.handleLine("//shrug")
+	want := [][]byte{[]byte("hello"), []byte("/shrug")}
+	if !reflect.DeepEqual(convo.outQueue, want) {
+		t.Fatalf("got %q, want %q", convo.outQueue, want)
+	}
+}
@@ -1,12 +1,18 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"net"
+	"net/http"
+	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/proxy"
 
 	. "github.com/davidlazar/vuvuzela"
 )
@@ -17,16 +23,60 @@ type Client struct {
 	EntryServer string
 	MyPublicKey *BoxKey
 
-	ws *websocket.Conn
+	// Proxy is a SOCKS5 proxy URL, like socks5://127.0.0.1:9050 for Tor.
+	// The entry server's hostname is resolved by the proxy.
+	Proxy string
+
+	// Transport is "websocket", "http" (long-polling), or empty to try
+	// websockets first and fall back to HTTP when they don't get through.
+	Transport string
+
+	// VerifyKey checks round announcements signed by the first server
+	// for this PKI Epoch. Without it, rounds are only checked to increase.
+	VerifyKey *VerifyKey
+	Epoch     uint32
+
+	// Advanced, if set, is called after each accepted round
+	// announcement and before the round is used, so the rounds can be
+	// saved (see Rounds).
+	Advanced func()
+
+	// Disconnected is called when the connection to the entry server
+	// drops, but not after Close.
+	Disconnected func(err error)
+
+	// announced rounds below these are rejected
+	nextConvoRound uint32
+	nextDialRound  uint32
+
+	// fetch retained dial buckets at the next dial round
+	catchUp bool
+
+	conn      transport
+	connected bool
+
+	traffic Traffic
+
+	// skip convo rounds before this one, as asked by the entry server
+	convoBackoff uint32
 
 	roundHandlers map[uint32]ConvoHandler
 	convoHandler  ConvoHandler
 	dialHandler   DialHandler
 }
 
+// Traffic counts what the client has sent and received since it was created.
+type Traffic struct {
+	BytesSent     int64
+	BytesReceived int64
+	ConvoRounds   int64
+	DialRounds    int64
+}
+
 type ConvoHandler interface {
 	NextConvoRequest(round uint32) *ConvoRequest
 	HandleConvoResponse(response *ConvoResponse)
+	HandleConvoError(err *ConvoError)
 }
 
 type DialHandler interface {
@@ -57,7 +107,11 @@ func (c *Client) SetDialHandler(dialer DialHandler) {
 }
 
 func (c *Client) Connect() error {
-	// TODO check if already connected
+	c.Lock()
+	defer c.Unlock()
+	if c.connected {
+		return nil
+	}
 	if c.convoHandler == nil {
 		return fmt.Errorf("no convo handler")
 	}
@@ -65,59 +119,198 @@ func (c *Client) Connect() error {
 		return fmt.Errorf("no dial handler")
 	}
 
+	timeout := 5 * time.Second
+	dial := (&net.Dialer{Timeout: timeout}).Dial
+	if c.Proxy != "" {
+		// Tor circuits take a while to build.
+		timeout = 30 * time.Second
+		pd, err := proxyDialer(c.Proxy)
+		if err != nil {
+			return err
+		}
+		dial = pd.Dial
+	}
+
+	var err error
+	switch c.Transport {
+	case "websocket":
+		err = c.connectWebsocket(dial, timeout)
+	case "http":
+		err = c.connectHTTP(dial, timeout)
+	case "":
+		// Even when the websocket can't reach the entry server, HTTP
+		// might: some networks only let traffic out through a proxy.
+		err = c.connectWebsocket(dial, timeout)
+		if err != nil {
+			log.WithFields(log.Fields{"call": "Connect"}).Infof("websocket failed (%s), trying HTTP long-polling", err)
+			err = c.connectHTTP(dial, timeout)
+		}
+	default:
+		err = fmt.Errorf("unknown transport %q", c.Transport)
+	}
+	if err != nil {
+		return err
+	}
+	c.connected = true
+	c.catchUp = true
+	return nil
+}
+
+// A transport carries JSON-encoded Envelopes to the entry server. Each
+// transport delivers what it receives to Client.receive.
+type transport interface {
+	Send(data []byte) error
+	Close()
+}
+
+type wsTransport struct {
+	ws *websocket.Conn
+}
+
+func (t *wsTransport) Send(data []byte) error {
+	const writeWait = 10 * time.Second
+	t.ws.SetWriteDeadline(time.Now().Add(writeWait))
+	return t.ws.WriteMessage(websocket.TextMessage, data)
+}
+
+func (t *wsTransport) Close() {
+	t.ws.Close()
+}
+
+func (c *Client) connectWebsocket(dial func(network, addr string) (net.Conn, error), timeout time.Duration) error {
 	wsaddr := fmt.Sprintf("%s/ws?publickey=%s", c.EntryServer, c.MyPublicKey.String())
 	dialer := &websocket.Dialer{
-		HandshakeTimeout: 5 * time.Second,
+		HandshakeTimeout: timeout,
+		NetDial:          dial,
+	}
+	if c.Proxy == "" {
+		// the same proxy as the HTTP transport, so both see the same network
+		dialer.Proxy = http.ProxyFromEnvironment
 	}
 	ws, _, err := dialer.Dial(wsaddr, nil)
 	if err != nil {
 		return err
 	}
-	c.ws = ws
-	go c.readLoop()
+	t := &wsTransport{ws: ws}
+	c.conn = t
+	go c.readLoop(t)
 	return nil
 }
 
+func proxyDialer(proxyURL string) (proxy.Dialer, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("bad proxy url: %s", err)
+	}
+	if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+		return nil, fmt.Errorf("unsupported proxy scheme: %q (expecting socks5)", u.Scheme)
+	}
+	// x/net/proxy passes hostnames to the proxy unresolved, so DNS
+	// lookups happen on the proxy side for both schemes.
+	return proxy.FromURL(u, proxy.Direct)
+}
+
+func (c *Client) Connected() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.connected
+}
+
+func (c *Client) Traffic() Traffic {
+	return Traffic{
+		BytesSent:     atomic.LoadInt64(&c.traffic.BytesSent),
+		BytesReceived: atomic.LoadInt64(&c.traffic.BytesReceived),
+		ConvoRounds:   atomic.LoadInt64(&c.traffic.ConvoRounds),
+		DialRounds:    atomic.LoadInt64(&c.traffic.DialRounds),
+	}
+}
+
 func (c *Client) Close() {
-	c.ws.Close()
+	c.Lock()
+	c.close()
+	c.Unlock()
 }
 
-func (c *Client) Send(v interface{}) {
-	const writeWait = 10 * time.Second
+func (c *Client) close() {
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.connected = false
+}
 
+func (c *Client) Send(v interface{}) {
 	e, err := Envelop(v)
 	if err != nil {
 		log.WithFields(log.Fields{"bug": true, "call": "Envelop"}).Error(err)
 		return
 	}
 
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.WithFields(log.Fields{"bug": true, "call": "json.Marshal"}).Error(err)
+		return
+	}
+
 	c.Lock()
-	c.ws.SetWriteDeadline(time.Now().Add(writeWait))
-	if err := c.ws.WriteJSON(e); err != nil {
-		log.WithFields(log.Fields{"call": "WriteJSON"}).Debug(err)
-		c.Unlock()
-		c.Close()
+	defer c.Unlock()
+	if !c.connected {
 		return
 	}
-	c.Unlock()
+	if err := c.conn.Send(data); err != nil {
+		log.WithFields(log.Fields{"call": "Send"}).Debug(err)
+		c.close()
+		c.disconnected(err)
+		return
+	}
+	atomic.AddInt64(&c.traffic.BytesSent, int64(len(data)))
 }
 
-func (c *Client) readLoop() {
+func (c *Client) readLoop(t *wsTransport) {
 	for {
-		var e Envelope
-		if err := c.ws.ReadJSON(&e); err != nil {
-			log.WithFields(log.Fields{"call": "ReadJSON"}).Debug(err)
-			c.Close()
+		_, data, err := t.ws.ReadMessage()
+		if err != nil {
+			log.WithFields(log.Fields{"call": "ReadMessage"}).Debug(err)
+			c.transportFailed(t, err)
 			break
 		}
+		c.receive(data)
+	}
+}
 
-		v, err := e.Open()
-		if err != nil {
-			log.WithFields(log.Fields{"call": "Envelope.Open"}).Error(err)
-			continue
-		}
-		go c.handleResponse(v)
+// transportFailed disconnects unless t has already been replaced.
+func (c *Client) transportFailed(t transport, err error) {
+	c.Lock()
+	failed := c.conn == t && c.connected
+	if failed {
+		c.close()
+	}
+	c.Unlock()
+	if failed {
+		c.disconnected(err)
+	}
+}
+
+func (c *Client) disconnected(err error) {
+	if c.Disconnected != nil {
+		go c.Disconnected(err)
+	}
+}
+
+func (c *Client) receive(data []byte) {
+	atomic.AddInt64(&c.traffic.BytesReceived, int64(len(data)))
+
+	var e Envelope
+	if err := json.Unmarshal(data, &e); err != nil {
+		log.WithFields(log.Fields{"call": "json.Unmarshal"}).Error(err)
+		return
+	}
+
+	v, err := e.Open()
+	if err != nil {
+		log.WithFields(log.Fields{"call": "Envelope.Open"}).Error(err)
+		return
 	}
+	go c.handleResponse(v)
 }
 
 func (c *Client) handleResponse(v interface{}) {
@@ -125,13 +318,108 @@ func (c *Client) handleResponse(v interface{}) {
 	case *BadRequestError:
 		log.Printf("bad request error: %s", v.Error())
 	case *AnnounceConvoRound:
+		if err := c.checkAnnouncement(v.Round, v.Epoch, v.Timestamp, v.Verify, &c.nextConvoRound); err != nil {
+			log.WithFields(log.Fields{"round": v.Round, "call": "AnnounceConvoRound"}).Error(err)
+			return
+		}
+		atomic.AddInt64(&c.traffic.ConvoRounds, 1)
+		if c.backingOff(v.Round) {
+			return
+		}
 		c.Send(c.nextConvoRequest(v.Round))
 	case *AnnounceDialRound:
+		if err := c.checkAnnouncement(v.Round, v.Epoch, v.Timestamp, v.Verify, &c.nextDialRound); err != nil {
+			log.WithFields(log.Fields{"round": v.Round, "call": "AnnounceDialRound"}).Error(err)
+			return
+		}
+		atomic.AddInt64(&c.traffic.DialRounds, 1)
 		c.Send(c.dialHandler.NextDialRequest(v.Round, v.Buckets))
+		c.fetchRetainedBuckets(v.Round)
 	case *ConvoResponse:
 		c.deliverConvoResponse(v)
+	case *ConvoError:
+		c.deliverConvoError(v)
 	case *DialBucket:
 		c.dialHandler.HandleDialBucket(v)
+	case *DialError:
+		log.WithFields(log.Fields{"round": v.Round}).Debug(v.Err)
+	}
+}
+
+// A client that hasn't accepted any rounds yet (see SetRounds) rejects
+// signed announcements older than this, so they can't be replayed to it.
+// After that, rounds only have to increase, and the client's clock
+// doesn't matter.
+const maxAnnouncementAge = 24 * time.Hour
+
+func (c *Client) checkAnnouncement(round, epoch uint32, timestamp int64, verify func(*VerifyKey) bool, next *uint32) error {
+	if err := c.advance(round, epoch, timestamp, verify, next); err != nil {
+		return err
+	}
+	if c.Advanced != nil {
+		c.Advanced()
+	}
+	return nil
+}
+
+func (c *Client) advance(round, epoch uint32, timestamp int64, verify func(*VerifyKey) bool, next *uint32) error {
+	c.Lock()
+	defer c.Unlock()
+	if c.VerifyKey != nil {
+		if !verify(c.VerifyKey) {
+			return fmt.Errorf("bad signature")
+		}
+		if epoch != c.Epoch {
+			return fmt.Errorf("signed for epoch %d, expecting %d (is the PKI up to date?)", epoch, c.Epoch)
+		}
+		if age := time.Since(time.Unix(timestamp, 0)); *next == 0 && (age > maxAnnouncementAge || age < -maxAnnouncementAge) {
+			return fmt.Errorf("timestamp is off by %s", age)
+		}
+	}
+
+	if round < *next {
+		return fmt.Errorf("round did not increase (expecting at least %d)", *next)
+	}
+	*next = round + 1
+	return nil
+}
+
+// Rounds returns the first convo and dial rounds the client will accept.
+func (c *Client) Rounds() (convo, dial uint32) {
+	c.Lock()
+	defer c.Unlock()
+	return c.nextConvoRound, c.nextDialRound
+}
+
+// SetRounds restores Rounds from an earlier run.
+func (c *Client) SetRounds(convo, dial uint32) {
+	c.Lock()
+	defer c.Unlock()
+	if convo > c.nextConvoRound {
+		c.nextConvoRound = convo
+	}
+	if dial > c.nextDialRound {
+		c.nextDialRound = dial
+	}
+}
+
+// fetchRetainedBuckets catches up on introductions sent while we were
+// disconnected. It always asks for every retained round, so the requests
+// don't reveal how long we were gone.
+func (c *Client) fetchRetainedBuckets(round uint32) {
+	c.Lock()
+	catchUp := c.catchUp
+	c.catchUp = false
+	c.Unlock()
+	if !catchUp {
+		return
+	}
+
+	for i := uint32(DialHistoryRounds); i > 0; i-- {
+		if i > round {
+			continue
+		}
+		c.Send(&DialBucketRequest{Round: round - i})
 	}
 }
 
@@ -154,3 +442,25 @@ func (c *Client) deliverConvoResponse(r *ConvoResponse) {
 
 	convo.HandleConvoResponse(r)
 }
+
+func (c *Client) backingOff(round uint32) bool {
+	c.Lock()
+	defer c.Unlock()
+	return round < c.convoBackoff
+}
+
+func (c *Client) deliverConvoError(e *ConvoError) {
+	c.Lock()
+	convo, ok := c.roundHandlers[e.Round]
+	delete(c.roundHandlers, e.Round)
+	if e.RetryAfter > 0 && e.Round+e.RetryAfter >= c.convoBackoff {
+		c.convoBackoff = e.Round + e.RetryAfter + 1
+	}
+	c.Unlock()
+	if !ok {
+		log.WithFields(log.Fields{"round": e.Round}).Error(e.Err)
+		return
+	}
+
+	convo.HandleConvoError(e)
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/davidlazar/vuvuzela"
+)
+
+// fakeSOCKS5 accepts connections until l is closed, records the
+// requested addresses, and refuses them.
+func fakeSOCKS5(l net.Listener, requested chan<- string) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		if host, ok := socks5Request(conn); ok {
+			select {
+			case requested <- host:
+			default:
+			}
+		}
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		conn.Close()
+	}
+}
+
+func socks5Request(conn net.Conn) (string, bool) {
+	buf := make([]byte, 256)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return "", false
+	}
+	if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+		return "", false
+	}
+	conn.Write([]byte{5, 0})
+
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return "", false
+	}
+	if buf[3] != 3 {
+		return "not a domain name", true
+	}
+	if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+		return "", false
+	}
+	host := make([]byte, buf[0])
+	io.ReadFull(conn, host)
+	io.ReadFull(conn, buf[:2])
+	return string(host), true
+}
+
+func TestProxyResolvesRemotely(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// The websocket and the HTTP fallback both go through the proxy.
+	requested := make(chan string, 2)
+	go fakeSOCKS5(l, requested)
+
+	public, _, _ := GenerateBoxKey(rand.Reader)
+	client := NewClient("ws://entry.vuvuzela.invalid:8080", public)
+	client.Proxy = "socks5://" + l.Addr().String()
+	client.SetConvoHandler(new(Conversation))
+	client.SetDialHandler(new(Dialer))
+
+	if err := client.Connect(); err == nil {
+		t.Fatalf("expecting the proxy to refuse the connection")
+	}
+	for i := 0; i < 2; i++ {
+		if host := <-requested; host != "entry.vuvuzela.invalid" {
+			t.Fatalf("expecting the proxy to resolve the entry server, got %q", host)
+		}
+	}
+}
+
+type testDialHandler struct {
+	rounds chan uint32
+}
+
+func (h *testDialHandler) NextDialRequest(round uint32, buckets uint32) *DialRequest {
+	h.rounds <- round
+	return &DialRequest{Round: round}
+}
+
+func (h *testDialHandler) HandleDialBucket(db *DialBucket) {}
+
+func TestHTTPFallback(t *testing.T) {
+	announce, _ := Envelop(&AnnounceDialRound{Round: 5, Buckets: 1})
+	data, _ := json.Marshal(announce)
+	sent := make(chan *Envelope, 64)
+	acks := make(chan string, 64)
+	var polls int32
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "websockets blocked", http.StatusForbidden)
+	})
+	mux.HandleFunc(HTTPConnectPath, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&HTTPSession{Session: "s1"})
+	})
+	mux.HandleFunc(HTTPRecvPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("session") != "s1" {
+			http.Error(w, "unknown session", http.StatusNotFound)
+			return
+		}
+		acks <- r.URL.Query().Get("after")
+		switch atomic.AddInt32(&polls, 1) {
+		case 1:
+			// The response is lost, so the announcement must be sent again.
+			http.Error(w, "bad gateway", http.StatusBadGateway)
+		case 2, 3:
+			// Sent again to a poll that already acknowledged it.
+			json.NewEncoder(w).Encode(&HTTPBatch{First: 1, Envelopes: []json.RawMessage{data}})
+		default:
+			time.Sleep(100 * time.Millisecond)
+			json.NewEncoder(w).Encode(&HTTPBatch{First: 2})
+		}
+	})
+	mux.HandleFunc(HTTPSendPath, func(w http.ResponseWriter, r *http.Request) {
+		e := new(Envelope)
+		if err := json.NewDecoder(r.Body).Decode(e); err != nil {
+			t.Error(err)
+		}
+		sent <- e
+	})
+	mux.HandleFunc(HTTPClosePath, func(w http.ResponseWriter, r *http.Request) {})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	public, _, _ := GenerateBoxKey(rand.Reader)
+	client := NewClient(strings.Replace(srv.URL, "http://", "ws://", 1), public)
+	dialer := &testDialHandler{rounds: make(chan uint32, 1)}
+	client.SetConvoHandler(new(Conversation))
+	client.SetDialHandler(dialer)
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, ok := client.conn.(*httpTransport); !ok {
+		t.Fatalf("expecting the HTTP transport, got %T", client.conn)
+	}
+
+	if round := <-dialer.rounds; round != 5 {
+		t.Fatalf("unexpected dial round %d", round)
+	}
+	e := <-sent
+	v, err := e.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, ok := v.(*DialRequest); !ok || r.Round != 5 {
+		t.Fatalf("unexpected request: %#v", v)
+	}
+
+	for i, want := range []string{"0", "0", "1", "1"} {
+		if after := <-acks; after != want {
+			t.Fatalf("poll %d: after=%s, expecting %s", i+1, after, want)
+		}
+	}
+	select {
+	case round := <-dialer.rounds:
+		t.Fatalf("dial round %d handled twice", round)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestBadProxy(t *testing.T) {
+	if _, err := proxyDialer("http://127.0.0.1:8080"); err == nil {
+		t.Fatalf("expecting error for non-SOCKS5 proxy")
+	}
+}
+
+func TestCheckAnnouncement(t *testing.T) {
+	verifyKey, signingKey, _ := GenerateSigningKey(rand.Reader)
+	client := NewClient("", nil)
+	client.VerifyKey = verifyKey
+	client.Epoch = 3
+
+	announce := func(round, epoch uint32, age time.Duration) *AnnounceConvoRound {
+		ts := time.Now().Add(-age).Unix()
+		return &AnnounceConvoRound{
+			Round:     round,
+			Epoch:     epoch,
+			Timestamp: ts,
+			Signature: signingKey.Sign(ConvoRoundMessage(round, epoch, ts)),
+		}
+	}
+	check := func(a *AnnounceConvoRound) error {
+		return client.checkAnnouncement(a.Round, a.Epoch, a.Timestamp, a.Verify, &client.nextConvoRound)
+	}
+
+	// Every accepted round is saved before it's used.
+	var saved []uint32
+	client.Advanced = func() {
+		convo, _ := client.Rounds()
+		saved = append(saved, convo)
+	}
+	if err := check(announce(10, 3, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 1 || saved[0] != 11 {
+		t.Fatalf("expecting round 11 to be saved, got %v", saved)
+	}
+	if err := check(announce(10, 3, 0)); err == nil {
+		t.Fatalf("accepted a repeated round")
+	}
+	if err := check(announce(9, 3, 0)); err == nil {
+		t.Fatalf("accepted an earlier round")
+	}
+	if err := check(announce(11, 2, 0)); err == nil {
+		t.Fatalf("accepted an announcement for the wrong epoch")
+	}
+	// Once rounds have been accepted, only their order matters.
+	if err := check(announce(12, 3, time.Hour)); err != nil {
+		t.Fatalf("rejected a late announcement: %s", err)
+	}
+	fresh := NewClient("", nil)
+	fresh.VerifyKey = verifyKey
+	fresh.Epoch = 3
+	stale := announce(12, 3, 2*maxAnnouncementAge)
+	if err := fresh.checkAnnouncement(stale.Round, stale.Epoch, stale.Timestamp, stale.Verify, &fresh.nextConvoRound); err == nil {
+		t.Fatalf("accepted a stale announcement")
+	}
+	fresh.SetRounds(client.Rounds())
+	old := announce(11, 3, 0)
+	if err := fresh.checkAnnouncement(old.Round, old.Epoch, old.Timestamp, old.Verify, &fresh.nextConvoRound); err == nil {
+		t.Fatalf("accepted a round from before a restart")
+	}
+	a := announce(13, 3, 0)
+	a.Round++
+	if err := check(a); err == nil {
+		t.Fatalf("accepted a forged announcement")
+	}
+	if err := check(announce(20, 3, 0)); err != nil {
+		t.Fatal(err)
+	}
+	// Rejected rounds aren't saved.
+	if len(saved) != 3 || saved[2] != 21 {
+		t.Fatalf("unexpected saved rounds: %v", saved)
+	}
+}
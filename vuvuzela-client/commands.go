@@ -0,0 +1,197 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/jroimartin/gocui"
+)
+
+// A command is what the user can type after a slash.
+type command struct {
+	name string
+	args string
+	help string
+	run  func(gc *GuiClient, args string) error
+}
+
+var commands = make(map[string]*command)
+
+func registerCommand(c *command) {
+	if commands[c.name] != nil {
+		panic("duplicate command: /" + c.name)
+	}
+	commands[c.name] = c
+}
+
+func (c *command) usage() string {
+	if c.args == "" {
+		return "/" + c.name
+	}
+	return "/" + c.name + " " + c.args
+}
+
+func (gc *GuiClient) handleLine(line string) error {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return nil
+	}
+	if !strings.HasPrefix(line, "/") || strings.HasPrefix(line, "//") {
+		gc.sendText(strings.TrimPrefix(line, "/"))
+		return nil
+	}
+
+	fields := strings.SplitN(line[1:], " ", 2)
+	args := ""
+	if len(fields) == 2 {
+		args = strings.TrimSpace(fields[1])
+	}
+	c := commands[fields[0]]
+	if c == nil {
+		gc.Warnf("Unknown command: /%s (see /help)\n", fields[0])
+		return nil
+	}
+	return c.run(gc, args)
+}
+
+func (gc *GuiClient) sendText(msg string) {
+	gc.selectedConvo.QueueTextMessage([]byte(msg))
+	gc.PeerPrintf(gc.selectedConvo.peerName, "<%s> %s\n", gc.myName, msg)
+}
+
+func (gc *GuiClient) showHelp(name string) {
+	if name != "" {
+		c := commands[strings.TrimPrefix(name, "/")]
+		if c == nil {
+			gc.Warnf("Unknown command: %s\n", name)
+			return
+		}
+		gc.Warnf("%s: %s\n", c.usage(), c.help)
+		return
+	}
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c := commands[name]
+		gc.Warnf("%-24s %s\n", c.usage(), c.help)
+	}
+	gc.Warnf("Lines without a slash are sent to the current conversation (start with // to send a slash).\n")
+	gc.Warnf("Ctrl-N/Ctrl-P switch conversations, PgUp/PgDn scroll, Ctrl-L jumps to the bottom.\n")
+}
+
+func init() {
+	registerCommand(&command{
+		name: "help",
+		args: "[command]",
+		help: "list commands, or explain one",
+		run: func(gc *GuiClient, args string) error {
+			gc.showHelp(args)
+			return nil
+		},
+	})
+	registerCommand(&command{
+		name: "quit",
+		help: "exit",
+		run: func(gc *GuiClient, args string) error {
+			return gocui.Quit
+		},
+	})
+	registerCommand(&command{
+		name: "talk",
+		args: "<user>",
+		help: "switch to the conversation with user",
+		run: func(gc *GuiClient, args string) error {
+			if args == "" {
+				gc.Warnf("usage: /talk <user>\n")
+				return nil
+			}
+			gc.switchConversation(args)
+			return nil
+		},
+	})
+	registerCommand(&command{
+		name: "dial",
+		args: "<user> [note]",
+		help: "ask user to talk, with an optional short note",
+		run: func(gc *GuiClient, args string) error {
+			gc.dial(args)
+			return nil
+		},
+	})
+	registerCommand(&command{
+		name: "clear",
+		help: "clear the current conversation's scrollback",
+		run: func(gc *GuiClient, args string) error {
+			gc.bufMu.Lock()
+			*gc.buffer(gc.shownBuffer) = buffer{}
+			gc.bufMu.Unlock()
+			return nil
+		},
+	})
+	registerCommand(&command{
+		name: "mycard",
+		args: "[days]",
+		help: "show your contact card, valid for days",
+		run: func(gc *GuiClient, args string) error {
+			gc.showCard(args)
+			return nil
+		},
+	})
+	registerCommand(&command{
+		name: "import",
+		args: "<card>",
+		help: "add a contact from their card",
+		run: func(gc *GuiClient, args string) error {
+			gc.importCard(args)
+			return nil
+		},
+	})
+	registerCommand(&command{
+		name: "requests",
+		help: "list incoming dial requests",
+		run: func(gc *GuiClient, args string) error {
+			gc.listRequests()
+			return nil
+		},
+	})
+	registerCommand(&command{
+		name: "accept",
+		args: "<n> [name]",
+		help: "accept dial request n",
+		run: func(gc *GuiClient, args string) error {
+			gc.acceptRequest(args)
+			return nil
+		},
+	})
+	registerCommand(&command{
+		name: "decline",
+		args: "<n>",
+		help: "decline dial request n",
+		run: func(gc *GuiClient, args string) error {
+			gc.declineRequest(args)
+			return nil
+		},
+	})
+	registerCommand(&command{
+		name: "block",
+		args: "<n|name>",
+		help: "ignore dial requests from request n's sender, or from a contact (by key, so a stranger can get around it with a new key)",
+		run: func(gc *GuiClient, args string) error {
+			gc.blockSender(args)
+			return nil
+		},
+	})
+	registerCommand(&command{
+		name: "unblock",
+		args: "<name|key>",
+		help: "stop ignoring a blocked sender",
+		run: func(gc *GuiClient, args string) error {
+			gc.unblockSender(args)
+			return nil
+		},
+	})
+}
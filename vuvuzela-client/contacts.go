@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davidlazar/go-crypto/encoding/base32"
+	log "github.com/sirupsen/logrus"
+	"rsc.io/qr"
+
+	. "github.com/davidlazar/vuvuzela"
+)
+
+const (
+	cardPrefix  = "vuvuzela:"
+	cardVersion = 1
+)
+
+// A ContactCard lets someone add us as a contact in one step. It is
+// signed with a key derived from our box key, so the name and expiry
+// can't be changed without also changing the keys. It doesn't prove who
+// made it: make sure the card came from the person you expect.
+type ContactCard struct {
+	Name      string
+	PublicKey BoxKey
+	VerifyKey VerifyKey
+	Expires   int64 `json:",omitempty"` // unix time, 0 for never
+	Signature []byte
+}
+
+func cardSigningKey(privateKey *BoxKey) (*VerifyKey, *SigningKey) {
+	h := sha256.New()
+	h.Write([]byte("vuvuzela contact card"))
+	h.Write(privateKey[:])
+	return SigningKeyFromSeed(h.Sum(nil))
+}
+
+func NewContactCard(name string, publicKey, privateKey *BoxKey, expires time.Time) *ContactCard {
+	verifyKey, signingKey := cardSigningKey(privateKey)
+	card := &ContactCard{
+		Name:      name,
+		PublicKey: *publicKey,
+		VerifyKey: *verifyKey,
+	}
+	if !expires.IsZero() {
+		card.Expires = expires.Unix()
+	}
+	card.Signature = signingKey.Sign(card.signedData())
+	return card
+}
+
+func (c *ContactCard) signedData() []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(cardVersion)
+	buf.Write(c.PublicKey[:])
+	buf.Write(c.VerifyKey[:])
+	binary.Write(buf, binary.BigEndian, c.Expires)
+	buf.WriteByte(byte(len(c.Name)))
+	buf.WriteString(c.Name)
+	return buf.Bytes()
+}
+
+func (c *ContactCard) String() string {
+	data := append(c.signedData(), c.Signature...)
+	return cardPrefix + base32.EncodeToString(data)
+}
+
+// ParseContactCard decodes a card and checks its signature and expiry.
+func ParseContactCard(s string) (*ContactCard, error) {
+	card, err := decodeContactCard(s)
+	if err != nil {
+		return nil, err
+	}
+	if card.Expired(time.Now()) {
+		return nil, fmt.Errorf("contact card for %s expired on %s", card.Name, time.Unix(card.Expires, 0).Format("2006-01-02"))
+	}
+	return card, nil
+}
+
+func decodeContactCard(s string) (*ContactCard, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, cardPrefix) {
+		return nil, fmt.Errorf("not a contact card (expecting %q prefix)", cardPrefix)
+	}
+	data, err := base32.DecodeString(s[len(cardPrefix):])
+	if err != nil {
+		return nil, fmt.Errorf("base32 decode error: %s", err)
+	}
+
+	const fixed = 1 + 32 + 32 + 8 + 1
+	if len(data) < fixed+64 {
+		return nil, fmt.Errorf("short contact card")
+	}
+	if data[0] != cardVersion {
+		return nil, fmt.Errorf("unsupported contact card version: %d", data[0])
+	}
+	card := new(ContactCard)
+	copy(card.PublicKey[:], data[1:33])
+	copy(card.VerifyKey[:], data[33:65])
+	card.Expires = int64(binary.BigEndian.Uint64(data[65:73]))
+	nameLen := int(data[73])
+	if len(data) != fixed+nameLen+64 {
+		return nil, fmt.Errorf("bad contact card length")
+	}
+	card.Name = string(data[fixed : fixed+nameLen])
+	card.Signature = data[fixed+nameLen:]
+
+	if !card.VerifyKey.Verify(data[:fixed+nameLen], card.Signature) {
+		return nil, fmt.Errorf("bad contact card signature")
+	}
+	if card.Name == "" || strings.ContainsAny(card.Name, " \t\n/") {
+		return nil, fmt.Errorf("bad name in contact card: %q", card.Name)
+	}
+	return card, nil
+}
+
+func (c *ContactCard) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+// UnmarshalText doesn't check the expiry, so saved contacts outlive
+// their cards.
+func (c *ContactCard) UnmarshalText(text []byte) error {
+	card, err := decodeContactCard(string(text))
+	if err != nil {
+		return err
+	}
+	*c = *card
+	return nil
+}
+
+func (c *ContactCard) Expired(now time.Time) bool {
+	return c.Expires != 0 && now.Unix() > c.Expires
+}
+
+// QR renders the card as a QR code for the terminal, using half blocks
+// so each character is two modules tall. Light modules are drawn, which
+// looks right on a dark terminal.
+func (c *ContactCard) QR() (string, error) {
+	code, err := qr.Encode(c.String(), qr.L)
+	if err != nil {
+		return "", err
+	}
+
+	const quiet = 2
+	light := func(x, y int) bool {
+		return !code.Black(x, y)
+	}
+	buf := new(bytes.Buffer)
+	for y := -quiet; y < code.Size+quiet; y += 2 {
+		for x := -quiet; x < code.Size+quiet; x++ {
+			top, bottom := light(x, y), light(x, y+1)
+			switch {
+			case top && bottom:
+				buf.WriteString("█")
+			case top:
+				buf.WriteString("▀")
+			case bottom:
+				buf.WriteString("▄")
+			default:
+				buf.WriteString(" ")
+			}
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.String(), nil
+}
+
+// ContactBook holds everyone we can talk to: the people in the PKI,
+// the contacts imported from cards, and the senders of dial requests
+// we accepted.
+type ContactBook struct {
+	sync.RWMutex
+
+	people   map[string]*BoxKey
+	cards    map[string]*ContactCard
+	accepted map[string]*BoxKey
+}
+
+func NewContactBook(people map[string]*BoxKey) *ContactBook {
+	b := &ContactBook{
+		people:   make(map[string]*BoxKey),
+		cards:    make(map[string]*ContactCard),
+		accepted: make(map[string]*BoxKey),
+	}
+	for name, key := range people {
+		b.people[name] = key
+	}
+	return b
+}
+
+func (b *ContactBook) Lookup(name string) (*BoxKey, bool) {
+	b.RLock()
+	defer b.RUnlock()
+	key, ok := b.people[name]
+	return key, ok
+}
+
+func (b *ContactBook) NameOf(key *BoxKey) (string, bool) {
+	b.RLock()
+	defer b.RUnlock()
+	for name, k := range b.people {
+		if *k == *key {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func (b *ContactBook) Names() []string {
+	b.RLock()
+	defer b.RUnlock()
+	names := make([]string, 0, len(b.people))
+	for name := range b.people {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (b *ContactBook) checkNew(name string, key *BoxKey) error {
+	if k, ok := b.people[name]; ok && *k != *key {
+		return fmt.Errorf("%s is already a contact with a different key", name)
+	}
+	for n, k := range b.people {
+		if *k == *key && n != name {
+			return fmt.Errorf("this key is already a contact named %s", n)
+		}
+	}
+	return nil
+}
+
+func (b *ContactBook) Import(card *ContactCard) error {
+	b.Lock()
+	defer b.Unlock()
+
+	if err := b.checkNew(card.Name, &card.PublicKey); err != nil {
+		return err
+	}
+	key := card.PublicKey
+	b.people[card.Name] = &key
+	b.cards[card.Name] = card
+	return nil
+}
+
+// Add adds a contact we only know by key, like the sender of an
+// accepted dial request.
+func (b *ContactBook) Add(name string, key *BoxKey) error {
+	if name == "" || strings.ContainsAny(name, " \t\n/") {
+		return fmt.Errorf("bad name: %q", name)
+	}
+	b.Lock()
+	defer b.Unlock()
+
+	if err := b.checkNew(name, key); err != nil {
+		return err
+	}
+	k := *key
+	b.people[name] = &k
+	b.accepted[name] = &k
+	return nil
+}
+
+// Saved returns the contacts that aren't in the PKI, for saving.
+func (b *ContactBook) Saved() *SavedContacts {
+	b.RLock()
+	defer b.RUnlock()
+	saved := &SavedContacts{
+		Cards:    make([]*ContactCard, 0, len(b.cards)),
+		Accepted: make(map[string]*BoxKey, len(b.accepted)),
+	}
+	for _, card := range b.cards {
+		saved.Cards = append(saved.Cards, card)
+	}
+	sort.Slice(saved.Cards, func(i, j int) bool {
+		return saved.Cards[i].Name < saved.Cards[j].Name
+	})
+	for name, key := range b.accepted {
+		saved.Accepted[name] = key
+	}
+	return saved
+}
+
+func (gc *GuiClient) loadContacts() {
+	gc.contacts = NewContactBook(gc.pki.People)
+	gc.inbox = NewInbox(gc.introPolicy, gc.contacts)
+	if gc.store == nil {
+		return
+	}
+	saved, err := gc.store.LoadContacts()
+	if err != nil {
+		log.WithFields(log.Fields{"call": "LoadContacts"}).Error(err)
+		return
+	}
+	for _, card := range saved.Cards {
+		if err := gc.contacts.Import(card); err != nil {
+			log.WithFields(log.Fields{"call": "LoadContacts"}).Warn(err)
+		}
+	}
+	for name, key := range saved.Accepted {
+		if err := gc.contacts.Add(name, key); err != nil {
+			log.WithFields(log.Fields{"call": "LoadContacts"}).Warn(err)
+		}
+	}
+	for _, key := range saved.Blocked {
+		gc.inbox.Block(key)
+	}
+}
+
+func (gc *GuiClient) saveContacts() {
+	if gc.store == nil {
+		return
+	}
+	saved := gc.contacts.Saved()
+	saved.Blocked = gc.inbox.Blocked()
+	if err := gc.store.SaveContacts(saved); err != nil {
+		log.WithFields(log.Fields{"call": "SaveContacts"}).Error(err)
+	}
+}
+
+// showCard prints our contact card. An optional argument sets how many
+// days the card is valid for.
+func (gc *GuiClient) showCard(arg string) {
+	var expires time.Time
+	if arg != "" {
+		days, err := strconv.Atoi(arg)
+		if err != nil || days <= 0 {
+			gc.Warnf("usage: /mycard [days]\n")
+			return
+		}
+		expires = time.Now().AddDate(0, 0, days)
+	}
+	card := NewContactCard(gc.myName, gc.myPublicKey, gc.myPrivateKey, expires)
+	qr, err := card.QR()
+	if err != nil {
+		gc.Warnf("QR: %s\n", err)
+	} else {
+		gc.Printf("%s", qr)
+	}
+	gc.Printf("%s\n", card)
+}
+
+func (gc *GuiClient) importCard(s string) {
+	card, err := ParseContactCard(s)
+	if err != nil {
+		gc.Warnf("Import failed: %s\n", err)
+		return
+	}
+	if card.PublicKey == *gc.myPublicKey {
+		gc.Warnf("That's your own card\n")
+		return
+	}
+	if err := gc.contacts.Import(card); err != nil {
+		gc.Warnf("Import failed: %s\n", err)
+		return
+	}
+	gc.saveContacts()
+	gc.Warnf("Added contact: %s (/dial %s)\n", card.Name, card.Name)
+}
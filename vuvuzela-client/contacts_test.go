@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/davidlazar/vuvuzela"
+)
+
+func TestContactCard(t *testing.T) {
+	public, private, _ := GenerateBoxKey(rand.Reader)
+
+	card := NewContactCard("alice", public, private, time.Now().AddDate(0, 0, 7))
+	s := card.String()
+	if !strings.HasPrefix(s, "vuvuzela:") {
+		t.Fatalf("bad card string: %q", s)
+	}
+	xcard, err := ParseContactCard(s)
+	if err != nil {
+		t.Fatalf("ParseContactCard: %s", err)
+	}
+	if xcard.Name != "alice" || xcard.PublicKey != *public || xcard.Expires != card.Expires {
+		t.Fatalf("card mismatch: %#v", xcard)
+	}
+	if _, err := card.QR(); err != nil {
+		t.Fatalf("QR: %s", err)
+	}
+
+	// Changing the name must break the signature.
+	forged := *card
+	forged.Name = "mallory"
+	if _, err := ParseContactCard(forged.String()); err == nil {
+		t.Fatalf("expecting error for forged card")
+	}
+
+	expired := NewContactCard("alice", public, private, time.Now().Add(-time.Hour))
+	if _, err := ParseContactCard(expired.String()); err == nil {
+		t.Fatalf("expecting error for expired card")
+	}
+	if _, err := decodeContactCard(expired.String()); err != nil {
+		t.Fatalf("decodeContactCard: %s", err)
+	}
+}
+
+func TestContactBook(t *testing.T) {
+	alicePublic, _, _ := GenerateBoxKey(rand.Reader)
+	bobPublic, bobPrivate, _ := GenerateBoxKey(rand.Reader)
+
+	book := NewContactBook(map[string]*BoxKey{"alice": alicePublic})
+	if err := book.Import(NewContactCard("bob", bobPublic, bobPrivate, time.Time{})); err != nil {
+		t.Fatalf("Import: %s", err)
+	}
+	if key, ok := book.Lookup("bob"); !ok || *key != *bobPublic {
+		t.Fatalf("bob not found after import")
+	}
+	if name, _ := book.NameOf(bobPublic); name != "bob" {
+		t.Fatalf("expecting bob, got %q", name)
+	}
+
+	if err := book.Import(NewContactCard("alice", bobPublic, bobPrivate, time.Time{})); err == nil {
+		t.Fatalf("expecting error importing a second key for alice")
+	}
+	if err := book.Import(NewContactCard("robert", bobPublic, bobPrivate, time.Time{})); err == nil {
+		t.Fatalf("expecting error importing bob's key under another name")
+	}
+
+	dir, err := ioutil.TempDir("", "vuvuzela-contacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, _ := OpenStore(dir)
+	if err := store.SaveContacts(book.Saved()); err != nil {
+		t.Fatalf("SaveContacts: %s", err)
+	}
+	saved, err := store.LoadContacts()
+	if err != nil {
+		t.Fatalf("LoadContacts: %s", err)
+	}
+	if len(saved.Cards) != 1 || saved.Cards[0].Name != "bob" || saved.Cards[0].PublicKey != *bobPublic {
+		t.Fatalf("unexpected contacts: %#v", saved)
+	}
+}
@@ -2,14 +2,10 @@ package main
 
 import (
 	"bytes"
-	"crypto/hmac"
 	"crypto/rand"
-	"crypto/sha256"
-	"encoding/binary"
-	"fmt"
-	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/nacl/box"
@@ -22,23 +18,35 @@ type Conversation struct {
 	sync.RWMutex
 
 	pki           *PKI
+	contacts      *ContactBook
 	peerName      string
 	peerPublicKey *BoxKey
 	myPublicKey   *BoxKey
 	myPrivateKey  *BoxKey
 	gui           *GuiClient
+	mailbox       bool
+	schedule      *Schedule
 
-	outQueue      chan []byte
+	outQueue      [][]byte
 	pendingRounds map[uint32]*pendingRound
 
 	lastPeerResponding bool
-	lastLatency        time.Duration
 	lastRound          uint32
+
+	rtt         RTTStats
+	peerToken   uint64
+	peerTokenAt time.Time
+	echoOffset  uint64
+
+	unansweredRounds int
+	pickupIndex      int
+
+	warnedTypes map[byte]bool
 }
 
 func (c *Conversation) Init() {
 	c.Lock()
-	c.outQueue = make(chan []byte, 64)
+	c.outQueue = nil
 	c.pendingRounds = make(map[uint32]*pendingRound)
 	c.lastPeerResponding = false
 	c.Unlock()
@@ -47,50 +55,61 @@ func (c *Conversation) Init() {
 type pendingRound struct {
 	onionSharedKeys []*[32]byte
 	sentMessage     [SizeEncryptedMessage]byte
-}
 
-type ConvoMessage struct {
-	Body interface{}
-	// seq/ack numbers can go here
-}
+	// texts are the queued messages sent in this round, if any. They
+	// stay unacknowledged until we see the peer's exchange in the same
+	// round, or until the last server confirms a mailbox deposit.
+	texts [][]byte
+
+	deposit bool
+	pickup  *mailPickup
 
-type TextMessage struct {
-	Message []byte
+	// cover rounds are skipped by the conversation schedule
+	cover bool
 }
 
-type TimestampMessage struct {
-	Timestamp time.Time
+// Longer texts are queued in parts, so that every part fits on its own
+// in any slot, including a mailbox deposit.
+const maxTextSize = SizeMailboxMessage - 1
+
+func (c *Conversation) QueueTextMessage(msg []byte) {
+	c.Lock()
+	c.outQueue = append(c.outQueue, splitText(msg)...)
+	c.Unlock()
+	c.gui.SaveState()
 }
 
-func (cm *ConvoMessage) Marshal() (msg [SizeMessage]byte) {
-	switch v := cm.Body.(type) {
-	case *TimestampMessage:
-		msg[0] = 0
-		binary.PutVarint(msg[1:], v.Timestamp.Unix())
-	case *TextMessage:
-		msg[0] = 1
-		copy(msg[1:], v.Message)
+// splitText cuts msg into parts of at most maxTextSize bytes, without
+// splitting a UTF-8 sequence.
+func splitText(msg []byte) [][]byte {
+	var parts [][]byte
+	for len(msg) > maxTextSize {
+		n := maxTextSize
+		for n > maxTextSize-utf8.UTFMax && !utf8.RuneStart(msg[n]) {
+			n--
+		}
+		parts = append(parts, msg[:n])
+		msg = msg[n:]
 	}
-	return
+	return append(parts, msg)
 }
 
-func (cm *ConvoMessage) Unmarshal(msg []byte) error {
-	switch msg[0] {
-	case 0:
-		ts, _ := binary.Varint(msg[1:])
-		cm.Body = &TimestampMessage{
-			Timestamp: time.Unix(ts, 0),
-		}
-	case 1:
-		cm.Body = &TextMessage{msg[1:]}
-	default:
-		return fmt.Errorf("unexpected message type: %d", msg[0])
+func (c *Conversation) dequeue() []byte {
+	c.Lock()
+	defer c.Unlock()
+	if len(c.outQueue) == 0 {
+		return nil
 	}
-	return nil
+	m := c.outQueue[0]
+	c.outQueue = c.outQueue[1:]
+	return m
 }
 
-func (c *Conversation) QueueTextMessage(msg []byte) {
-	c.outQueue <- msg
+// requeue puts unacknowledged messages back at the front of the queue.
+func (c *Conversation) requeue(msgs [][]byte) {
+	c.Lock()
+	c.outQueue = append(append([][]byte(nil), msgs...), c.outQueue...)
+	c.Unlock()
 }
 
 func (c *Conversation) NextConvoRequest(round uint32) *ConvoRequest {
@@ -101,37 +120,76 @@ func (c *Conversation) NextConvoRequest(round uint32) *ConvoRequest {
 
 	var body interface{}
 
-	select {
-	case m := <-c.outQueue:
-		body = &TextMessage{Message: m}
-	default:
-		body = &TimestampMessage{
-			Timestamp: time.Now(),
-		}
+	schedule := c.getSchedule()
+	cover := schedule != nil && !schedule.Active(round)
+
+	away := !cover && c.mailbox && c.peerAway()
+	slot := SizeMessage
+	if away {
+		slot = SizeMailboxMessage
+	}
+
+	var texts [][]byte
+	if !cover {
+		texts, body = c.nextText(slot)
+	}
+	if texts == nil {
+		body = c.nextEcho(time.Now())
 	}
 	msg := &ConvoMessage{
 		Body: body,
 	}
 	msgdata := msg.Marshal()
 
-	var encmsg [SizeEncryptedMessage]byte
-	ctxt := c.Seal(msgdata[:], round, c.myRole())
-	copy(encmsg[:], ctxt)
-
-	exchange := &ConvoExchange{
-		DeadDrop:         c.deadDrop(round),
-		EncryptedMessage: encmsg,
+	var mail []byte
+	if texts != nil && away {
+		var err error
+		mail, err = sealMail(msgdata[:], c.peerPublicKey, c.myPrivateKey)
+		if err != nil {
+			log.WithFields(log.Fields{"bug": true, "call": "sealMail"}).Error(err)
+		}
 	}
 
-	onion, sharedKeys := onionbox.Seal(exchange.Marshal(), ForwardNonce(round), c.pki.ServerKeys().Keys())
-
 	pr := &pendingRound{
-		onionSharedKeys: sharedKeys,
-		sentMessage:     encmsg,
+		texts: texts,
+		cover: cover,
 	}
+	exchange := new(ConvoExchange)
+
+	if cover {
+		ctxt := c.Seal(msgdata[:], round, c.myRole())
+		copy(exchange.EncryptedMessage[:], ctxt)
+		rand.Read(exchange.DeadDrop[:])
+	} else if mail != nil {
+		window := round / MailboxWindow
+		exchange.DeadDrop = MailboxDeadDrop(c.myPrivateKey, c.peerPublicKey, c.myRole(), window)
+		exchange.Mode = ExchangeDeposit
+		copy(exchange.EncryptedMessage[:], mail)
+		pr.deposit = true
+	} else {
+		ctxt := c.Seal(msgdata[:], round, c.myRole())
+		copy(exchange.EncryptedMessage[:], ctxt)
+		exchange.DeadDrop = c.deadDrop(round)
+
+		// Checking a mailbox looks just like a conversation with a peer
+		// who doesn't show up.
+		if texts == nil && c.mailbox && (c.Solo() || c.peerAway() && round%2 == 1) {
+			if p, drop := c.nextPickup(round); p != nil {
+				exchange.DeadDrop = drop
+				pr.pickup = p
+			}
+		}
+	}
+
+	onion, sharedKeys := onionbox.Seal(exchange.Marshal(), ForwardNonce(round), c.pki.ServerKeys().Keys())
+	pr.onionSharedKeys = sharedKeys
+	pr.sentMessage = exchange.EncryptedMessage
 	c.Lock()
 	c.pendingRounds[round] = pr
 	c.Unlock()
+	if texts != nil {
+		c.gui.SaveState()
+	}
 
 	return &ConvoRequest{
 		Round: round,
@@ -142,11 +200,33 @@ func (c *Conversation) NextConvoRequest(round uint32) *ConvoRequest {
 func (c *Conversation) HandleConvoResponse(r *ConvoResponse) {
 	rlog := log.WithFields(log.Fields{"round": r.Round})
 
-	var responding bool
+	var responding, delivered bool
+	var pr *pendingRound
 	defer func() {
-		c.Lock()
-		c.lastPeerResponding = responding
-		c.Unlock()
+		if pr != nil && pr.texts != nil {
+			if !responding && !delivered {
+				c.requeue(pr.texts)
+			}
+			c.gui.SaveState()
+		}
+		if pr == nil || !pr.cover {
+			c.Lock()
+			changed := responding != c.lastPeerResponding
+			c.lastPeerResponding = responding
+			if responding {
+				c.unansweredRounds = 0
+			} else {
+				c.unansweredRounds++
+			}
+			c.Unlock()
+			if changed && !c.Solo() {
+				event := "not-responding"
+				if responding {
+					event = "responding"
+				}
+				c.gui.hooks.Emit(&HookEvent{Event: event, Peer: c.peerName, Round: r.Round})
+			}
+		}
 		c.gui.Flush()
 	}()
 
@@ -165,7 +245,23 @@ func (c *Conversation) HandleConvoResponse(r *ConvoResponse) {
 		return
 	}
 
-	if bytes.Compare(encmsg, pr.sentMessage[:]) == 0 && !c.Solo() {
+	if bytes.Compare(encmsg, pr.sentMessage[:]) == 0 {
+		if pr.deposit {
+			delivered = true
+			c.gui.PeerWarnf(c.peerName, "Left a message in %s's mailbox\n", c.peerName)
+			return
+		}
+		if !c.Solo() {
+			return
+		}
+	} else if pr.pickup != nil {
+		c.handleMail(r.Round, pr.pickup, encmsg)
+		if !c.Solo() {
+			return
+		}
+		// An idle client's own message didn't come back, so there is
+		// nothing else to show for this round.
+		responding = true
 		return
 	}
 
@@ -177,28 +273,45 @@ func (c *Conversation) HandleConvoResponse(r *ConvoResponse) {
 
 	msg := new(ConvoMessage)
 	if err := msg.Unmarshal(msgdata); err != nil {
-		rlog.Error("unmarshaling peer message failed")
+		rlog.Errorf("unmarshaling peer message failed: %s", err)
 		return
 	}
 
 	responding = true
+	c.handleMessage(&IncomingMessage{
+		ConvoMessage: msg,
+		Round:        r.Round,
+		Peer:         c.peerName,
+	})
+}
 
-	switch m := msg.Body.(type) {
-	case *TextMessage:
-		s := strings.TrimRight(string(m.Message), "\x00")
-		c.gui.Printf("<%s> %s\n", c.peerName, s)
-	case *TimestampMessage:
-		latency := time.Now().Sub(m.Timestamp)
-		c.Lock()
-		c.lastLatency = latency
-		c.Unlock()
+// HandleConvoError gives up on a round the entry server couldn't run.
+func (c *Conversation) HandleConvoError(e *ConvoError) {
+	c.Lock()
+	pr, ok := c.pendingRounds[e.Round]
+	delete(c.pendingRounds, e.Round)
+	c.Unlock()
+
+	if ok && pr.texts != nil {
+		c.requeue(pr.texts)
+		c.gui.SaveState()
+	}
+	if e.RetryAfter > 0 {
+		c.gui.Warnf("Entry server is overloaded, retrying in %d rounds\n", e.RetryAfter)
+	} else {
+		log.WithFields(log.Fields{"round": e.Round}).Error(e.Err)
 	}
 }
 
 type Status struct {
 	PeerResponding bool
 	Round          uint32
-	Latency        float64
+	StartsIn       uint32
+
+	// Latency is the estimated one-way latency in seconds, or zero
+	// before the first round trip.
+	Latency float64
+	RTT     RTTStats
 }
 
 func (c *Conversation) Status() *Status {
@@ -206,12 +319,28 @@ func (c *Conversation) Status() *Status {
 	status := &Status{
 		PeerResponding: c.lastPeerResponding,
 		Round:          c.lastRound,
-		Latency:        float64(c.lastLatency) / float64(time.Second),
+		Latency:        c.rtt.OneWay().Seconds(),
+		RTT:            c.rtt,
+	}
+	if c.schedule != nil {
+		status.StartsIn = c.schedule.StartsIn(c.lastRound)
 	}
 	c.RUnlock()
 	return status
 }
 
+func (c *Conversation) getSchedule() *Schedule {
+	c.RLock()
+	defer c.RUnlock()
+	return c.schedule
+}
+
+func (c *Conversation) setSchedule(s *Schedule) {
+	c.Lock()
+	c.schedule = s
+	c.Unlock()
+}
+
 func (c *Conversation) Solo() bool {
 	return bytes.Compare(c.myPublicKey[:], c.peerPublicKey[:]) == 0
 }
@@ -219,49 +348,26 @@ func (c *Conversation) Solo() bool {
 // Roles ensure that messages to the peer and messages from
 // the peer have distinct nonces.
 func (c *Conversation) myRole() byte {
-	if bytes.Compare(c.myPublicKey[:], c.peerPublicKey[:]) < 0 {
-		return 0
-	} else {
-		return 1
-	}
+	return ConvoRole(c.myPublicKey, c.peerPublicKey)
 }
 
 func (c *Conversation) theirRole() byte {
-	if bytes.Compare(c.peerPublicKey[:], c.myPublicKey[:]) < 0 {
-		return 0
-	} else {
-		return 1
-	}
+	return ConvoRole(c.peerPublicKey, c.myPublicKey)
 }
 
 func (c *Conversation) Seal(message []byte, round uint32, role byte) []byte {
-	var nonce [24]byte
-	binary.BigEndian.PutUint32(nonce[:], round)
-	nonce[23] = role
-
-	ctxt := box.Seal(nil, message, &nonce, c.peerPublicKey.Key(), c.myPrivateKey.Key())
+	ctxt := box.Seal(nil, message, ConvoNonce(round, role), c.peerPublicKey.Key(), c.myPrivateKey.Key())
 	return ctxt
 }
 
 func (c *Conversation) Open(ctxt []byte, round uint32, role byte) ([]byte, bool) {
-	var nonce [24]byte
-	binary.BigEndian.PutUint32(nonce[:], round)
-	nonce[23] = role
-
-	return box.Open(nil, ctxt, &nonce, c.peerPublicKey.Key(), c.myPrivateKey.Key())
+	return box.Open(nil, ctxt, ConvoNonce(round, role), c.peerPublicKey.Key(), c.myPrivateKey.Key())
 }
 
 func (c *Conversation) deadDrop(round uint32) (id DeadDrop) {
 	if c.Solo() {
 		rand.Read(id[:])
-	} else {
-		var sharedKey [32]byte
-		box.Precompute(&sharedKey, c.peerPublicKey.Key(), c.myPrivateKey.Key())
-
-		h := hmac.New(sha256.New, sharedKey[:])
-		binary.Write(h, binary.BigEndian, round)
-		r := h.Sum(nil)
-		copy(id[:], r)
+		return
 	}
-	return
+	return ConvoDeadDrop(c.myPrivateKey, c.peerPublicKey, round)
 }
@@ -3,10 +3,13 @@ package main
 import (
 	"bytes"
 	"crypto/rand"
+	"fmt"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	. "github.com/davidlazar/vuvuzela"
+	"github.com/davidlazar/vuvuzela/onionbox"
 )
 
 func TestSoloConversation(t *testing.T) {
@@ -54,3 +57,396 @@ func TestMarshalConvoMessage(t *testing.T) {
 		t.Fatalf("timestamps don't match")
 	}
 }
+
+type testPingMessage struct {
+	N byte
+}
+
+func TestMessageRegistry(t *testing.T) {
+	RegisterMessageType(&MessageType{
+		ID:       200,
+		Name:     "test ping",
+		Body:     (*testPingMessage)(nil),
+		Version:  3,
+		Critical: true,
+		Marshal: func(body interface{}, data []byte) {
+			data[0] = body.(*testPingMessage).N
+		},
+		Unmarshal: func(version byte, data []byte) (interface{}, error) {
+			if version != 3 {
+				return nil, fmt.Errorf("unexpected version %d", version)
+			}
+			return &testPingMessage{N: data[0]}, nil
+		},
+	})
+
+	data := (&ConvoMessage{Body: &testPingMessage{N: 7}}).Marshal()
+	if data[0] != 200 || data[1] != FlagCritical|3 {
+		t.Fatalf("unexpected header: %x", data[:2])
+	}
+	cm := new(ConvoMessage)
+	if err := cm.Unmarshal(data[:]); err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := cm.Body.(*testPingMessage); !ok || m.N != 7 {
+		t.Fatalf("unexpected body: %#v", cm.Body)
+	}
+
+	// Text keeps its original layout so older clients can read it.
+	text := (&ConvoMessage{Body: &TextMessage{Message: []byte("hi")}}).Marshal()
+	if text[0] != 1 || string(text[1:3]) != "hi" {
+		t.Fatalf("text layout changed: %x", text[:4])
+	}
+
+	var unknown [SizeMessage]byte
+	unknown[0] = 201
+	unknown[1] = FlagCritical
+	unknown[2] = 0xab
+	if err := cm.Unmarshal(unknown[:]); err != nil {
+		t.Fatalf("unknown types should decode: %s", err)
+	}
+	if m, ok := cm.Body.(*UnknownMessage); !ok || m.Data[0] != 0xab || cm.Flags != FlagCritical {
+		t.Fatalf("unexpected unknown message: %#v", cm)
+	}
+}
+
+func TestMailboxDrop(t *testing.T) {
+	alicePublic, alicePrivate, _ := GenerateBoxKey(rand.Reader)
+	bobPublic, bobPrivate, _ := GenerateBoxKey(rand.Reader)
+
+	aliceRole := ConvoRole(alicePublic, bobPublic)
+	if MailboxDeadDrop(alicePrivate, bobPublic, aliceRole, 3) != MailboxDeadDrop(bobPrivate, alicePublic, aliceRole, 3) {
+		t.Fatalf("sender and recipient disagree on the mailbox")
+	}
+	if MailboxDeadDrop(alicePrivate, bobPublic, aliceRole, 3) == MailboxDeadDrop(alicePrivate, bobPublic, 1-aliceRole, 3) {
+		t.Fatalf("expecting distinct mailboxes for each direction")
+	}
+
+	msg := make([]byte, SizeMessage)
+	rand.Read(msg[:SizeMailboxMessage])
+	ctxt, err := sealMail(msg, bobPublic, alicePrivate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ctxt) != SizeEncryptedMessage {
+		t.Fatalf("expecting mail to fill a message slot, got %d bytes", len(ctxt))
+	}
+	xmsg, ok := openMail(ctxt, alicePublic, bobPrivate)
+	if !ok || !bytes.Equal(xmsg, msg[:SizeMailboxMessage]) {
+		t.Fatalf("failed to open mail")
+	}
+
+	msg[SizeMailboxMessage] = 1
+	if _, err := sealMail(msg, bobPublic, alicePrivate); err == nil {
+		t.Fatalf("expecting a message that doesn't fit to be rejected")
+	}
+}
+
+func TestSplitText(t *testing.T) {
+	long := bytes.Repeat([]byte("ab\u00e9"), 200)
+	parts := splitText(long)
+	if len(parts) < 2 {
+		t.Fatalf("expecting a long text to be split, got %d parts", len(parts))
+	}
+	for i, p := range parts {
+		if len(p) > maxTextSize || !utf8.Valid(p) {
+			t.Fatalf("part %d: %d bytes, valid UTF-8: %v", i, len(p), utf8.Valid(p))
+		}
+	}
+	if !bytes.Equal(bytes.Join(parts, nil), long) {
+		t.Fatalf("parts don't add up to the text")
+	}
+
+	// Every part survives a mailbox deposit.
+	convo := new(Conversation)
+	convo.Init()
+	convo.outQueue = parts
+	for len(convo.outQueue) > 0 {
+		texts, body := convo.nextText(SizeMailboxMessage)
+		data := (&ConvoMessage{Body: body}).Marshal()
+		if len(bytes.TrimRight(data[:], "\x00")) > SizeMailboxMessage {
+			t.Fatalf("%d texts don't fit in a mailbox slot", len(texts))
+		}
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	alicePublic, alicePrivate, _ := GenerateBoxKey(rand.Reader)
+	bobPublic, bobPrivate, _ := GenerateBoxKey(rand.Reader)
+
+	alice := &Dialer{myPrivateKey: alicePrivate}
+	alice.Init()
+	bob := &Dialer{myPrivateKey: bobPrivate}
+	bob.Init()
+
+	intro := &Introduction{Rendezvous: 1000, LongTermKey: *alicePublic, ScheduleDelay: 50}
+	alice.rendezvous[*bobPublic] = intro
+	bob.rendezvous[*alicePublic] = intro
+
+	sa := alice.Schedule(bobPublic)
+	sb := bob.Schedule(alicePublic)
+	if sa.start != sb.start || sa.start < 1000 || sa.start > 1050 {
+		t.Fatalf("bad start: alice=%d bob=%d", sa.start, sb.start)
+	}
+	if sa.StartsIn(1000) != sa.start-1000 || sa.StartsIn(sa.start) != 0 {
+		t.Fatalf("bad StartsIn")
+	}
+
+	for round := uint32(990); round < 1100; round++ {
+		a := sa.Active(round)
+		if a != sb.Active(round) {
+			t.Fatalf("round %d: schedules disagree", round)
+		}
+		if round < sa.start && a {
+			t.Fatalf("round %d: active before start %d", round, sa.start)
+		}
+		if round >= sa.start+ScheduleRamp && !a {
+			t.Fatalf("round %d: inactive after ramp", round)
+		}
+	}
+
+	if bob.Schedule(bobPublic) != nil {
+		t.Fatalf("expecting no schedule without a dial")
+	}
+
+	var key [32]byte
+	s := NewSchedule(&key, ^uint32(0)-1, ^uint32(0))
+	if s.start < ^uint32(0)-1 {
+		t.Fatalf("start wrapped around: %d", s.start)
+	}
+	bad := &Introduction{ScheduleDelay: ^uint32(0)}
+	if err := new(Introduction).Unmarshal(bad.Marshal()); err == nil {
+		t.Fatalf("expecting an error for a huge schedule delay")
+	}
+}
+
+func TestRendezvousInConvoRounds(t *testing.T) {
+	alicePublic, alicePrivate, _ := GenerateBoxKey(rand.Reader)
+	bobPublic, bobPrivate, _ := GenerateBoxKey(rand.Reader)
+	serverPublic, _, _ := GenerateBoxKey(rand.Reader)
+	pki := &PKI{
+		Servers:     map[string]*ServerInfo{"a": {PublicKey: serverPublic}},
+		ServerOrder: []string{"a"},
+	}
+
+	// Convo rounds run far ahead of dial rounds.
+	const dialRound, convoRound = 100, 5000
+	alice := &Dialer{
+		gui:           new(GuiClient),
+		pki:           pki,
+		myPublicKey:   alicePublic,
+		myPrivateKey:  alicePrivate,
+		ScheduleDelay: 20,
+		ConvoRound:    func() uint32 { return convoRound },
+	}
+	alice.Init()
+	bob := &Dialer{
+		gui:          new(GuiClient),
+		contacts:     NewContactBook(map[string]*BoxKey{"alice": alicePublic}),
+		myPublicKey:  bobPublic,
+		myPrivateKey: bobPrivate,
+		ConvoRound:   func() uint32 { return convoRound + 1 },
+	}
+	bob.Init()
+
+	alice.QueueRequest(bobPublic, "")
+	alice.NextDialRequest(dialRound, 1)
+	intro := alice.rendezvous[*bobPublic]
+	if intro.Rendezvous != convoRound+rendezvousOffset {
+		t.Fatalf("rendezvous %d is not in convo rounds", intro.Rendezvous)
+	}
+
+	bucket := func(intro *Introduction) *DialBucket {
+		ctxt, _ := onionbox.Seal(intro.Marshal(), ForwardNonce(dialRound), BoxKeys{bobPublic}.Keys())
+		var encintro [SizeEncryptedIntro]byte
+		copy(encintro[:], ctxt)
+		return &DialBucket{Round: dialRound, Intros: [][SizeEncryptedIntro]byte{encintro}}
+	}
+	far := *intro
+	far.Rendezvous = convoRound + 10*rendezvousOffset
+	bob.HandleDialBucket(bucket(&far))
+	if len(bob.inbox.Pending()) != 0 {
+		t.Fatalf("expecting a rendezvous far ahead to be dropped")
+	}
+	bob.handledRounds = make(map[uint32]bool)
+	bob.HandleDialBucket(bucket(intro))
+	reqs := bob.inbox.Pending()
+	if len(reqs) != 1 {
+		t.Fatalf("expecting one dial request, got %d", len(reqs))
+	}
+	bob.accept(reqs[0].Intro)
+
+	sa, sb := alice.Schedule(bobPublic), bob.Schedule(alicePublic)
+	if sa.start != sb.start || sa.start < convoRound+rendezvousOffset {
+		t.Fatalf("bad start: alice=%d bob=%d", sa.start, sb.start)
+	}
+	if sa.Active(convoRound+1) || sa.StartsIn(convoRound+1) == 0 {
+		t.Fatalf("schedule started before the rendezvous")
+	}
+}
+
+func TestConvoErrorBackoff(t *testing.T) {
+	convo := &Conversation{gui: new(GuiClient)}
+	convo.Init()
+	convo.pendingRounds[5] = &pendingRound{texts: [][]byte{[]byte("hello")}}
+
+	client := NewClient("", nil)
+	client.roundHandlers[5] = convo
+	client.deliverConvoError(&ConvoError{Round: 5, Err: "server overloaded", RetryAfter: 2})
+
+	for round, want := range map[uint32]bool{6: true, 7: true, 8: false} {
+		if client.backingOff(round) != want {
+			t.Fatalf("round %d: expecting backingOff=%v", round, want)
+		}
+	}
+	if m := convo.dequeue(); string(m) != "hello" {
+		t.Fatalf("expecting message to be requeued, got %q", m)
+	}
+}
+
+func TestDialerRetainedBuckets(t *testing.T) {
+	alicePublic, _, _ := GenerateBoxKey(rand.Reader)
+	bobPublic, bobPrivate, _ := GenerateBoxKey(rand.Reader)
+
+	bob := &Dialer{
+		gui:          new(GuiClient),
+		contacts:     NewContactBook(map[string]*BoxKey{"alice": alicePublic}),
+		myPublicKey:  bobPublic,
+		myPrivateKey: bobPrivate,
+	}
+	bob.Init()
+	bob.inflightRequests[7] = &outgoingDial{key: alicePublic}
+
+	var round uint32 = 7
+	intro := &Introduction{Rendezvous: round + 4, LongTermKey: *alicePublic}
+	copy(intro.Note[:], "lunch?\x1b[2J")
+	ctxt, _ := onionbox.Seal(intro.Marshal(), ForwardNonce(round), BoxKeys{bobPublic}.Keys())
+	db := &DialBucket{Round: round, Retained: true}
+	var encintro [SizeEncryptedIntro]byte
+	copy(encintro[:], ctxt)
+	db.Intros = append(db.Intros, encintro)
+
+	bob.HandleDialBucket(db)
+	if bob.inflightRequests[7] == nil {
+		t.Fatalf("retained bucket should not complete our own dial")
+	}
+	reqs := bob.inbox.Pending()
+	if len(reqs) != 1 || reqs[0].Note() != "lunch?[2J" {
+		t.Fatalf("expecting a dial request with a sanitized note")
+	}
+	if bob.rendezvous[*alicePublic] != nil {
+		t.Fatalf("rendezvous recorded before the request was accepted")
+	}
+
+	db.Retained = false
+	bob.HandleDialBucket(db)
+	if reqs := bob.inbox.Pending(); reqs[0].Count != 1 {
+		t.Fatalf("expecting repeated round to be ignored")
+	}
+
+	bob.accept(reqs[0].Intro)
+	if bob.rendezvous[*alicePublic] != reqs[0].Intro {
+		t.Fatalf("expecting the accepted rendezvous")
+	}
+	// Anyone can claim to be alice; that mustn't move her schedule.
+	bob.accept(&Introduction{Rendezvous: 1 << 30, LongTermKey: *alicePublic})
+	if bob.rendezvous[*alicePublic] != reqs[0].Intro {
+		t.Fatalf("established rendezvous was replaced")
+	}
+}
+
+func TestEchoRTT(t *testing.T) {
+	alice, bob := new(Conversation), new(Conversation)
+	start := time.Now()
+	at := func(seconds int) time.Time {
+		return start.Add(time.Duration(seconds) * time.Second)
+	}
+
+	// Round 1: both send tokens, nothing to echo yet.
+	a1, b1 := alice.nextEcho(at(0)), bob.nextEcho(at(0))
+	if a1.Echo != 0 || b1.Echo != 0 {
+		t.Fatalf("unexpected echo in first message")
+	}
+	bob.handleEcho(a1, at(10))
+	alice.handleEcho(b1, at(10))
+
+	// Round 2: bob echoes alice's token after holding it 20s.
+	b2 := bob.nextEcho(at(30))
+	if b2.Echo != a1.Token || b2.Held != 20*time.Second {
+		t.Fatalf("bad echo: %+v", b2)
+	}
+	alice.handleEcho(b2, at(42))
+	if alice.rtt.Samples != 1 || alice.rtt.Last != 22*time.Second {
+		t.Fatalf("unexpected rtt: %+v", alice.rtt)
+	}
+	if alice.rtt.OneWay() != 11*time.Second {
+		t.Fatalf("unexpected one-way estimate: %s", alice.rtt.OneWay())
+	}
+
+	// A token is echoed once.
+	if b3 := bob.nextEcho(at(50)); b3.Echo != 0 {
+		t.Fatalf("token echoed twice")
+	}
+
+	// Echoes from the future (e.g. before a restart) are ignored.
+	alice.handleEcho(&EchoMessage{Token: 1, Echo: alice.echoToken(at(1000))}, at(60))
+	if alice.rtt.Samples != 1 {
+		t.Fatalf("accepted a bogus echo")
+	}
+	// So are tokens that alice didn't send.
+	alice.handleEcho(&EchoMessage{Token: 1, Echo: alice.echoOffset - 1}, at(60))
+	if alice.rtt.Samples != 1 {
+		t.Fatalf("accepted an echo that alice didn't send")
+	}
+
+	// Tokens don't reveal how long the client has been running, and
+	// differ between conversations.
+	if a1.Token == uint64(at(0).Sub(echoStart))+1 || a1.Token == b1.Token {
+		t.Fatalf("tokens aren't offset: %d, %d", a1.Token, b1.Token)
+	}
+}
+
+func TestPackedText(t *testing.T) {
+	convo := new(Conversation)
+	convo.Init()
+
+	convo.outQueue = [][]byte{[]byte("are you there?")}
+	texts, body := convo.nextText(SizeMessage)
+	if len(texts) != 1 {
+		t.Fatalf("expecting one message, got %d", len(texts))
+	}
+	if _, ok := body.(*TextMessage); !ok {
+		t.Fatalf("expecting a lone message to be plain text, got %T", body)
+	}
+
+	for i := 0; i < 20; i++ {
+		convo.outQueue = append(convo.outQueue, []byte(fmt.Sprintf("ok, sounds good %d", i)))
+	}
+	texts, body = convo.nextText(SizeMailboxMessage)
+	if len(texts) < 5 {
+		t.Fatalf("expecting several messages per slot, got %d", len(texts))
+	}
+	data := (&ConvoMessage{Body: body}).Marshal()
+	cm := new(ConvoMessage)
+	if err := cm.Unmarshal(data[:SizeMailboxMessage]); err != nil {
+		t.Fatal(err)
+	}
+	msgs := cm.Body.(*PackedTextMessage).Messages
+	if len(msgs) != len(texts) {
+		t.Fatalf("expecting %d messages, got %d", len(texts), len(msgs))
+	}
+	for i := range msgs {
+		if !bytes.Equal(msgs[i], texts[i]) {
+			t.Fatalf("message %d: got %q, want %q", i, msgs[i], texts[i])
+		}
+	}
+	if len(convo.outQueue) != 20-len(texts) {
+		t.Fatalf("unexpected queue length %d", len(convo.outQueue))
+	}
+
+	// Compressed payloads can't expand without bound.
+	bomb := encodePacked([][]byte{make([]byte, maxUnpackedSize)})
+	if _, err := decodePacked(bomb); err == nil {
+		t.Fatalf("expecting oversized payload to be rejected")
+	}
+}
@@ -2,6 +2,9 @@ package main
 
 import (
 	"crypto/rand"
+	"fmt"
+	"sync"
+	"time"
 
 	"golang.org/x/crypto/nacl/box"
 
@@ -10,36 +13,117 @@ import (
 )
 
 type Dialer struct {
+	sync.Mutex
+
 	gui          *GuiClient
 	pki          *PKI
+	contacts     *ContactBook
+	inbox        *Inbox
 	myPublicKey  *BoxKey
 	myPrivateKey *BoxKey
 
-	userDialRequests chan *BoxKey
+	// ScheduleDelay is the delayed start we propose when dialing.
+	ScheduleDelay uint32
+
+	// ConvoRound returns the next convo round. A rendezvous is a convo
+	// round, since that's what conversation schedules count, and convo
+	// rounds don't keep pace with dial rounds.
+	ConvoRound func() uint32
+
+	userDialRequests []*outgoingDial
+	// dial requests sent in rounds that haven't completed yet
+	inflightRequests map[uint32]*outgoingDial
+
+	rendezvous map[BoxKey]*Introduction
+
+	// rounds whose bucket we've already seen, live or retained
+	handledRounds map[uint32]bool
 }
 
 func (d *Dialer) Init() {
-	d.userDialRequests = make(chan *BoxKey, 4)
+	d.userDialRequests = nil
+	d.inflightRequests = make(map[uint32]*outgoingDial)
+	d.rendezvous = make(map[BoxKey]*Introduction)
+	d.handledRounds = make(map[uint32]bool)
+	if d.inbox == nil {
+		d.inbox = NewInbox(nil, d.contacts)
+	}
+}
+
+// Schedule returns the conversation schedule agreed on in the most recent
+// dial to or from peer, or nil if there hasn't been one.
+func (d *Dialer) Schedule(peer *BoxKey) *Schedule {
+	d.Lock()
+	intro, ok := d.rendezvous[*peer]
+	d.Unlock()
+	if !ok {
+		return nil
+	}
+
+	var sharedKey [32]byte
+	box.Precompute(&sharedKey, peer.Key(), d.myPrivateKey.Key())
+	return NewSchedule(&sharedKey, intro.Rendezvous, intro.ScheduleDelay)
+}
+
+// A dial's conversation starts this many convo rounds after the dial is
+// sent, leaving time for the dial round to finish.
+const rendezvousOffset = 32
+
+func (d *Dialer) convoRound() uint32 {
+	if d.ConvoRound == nil {
+		return 0
+	}
+	return d.ConvoRound()
+}
+
+type outgoingDial struct {
+	key  *BoxKey
+	note string
+}
+
+// QueueRequest dials publicKey, sending note along with the introduction.
+func (d *Dialer) QueueRequest(publicKey *BoxKey, note string) error {
+	if len(note) > SizeIntroNote {
+		return fmt.Errorf("note is too long (%d bytes, max %d)", len(note), SizeIntroNote)
+	}
+	d.Lock()
+	d.userDialRequests = append(d.userDialRequests, &outgoingDial{publicKey, note})
+	d.Unlock()
+	d.gui.SaveState()
+	return nil
 }
 
-func (d *Dialer) QueueRequest(publicKey *BoxKey) {
-	d.userDialRequests <- publicKey
+func (d *Dialer) nextRequest(round uint32) *outgoingDial {
+	d.Lock()
+	defer d.Unlock()
+	if len(d.userDialRequests) == 0 {
+		return nil
+	}
+	req := d.userDialRequests[0]
+	d.userDialRequests = d.userDialRequests[1:]
+	d.inflightRequests[round] = req
+	return req
 }
 
 func (d *Dialer) NextDialRequest(round uint32, buckets uint32) *DialRequest {
 	var ex *DialExchange
-	select {
-	case pk := <-d.userDialRequests:
-		intro := (&Introduction{
-			Rendezvous:  round + 4,
-			LongTermKey: *d.myPublicKey,
-		}).Marshal()
-		ctxt, _ := onionbox.Seal(intro, ForwardNonce(round), BoxKeys{pk}.Keys())
+	if req := d.nextRequest(round); req != nil {
+		pk := req.key
+		intro := &Introduction{
+			Rendezvous:    d.convoRound() + rendezvousOffset,
+			LongTermKey:   *d.myPublicKey,
+			ScheduleDelay: d.ScheduleDelay,
+		}
+		copy(intro.Note[:], req.note)
+		d.Lock()
+		d.rendezvous[*pk] = intro
+		d.Unlock()
+		ctxt, _ := onionbox.Seal(intro.Marshal(), ForwardNonce(round), BoxKeys{pk}.Keys())
 		ex = &DialExchange{
 			Bucket: KeyDialBucket(pk, buckets),
 		}
 		copy(ex.EncryptedIntro[:], ctxt)
-	default:
+	} else {
 		ex = &DialExchange{
 			Bucket: ^uint32(0),
 		}
@@ -55,9 +139,30 @@ func (d *Dialer) NextDialRequest(round uint32, buckets uint32) *DialRequest {
 }
 
 func (d *Dialer) HandleDialBucket(db *DialBucket) {
+	d.Lock()
+	if d.handledRounds[db.Round] {
+		d.Unlock()
+		return
+	}
+	d.handledRounds[db.Round] = true
+	for r := range d.handledRounds {
+		if r+2*DialHistoryRounds < db.Round {
+			delete(d.handledRounds, r)
+		}
+	}
+	// A retained bucket doesn't mean our request made it into the round.
+	var sent bool
+	if !db.Retained {
+		_, sent = d.inflightRequests[db.Round]
+		delete(d.inflightRequests, db.Round)
+	}
+	d.Unlock()
+	if sent {
+		d.gui.SaveState()
+	}
+
 	nonce := ForwardNonce(db.Round)
 
-OUTER:
 	for _, b := range db.Intros {
 		var pk [32]byte
 		copy(pk[:], b[0:32])
@@ -70,13 +175,43 @@ OUTER:
 		if err := intro.Unmarshal(data); err != nil {
 			continue
 		}
+		// A rendezvous that has passed just means the conversation
+		// starts right away; one far ahead would hold it off.
+		if now := d.convoRound(); now != 0 && intro.Rendezvous > now+2*rendezvousOffset {
+			continue
+		}
+		// The sender's LongTermKey isn't authenticated, so the rendezvous
+		// isn't used until the user accepts the request.
+		req, isNew := d.inbox.Receive(intro, time.Now())
+		if req == nil {
+			continue
+		}
 
-		for name, key := range d.pki.People {
-			if *key == intro.LongTermKey {
-				d.gui.Warnf("Received introduction: %s\n", name)
-				continue OUTER
+		if isNew {
+			if note := req.Note(); note != "" {
+				d.gui.Warnf("Dial request #%d from %s: %q (see /requests)\n", req.ID, req, note)
+			} else {
+				d.gui.Warnf("Dial request #%d from %s (see /requests)\n", req.ID, req)
 			}
+			d.gui.hooks.Emit(&HookEvent{Event: "intro", Peer: req.String(), Note: req.Note(), Round: db.Round})
 		}
-		d.gui.Warnf("Received introduction: (%s)\n", &intro.LongTermKey)
 	}
 }
+
+// accept uses the rendezvous from an accepted dial request, unless we
+// already have one with the sender: a conversation that is under way
+// keeps its schedule.
+func (d *Dialer) accept(intro *Introduction) {
+	d.Lock()
+	defer d.Unlock()
+	if _, ok := d.rendezvous[intro.LongTermKey]; !ok {
+		d.rendezvous[intro.LongTermKey] = intro
+	}
+}
+
+// forget drops the rendezvous with a blocked sender.
+func (d *Dialer) forget(key *BoxKey) {
+	d.Lock()
+	delete(d.rendezvous, *key)
+	d.Unlock()
+}
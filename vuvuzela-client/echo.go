@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// An EchoMessage is sent when there is no text to send. It carries a
+// token from our own clock, and echoes the last token we got from the
+// peer along with how long we held it. Only the sender ever interprets
+// its tokens, so the peers' clocks don't need to agree.
+type EchoMessage struct {
+	Token uint64
+	Echo  uint64 // zero if there's nothing to echo
+	Held  time.Duration
+}
+
+const sizeEchoMessage = 24
+
+// Samples above this are assumed to be from a token that predates a
+// restart.
+const maxRTT = 10 * time.Minute
+
+// echoStart anchors echo tokens to the monotonic clock.
+var echoStart = time.Now()
+
+// Each conversation adds its own random offset to its tokens, so the
+// peer can't tell how long the client has been running or link the
+// tokens of its conversations.
+func (c *Conversation) echoToken(t time.Time) uint64 {
+	if c.echoOffset == 0 {
+		var b [8]byte
+		rand.Read(b[:])
+		// Less than 2^63 and never zero, so a token is never zero.
+		c.echoOffset = binary.BigEndian.Uint64(b[:])>>1 + 1
+	}
+	return uint64(t.Sub(echoStart)) + c.echoOffset
+}
+
+// echoTime returns when we sent token, or false if we didn't send it
+// by t.
+func (c *Conversation) echoTime(token uint64, t time.Time) (time.Time, bool) {
+	elapsed := token - c.echoToken(echoStart)
+	if elapsed > uint64(t.Sub(echoStart)) {
+		return time.Time{}, false
+	}
+	return echoStart.Add(time.Duration(elapsed)), true
+}
+
+// RTTStats summarizes the round trips measured in a conversation. A round
+// trip is the time from sending a token to getting it back, minus the
+// time the peer held it, so it spans one trip through the mixnet in each
+// direction.
+type RTTStats struct {
+	Samples int
+	Last    time.Duration
+	Min     time.Duration
+	Max     time.Duration
+
+	// Smoothed and Jitter are the RFC 6298 SRTT and RTTVAR.
+	Smoothed time.Duration
+	Jitter   time.Duration
+}
+
+func (s *RTTStats) add(rtt time.Duration) {
+	s.Samples++
+	s.Last = rtt
+	if s.Samples == 1 {
+		s.Min, s.Max = rtt, rtt
+		s.Smoothed = rtt
+		s.Jitter = rtt / 2
+		return
+	}
+	if rtt < s.Min {
+		s.Min = rtt
+	}
+	if rtt > s.Max {
+		s.Max = rtt
+	}
+	diff := s.Smoothed - rtt
+	if diff < 0 {
+		diff = -diff
+	}
+	s.Jitter = (3*s.Jitter + diff) / 4
+	s.Smoothed = (7*s.Smoothed + rtt) / 8
+}
+
+// OneWay estimates the latency of a message through the mixnet.
+func (s *RTTStats) OneWay() time.Duration {
+	return s.Smoothed / 2
+}
+
+// nextEcho returns the message to send when there is no text.
+func (c *Conversation) nextEcho(now time.Time) *EchoMessage {
+	c.Lock()
+	defer c.Unlock()
+	m := &EchoMessage{Token: c.echoToken(now)}
+	if c.peerToken != 0 {
+		m.Echo = c.peerToken
+		m.Held = now.Sub(c.peerTokenAt)
+		c.peerToken = 0
+	}
+	return m
+}
+
+func (c *Conversation) handleEcho(m *EchoMessage, now time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	c.peerToken = m.Token
+	c.peerTokenAt = now
+
+	if m.Echo == 0 {
+		return
+	}
+	sent, ok := c.echoTime(m.Echo, now)
+	if !ok {
+		return
+	}
+	rtt := now.Sub(sent) - m.Held
+	if rtt <= 0 || rtt > maxRTT {
+		return
+	}
+	c.rtt.add(rtt)
+}
+
+func init() {
+	RegisterMessageType(&MessageType{
+		ID:   2,
+		Name: "echo",
+		Body: (*EchoMessage)(nil),
+		Marshal: func(body interface{}, data []byte) {
+			m := body.(*EchoMessage)
+			binary.BigEndian.PutUint64(data[0:8], m.Token)
+			binary.BigEndian.PutUint64(data[8:16], m.Echo)
+			binary.BigEndian.PutUint64(data[16:24], uint64(m.Held))
+		},
+		Unmarshal: func(_ byte, data []byte) (interface{}, error) {
+			if len(data) < sizeEchoMessage {
+				return nil, fmt.Errorf("short message")
+			}
+			return &EchoMessage{
+				Token: binary.BigEndian.Uint64(data[0:8]),
+				Echo:  binary.BigEndian.Uint64(data[8:16]),
+				Held:  time.Duration(binary.BigEndian.Uint64(data[16:24])),
+			}, nil
+		},
+		Handle: func(c *Conversation, in *IncomingMessage) {
+			if !in.Mailbox {
+				c.handleEcho(in.Body.(*EchoMessage), time.Now())
+			}
+		},
+	})
+}
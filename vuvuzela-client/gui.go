@@ -3,8 +3,11 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
+	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/jroimartin/gocui"
@@ -18,6 +21,9 @@ type GuiClient struct {
 	sync.Mutex
 
 	pki          *PKI
+	contacts     *ContactBook
+	inbox        *Inbox
+	introPolicy  *IntroPolicy
 	myName       string
 	myPublicKey  *BoxKey
 	myPrivateKey *BoxKey
@@ -25,125 +31,205 @@ type GuiClient struct {
 	gui    *gocui.Gui
 	client *Client
 
+	store    *Store
+	saveMu   sync.Mutex
+	presence *Presence
+	hooks    *Hooks
+
+	// rounds restored from the state, until there is a client
+	savedRounds [2]uint32
+	roundsMu    sync.Mutex
+	mailbox     bool
+
+	delayedStart uint32
+	proxy        string
+	transport    string
+
 	selectedConvo *Conversation
 	conversations map[string]*Conversation
 	dialer        *Dialer
+
+	// bufMu guards the scrollback shown by the terminal UI.
+	bufMu       sync.Mutex
+	buffers     map[string]*buffer
+	shownBuffer string
+	logBuffer   buffer
+	pageSize    int
 }
 
-func (gc *GuiClient) switchConversation(peer string) {
-	var convo *Conversation
+func (gc *GuiClient) conversation(peer string) *Conversation {
+	gc.Lock()
+	defer gc.Unlock()
 
 	convo, ok := gc.conversations[peer]
 	if !ok {
-		peerPublicKey, ok := gc.pki.People[peer]
+		peerPublicKey, ok := gc.contacts.Lookup(peer)
 		if !ok {
-			gc.Warnf("unknown user: %s", peer)
-			return
+			return nil
 		}
 		convo = &Conversation{
 			pki:           gc.pki,
+			contacts:      gc.contacts,
 			peerName:      peer,
 			peerPublicKey: peerPublicKey,
 			myPublicKey:   gc.myPublicKey,
 			myPrivateKey:  gc.myPrivateKey,
 			gui:           gc,
+			mailbox:       gc.mailbox,
 		}
 		convo.Init()
 		gc.conversations[peer] = convo
 	}
+	return convo
+}
 
+func (gc *GuiClient) switchConversation(peer string) {
+	convo := gc.conversation(peer)
+	if convo == nil {
+		gc.Warnf("unknown user: %s", peer)
+		return
+	}
+
+	if s := gc.dialer.Schedule(convo.peerPublicKey); s != nil && !convo.Solo() {
+		convo.setSchedule(s)
+	}
+
+	gc.Lock()
 	gc.selectedConvo = convo
+	gc.Unlock()
+	gc.showBuffer(peer)
 	gc.activateConvo(convo)
 	gc.Warnf("Now talking to %s\n", peer)
+	gc.SaveState()
 }
 
 func (gc *GuiClient) activateConvo(convo *Conversation) {
 	if gc.client != nil {
 		convo.Lock()
 		convo.lastPeerResponding = false
-		convo.lastLatency = 0
+		convo.rtt = RTTStats{}
+		convo.peerToken = 0
 		convo.Unlock()
 		gc.client.SetConvoHandler(convo)
 	}
 }
 
-func (gc *GuiClient) handleLine(line string) error {
-	switch {
-	case line == "/quit":
-		return gocui.Quit
-	case strings.HasPrefix(line, "/talk "):
-		peer := line[6:]
-		gc.switchConversation(peer)
-	case strings.HasPrefix(line, "/dial "):
-		peer := line[6:]
-		pk, ok := gc.pki.People[peer]
-		if !ok {
-			gc.Warnf("Unknown user: %q (see %s)\n", peer, *pkiPath)
-			return nil
-		}
-		gc.Warnf("Dialing user: %s\n", peer)
-		gc.dialer.QueueRequest(pk)
-	default:
-		msg := strings.TrimSpace(line)
-		gc.selectedConvo.QueueTextMessage([]byte(msg))
-		gc.Printf("<%s> %s\n", gc.myName, msg)
+func (gc *GuiClient) dial(args string) {
+	fields := strings.SplitN(args, " ", 2)
+	peer, note := fields[0], ""
+	if len(fields) == 2 {
+		note = strings.TrimSpace(fields[1])
 	}
-	return nil
-}
-
-func (gc *GuiClient) readLine(_ *gocui.Gui, v *gocui.View) error {
-	// HACK: pressing enter on startup causes panic
-	if len(v.Buffer()) == 0 {
-		return nil
+	if peer == "" {
+		gc.Warnf("usage: /dial <user> [note]\n")
+		return
 	}
-	_, cy := v.Cursor()
-	line, err := v.Line(cy - 1)
-	if err != nil {
-		return err
+	pk, ok := gc.contacts.Lookup(peer)
+	if !ok {
+		gc.Warnf("Unknown user: %q (see %s or /import)\n", peer, *pkiPath)
+		return
 	}
-	if line == "" {
-		return nil
+	if err := gc.dialer.QueueRequest(pk, note); err != nil {
+		gc.Warnf("Can't dial %s: %s\n", peer, err)
+		return
 	}
-	v.Clear()
+	gc.Warnf("Dialing user: %s\n", peer)
+}
 
+func (gc *GuiClient) readLine(_ *gocui.Gui, v *gocui.View) error {
+	// Enter may have split the line at the cursor; join it back up.
+	line := strings.Replace(v.Buffer(), "\n", "", -1)
+	v.Clear()
+	v.SetCursor(0, 0)
+	v.SetOrigin(0, 0)
 	return gc.handleLine(line)
 }
 
 func (gc *GuiClient) Flush() {
+	if gc.gui == nil {
+		return
+	}
 	gc.gui.Flush()
 }
 
+// Warnf and Printf write to the conversation on screen. Without a gui
+// (daemon mode), output goes to the log instead.
 func (gc *GuiClient) Warnf(format string, v ...interface{}) {
-	mv, err := gc.gui.View("main")
-	if err != nil {
+	if gc.gui == nil {
+		log.Warn(strings.TrimSpace(fmt.Sprintf(format, v...)))
 		return
 	}
-	fmt.Fprintf(mv, "-!- "+format, v...)
-	gc.gui.Flush()
+	gc.Printf("-!- "+format, v...)
 }
 
 func (gc *GuiClient) Printf(format string, v ...interface{}) {
-	mv, err := gc.gui.View("main")
-	if err != nil {
+	if gc.gui == nil {
+		log.Info(strings.TrimSpace(fmt.Sprintf(format, v...)))
 		return
 	}
-	fmt.Fprintf(mv, format, v...)
-	gc.gui.Flush()
+	gc.bufMu.Lock()
+	peer := gc.shownBuffer
+	gc.bufMu.Unlock()
+	gc.PeerPrintf(peer, format, v...)
 }
 
+// PeerWarnf is Warnf for a notice about one conversation.
+func (gc *GuiClient) PeerWarnf(peer string, format string, v ...interface{}) {
+	if gc.gui == nil {
+		log.WithFields(log.Fields{"peer": peer}).Warn(strings.TrimSpace(fmt.Sprintf(format, v...)))
+		return
+	}
+	gc.PeerPrintf(peer, "-!- "+format, v...)
+}
+
+const (
+	listWidth = 20
+	logHeight = 6
+
+	unreadMarker = "---- unread ----"
+)
+
+// The screen has the conversation list on the left, the conversation on
+// screen to its right, the log pane under both, and the status bar and
+// input line at the bottom.
 func (gc *GuiClient) layout(g *gocui.Gui) error {
 	maxX, maxY := g.Size()
-	if v, err := g.SetView("main", 0, -1, maxX-1, maxY-1); err != nil {
+	mainBottom := maxY - 3 - logHeight
+
+	lv, err := g.SetView("convos", -1, -1, listWidth, mainBottom)
+	if err != nil {
 		if err != gocui.ErrorUnkView {
 			return err
 		}
-		v.Autoscroll = true
-		v.Wrap = true
-		v.Frame = false
+		lv.Wrap = false
+		lv.Frame = true
+	}
+	gc.drawList(lv)
+
+	mv, err := g.SetView("main", listWidth, -1, maxX, mainBottom)
+	if err != nil {
+		if err != gocui.ErrorUnkView {
+			return err
+		}
+		mv.Wrap = true
+		mv.Frame = true
 		log.AddHook(gc)
 		log.SetOutput(ioutil.Discard)
 		log.SetFormatter(&GuiFormatter{})
 	}
+	gc.drawMain(mv)
+
+	gv, err := g.SetView("log", -1, mainBottom, maxX, maxY-2)
+	if err != nil {
+		if err != gocui.ErrorUnkView {
+			return err
+		}
+		gv.Wrap = true
+		gv.Frame = false
+		gv.FgColor = gocui.ColorCyan
+	}
+	gc.drawLog(gv)
+
 	sv, err := g.SetView("status", -1, maxY-3, maxX, maxY-1)
 	if err != nil {
 		if err != gocui.ErrorUnkView {
@@ -158,7 +244,9 @@ func (gc *GuiClient) layout(g *gocui.Gui) error {
 
 	st := gc.selectedConvo.Status()
 	latency := fmt.Sprintf("%.1fs", st.Latency)
-	if st.Latency == 0.0 {
+	if st.RTT.Samples > 0 {
+		latency += fmt.Sprintf(" ±%.1fs", st.RTT.Jitter.Seconds()/2)
+	} else {
 		latency = "-"
 	}
 	round := fmt.Sprintf("%d", st.Round)
@@ -166,6 +254,14 @@ func (gc *GuiClient) layout(g *gocui.Gui) error {
 		round = "-"
 	}
 	fmt.Fprintf(sv, " [%s]  [round: %s]  [latency: %s]", gc.myName, round, latency)
+	if st.StartsIn > 0 {
+		fmt.Fprintf(sv, "  [starts in %d rounds]", st.StartsIn)
+	}
+	gc.bufMu.Lock()
+	if gc.buffer(gc.shownBuffer).scroll > 0 {
+		fmt.Fprintf(sv, "  [scrolled up, Ctrl-L for latest]")
+	}
+	gc.bufMu.Unlock()
 
 	partner := "(no partner)"
 	if !gc.selectedConvo.Solo() {
@@ -204,6 +300,95 @@ func (gc *GuiClient) layout(g *gocui.Gui) error {
 	return nil
 }
 
+func (gc *GuiClient) drawList(v *gocui.View) {
+	v.Clear()
+	width, _ := v.Size()
+	gc.bufMu.Lock()
+	shown := gc.shownBuffer
+	gc.bufMu.Unlock()
+	for _, e := range gc.bufferList() {
+		prefix := "  "
+		if e.name == shown {
+			prefix = "> "
+		}
+		line := prefix + e.name
+		if e.unread > 0 {
+			line += fmt.Sprintf(" (%d)", e.unread)
+		}
+		if width > 0 && len(line) > width {
+			line = line[:width]
+		}
+		fmt.Fprintln(v, line)
+	}
+}
+
+func (gc *GuiClient) drawMain(v *gocui.View) {
+	v.Clear()
+	width, height := v.Size()
+	gc.bufMu.Lock()
+	defer gc.bufMu.Unlock()
+	gc.pageSize = height - 1
+	if gc.pageSize < 1 {
+		gc.pageSize = 1
+	}
+	for _, line := range gc.buffer(gc.shownBuffer).visible(width, height, unreadMarker) {
+		fmt.Fprintln(v, line)
+	}
+}
+
+func (gc *GuiClient) drawLog(v *gocui.View) {
+	v.Clear()
+	width, height := v.Size()
+	gc.bufMu.Lock()
+	defer gc.bufMu.Unlock()
+	for _, line := range gc.logBuffer.visible(width, height, "") {
+		fmt.Fprintln(v, line)
+	}
+}
+
+func (gc *GuiClient) keyBindings() error {
+	bindings := []struct {
+		view string
+		key  interface{}
+		h    gocui.KeybindingHandler
+	}{
+		{"", gocui.KeyCtrlC, quit},
+		{"input", gocui.KeyEnter, gc.readLine},
+		{"", gocui.KeyPgup, func(*gocui.Gui, *gocui.View) error {
+			gc.scrollShown(1)
+			return nil
+		}},
+		{"", gocui.KeyPgdn, func(*gocui.Gui, *gocui.View) error {
+			gc.scrollShown(-1)
+			return nil
+		}},
+		{"", gocui.KeyCtrlL, func(*gocui.Gui, *gocui.View) error {
+			gc.bufMu.Lock()
+			gc.buffer(gc.shownBuffer).scroll = 0
+			gc.bufMu.Unlock()
+			return nil
+		}},
+		{"", gocui.KeyCtrlN, func(*gocui.Gui, *gocui.View) error {
+			gc.cycleConversation(1)
+			return nil
+		}},
+		{"", gocui.KeyCtrlP, func(*gocui.Gui, *gocui.View) error {
+			gc.cycleConversation(-1)
+			return nil
+		}},
+		{"", gocui.KeyF1, func(*gocui.Gui, *gocui.View) error {
+			gc.showHelp("")
+			return nil
+		}},
+	}
+	for _, b := range bindings {
+		if err := gc.gui.SetKeybinding(b.view, b.key, gocui.ModNone, b.h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func quit(g *gocui.Gui, v *gocui.View) error {
 	return gocui.Quit
 }
@@ -211,13 +396,80 @@ func quit(g *gocui.Gui, v *gocui.View) error {
 func (gc *GuiClient) Connect() error {
 	if gc.client == nil {
 		gc.client = NewClient(gc.pki.EntryServer, gc.myPublicKey)
+		gc.client.Proxy = gc.proxy
+		gc.client.Transport = gc.transport
+		gc.client.VerifyKey = gc.pki.FirstServerVerifyKey()
+		gc.client.Epoch = gc.pki.Epoch
+		gc.dialer.ConvoRound = func() uint32 {
+			convo, _ := gc.client.Rounds()
+			return convo
+		}
 		gc.client.SetDialHandler(gc.dialer)
+		gc.client.SetRounds(gc.savedRounds[0], gc.savedRounds[1])
+		gc.client.Advanced = gc.saveRounds
+		gc.client.Disconnected = func(err error) {
+			gc.hooks.Emit(&HookEvent{Event: "disconnect", Text: err.Error()})
+		}
 	}
 	gc.activateConvo(gc.selectedConvo)
 	return gc.client.Connect()
 }
 
+func (gc *GuiClient) Disconnect() {
+	if gc.client != nil {
+		gc.client.Close()
+	}
+}
+
+func (gc *GuiClient) Connected() bool {
+	return gc.client != nil && gc.client.Connected()
+}
+
+func (gc *GuiClient) Traffic() Traffic {
+	if gc.client == nil {
+		return Traffic{}
+	}
+	return gc.client.Traffic()
+}
+
+func (gc *GuiClient) init() {
+	gc.conversations = make(map[string]*Conversation)
+	gc.loadContacts()
+
+	gc.dialer = &Dialer{
+		gui:          gc,
+		pki:          gc.pki,
+		contacts:     gc.contacts,
+		inbox:        gc.inbox,
+		myPublicKey:  gc.myPublicKey,
+		myPrivateKey: gc.myPrivateKey,
+
+		ScheduleDelay: gc.delayedStart,
+	}
+	gc.dialer.Init()
+
+	gc.restoreState()
+}
+
+// RunDaemon keeps the client online according to its presence policy
+// without starting the terminal UI.
+func (gc *GuiClient) RunDaemon() {
+	gc.init()
+
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		gc.hooks.Close()
+		os.Exit(0)
+	}()
+	gc.presence.Run(gc, gc.Warnf)
+}
+
 func (gc *GuiClient) Run() {
+	// runs after the terminal is restored
+	defer gc.hooks.Close()
+
 	gui := gocui.NewGui()
 	if err := gui.Init(); err != nil {
 		log.Panicln(err)
@@ -225,10 +477,7 @@ func (gc *GuiClient) Run() {
 	defer gui.Close()
 	gc.gui = gui
 
-	if err := gui.SetKeybinding("", gocui.KeyCtrlC, gocui.ModNone, quit); err != nil {
-		log.Panicln(err)
-	}
-	if err := gui.SetKeybinding("input", gocui.KeyEnter, gocui.ModNone, gc.readLine); err != nil {
+	if err := gc.keyBindings(); err != nil {
 		log.Panicln(err)
 	}
 	gui.ShowCursor = true
@@ -236,16 +485,7 @@ func (gc *GuiClient) Run() {
 	gui.FgColor = gocui.ColorDefault
 	gui.SetLayout(gc.layout)
 
-	gc.conversations = make(map[string]*Conversation)
-	gc.switchConversation(gc.myName)
-
-	gc.dialer = &Dialer{
-		gui:          gc,
-		pki:          gc.pki,
-		myPublicKey:  gc.myPublicKey,
-		myPrivateKey: gc.myPrivateKey,
-	}
-	gc.dialer.Init()
+	gc.init()
 
 	go func() {
 		time.Sleep(500 * time.Millisecond)
@@ -267,7 +507,7 @@ func (gc *GuiClient) Fire(entry *log.Entry) error {
 		return err
 	}
 
-	gc.Warnf(line)
+	gc.logLine(line)
 	return nil
 }
 
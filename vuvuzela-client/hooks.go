@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// HookConf runs a command or writes to a named pipe when something
+// happens, for desktop notifications, logging, and the like.
+type HookConf struct {
+	// Events lists the events to hook (see hookEvents), or all of them
+	// if empty.
+	Events []string `json:",omitempty"`
+
+	// Command is run for each event with the event as JSON on stdin.
+	Command []string `json:",omitempty"`
+
+	// Pipe is a named pipe (or file) that each event is written to as a
+	// line of JSON. Events are dropped while nobody is reading the pipe.
+	Pipe string `json:",omitempty"`
+
+	// MaxPerMinute limits how often the hook runs (default 10). Events
+	// over the limit are dropped and counted in the next event's Dropped.
+	MaxPerMinute int `json:",omitempty"`
+}
+
+var hookEvents = map[string]bool{
+	"message":        true, // a text message arrived
+	"intro":          true, // a new dial request arrived
+	"responding":     true, // the peer started responding
+	"not-responding": true, // the peer stopped responding
+	"disconnect":     true, // the connection to the entry server dropped
+}
+
+// HookEvent is what a hook gets on stdin or from its pipe.
+type HookEvent struct {
+	Event   string
+	Time    time.Time
+	Peer    string `json:",omitempty"`
+	Text    string `json:",omitempty"`
+	Note    string `json:",omitempty"`
+	Round   uint32 `json:",omitempty"`
+	Mailbox bool   `json:",omitempty"`
+	Dropped int    `json:",omitempty"`
+}
+
+const (
+	hookTimeout   = 10 * time.Second
+	hookQueueSize = 16
+)
+
+type Hooks struct {
+	hooks []*hook
+	wg    sync.WaitGroup
+
+	// mu keeps Close from closing the queues under a running Emit.
+	mu     sync.RWMutex
+	closed bool
+}
+
+type hook struct {
+	conf   HookConf
+	events map[string]bool
+	queue  chan *HookEvent
+
+	mu      sync.Mutex
+	tokens  float64
+	last    time.Time
+	dropped int
+}
+
+func NewHooks(confs []HookConf) (*Hooks, error) {
+	hs := new(Hooks)
+	for i, conf := range confs {
+		if len(conf.Command) == 0 && conf.Pipe == "" {
+			return nil, fmt.Errorf("hook %d: needs a Command or a Pipe", i)
+		}
+		if conf.MaxPerMinute <= 0 {
+			conf.MaxPerMinute = 10
+		}
+		h := &hook{
+			conf:   conf,
+			events: make(map[string]bool),
+			queue:  make(chan *HookEvent, hookQueueSize),
+			tokens: float64(conf.MaxPerMinute),
+		}
+		for _, e := range conf.Events {
+			if !hookEvents[e] {
+				return nil, fmt.Errorf("hook %d: unknown event %q", i, e)
+			}
+			h.events[e] = true
+		}
+		hs.hooks = append(hs.hooks, h)
+	}
+	for _, h := range hs.hooks {
+		hs.wg.Add(1)
+		go func(h *hook) {
+			defer hs.wg.Done()
+			for e := range h.queue {
+				h.run(e)
+			}
+		}(h)
+	}
+	return hs, nil
+}
+
+// Emit hands e to the hooks that want it without waiting for them.
+// Emit on a nil or closed *Hooks does nothing.
+func (hs *Hooks) Emit(e *HookEvent) {
+	if hs == nil {
+		return
+	}
+	hs.mu.RLock()
+	defer hs.mu.RUnlock()
+	if hs.closed {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	for _, h := range hs.hooks {
+		if len(h.events) > 0 && !h.events[e.Event] {
+			continue
+		}
+		if !h.allow(e.Time) {
+			continue
+		}
+		ev := *e
+		h.mu.Lock()
+		ev.Dropped, h.dropped = h.dropped, 0
+		h.mu.Unlock()
+		select {
+		case h.queue <- &ev:
+		default:
+			h.mu.Lock()
+			h.dropped += ev.Dropped + 1
+			h.mu.Unlock()
+		}
+	}
+}
+
+// Close waits for queued events to be handled. Later events are
+// ignored.
+func (hs *Hooks) Close() {
+	if hs == nil {
+		return
+	}
+	hs.mu.Lock()
+	if !hs.closed {
+		hs.closed = true
+		for _, h := range hs.hooks {
+			close(h.queue)
+		}
+	}
+	hs.mu.Unlock()
+	hs.wg.Wait()
+}
+
+// allow is a token bucket that fills at MaxPerMinute and holds as many.
+func (h *hook) allow(now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	max := float64(h.conf.MaxPerMinute)
+	if !h.last.IsZero() && now.After(h.last) {
+		h.tokens += now.Sub(h.last).Minutes() * max
+		if h.tokens > max {
+			h.tokens = max
+		}
+	}
+	h.last = now
+	if h.tokens < 1 {
+		h.dropped++
+		return false
+	}
+	h.tokens--
+	return true
+}
+
+func (h *hook) run(e *HookEvent) {
+	hlog := log.WithFields(log.Fields{"call": "hook", "event": e.Event})
+	data, err := json.Marshal(e)
+	if err != nil {
+		hlog.WithFields(log.Fields{"bug": true}).Error(err)
+		return
+	}
+	data = append(data, '\n')
+
+	if h.conf.Pipe != "" {
+		if err := writePipe(h.conf.Pipe, data); err != nil {
+			hlog.Debug(err)
+		}
+	}
+	if len(h.conf.Command) > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+		cmd := exec.CommandContext(ctx, h.conf.Command[0], h.conf.Command[1:]...)
+		cmd.Stdin = bytes.NewReader(data)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			hlog.Errorf("%s: %s", err, bytes.TrimSpace(out))
+		}
+		cancel()
+	}
+}
+
+// writePipe doesn't wait for a reader: opening a named pipe that nobody
+// has open fails right away.
+func writePipe(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
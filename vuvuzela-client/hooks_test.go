@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func readEvents(t *testing.T, path string) []*HookEvent {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var events []*HookEvent
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		e := new(HookEvent)
+		if err := json.Unmarshal(s.Bytes(), e); err != nil {
+			t.Fatalf("bad event %q: %s", s.Text(), err)
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+func TestHooks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vuvuzela-hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pipe := filepath.Join(dir, "pipe")
+	out := filepath.Join(dir, "out")
+	if err := ioutil.WriteFile(pipe, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewHooks([]HookConf{{Events: []string{"nope"}, Pipe: pipe}}); err == nil {
+		t.Fatalf("expecting an error for an unknown event")
+	}
+	hooks, err := NewHooks([]HookConf{
+		{Pipe: pipe, MaxPerMinute: 2},
+		{Events: []string{"intro"}, Command: []string{"sh", "-c", "cat >> " + out}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	hooks.Emit(&HookEvent{Event: "message", Time: now, Peer: "bob", Text: "hi"})
+	hooks.Emit(&HookEvent{Event: "intro", Time: now, Peer: "carol", Note: "it's me"})
+	hooks.Emit(&HookEvent{Event: "message", Time: now, Peer: "bob"})
+	hooks.Emit(&HookEvent{Event: "message", Time: now.Add(time.Minute), Peer: "bob"})
+	hooks.Close()
+
+	events := readEvents(t, pipe)
+	if len(events) != 3 || events[0].Text != "hi" || events[1].Event != "intro" {
+		t.Fatalf("unexpected pipe events: %+v", events)
+	}
+	if events[2].Dropped != 1 {
+		t.Fatalf("expecting the throttled event to be counted: %+v", events[2])
+	}
+
+	events = readEvents(t, out)
+	if len(events) != 1 || events[0].Peer != "carol" || events[0].Note != "it's me" {
+		t.Fatalf("unexpected command events: %+v", events)
+	}
+
+	// Events after Close, even racing with it, are ignored.
+	hooks.Emit(&HookEvent{Event: "intro", Time: now.Add(2 * time.Minute), Peer: "dave"})
+	hooks.Close()
+	if events := readEvents(t, out); len(events) != 1 {
+		t.Fatalf("hook ran after Close: %+v", events)
+	}
+	hooks, err = NewHooks([]HookConf{{Pipe: pipe}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			hooks.Emit(&HookEvent{Event: "message"})
+		}
+		close(done)
+	}()
+	hooks.Close()
+	<-done
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/davidlazar/vuvuzela"
+)
+
+// httpTransport long-polls the entry server over plain HTTP, for networks
+// where websockets don't get through.
+type httpTransport struct {
+	base    string
+	session string
+
+	// poll outlasts HTTPPollWait; post is for everything else.
+	poll *http.Client
+	post *http.Client
+
+	// acked is the sequence number of the last envelope received, which
+	// the next poll acknowledges. Only pollLoop uses it.
+	acked uint64
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// A failed poll is retried this many times before giving up on the
+// session, since the entry server keeps unacknowledged envelopes for it.
+const httpPollRetries = 3
+
+// httpBase turns the entry server's websocket URL into an HTTP one.
+func httpBase(entryServer string) (string, error) {
+	u, err := url.Parse(entryServer)
+	if err != nil {
+		return "", fmt.Errorf("bad entry server url: %s", err)
+	}
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	case "http", "https":
+	default:
+		return "", fmt.Errorf("unsupported entry server scheme: %q", u.Scheme)
+	}
+	return strings.TrimSuffix(u.String(), "/"), nil
+}
+
+func (c *Client) connectHTTP(dial func(network, addr string) (net.Conn, error), timeout time.Duration) error {
+	base, err := httpBase(c.EntryServer)
+	if err != nil {
+		return err
+	}
+
+	rt := &http.Transport{
+		Dial:                dial,
+		TLSHandshakeTimeout: timeout,
+	}
+	if c.Proxy == "" {
+		// The networks that need this transport often require an HTTP proxy.
+		rt.Proxy = http.ProxyFromEnvironment
+	}
+	t := &httpTransport{
+		base: base,
+		poll: &http.Client{Transport: rt, Timeout: HTTPPollWait + 2*timeout},
+		post: &http.Client{Transport: rt, Timeout: 2 * timeout},
+		done: make(chan struct{}),
+	}
+
+	resp, err := t.post.Post(base+HTTPConnectPath+"?publickey="+c.MyPublicKey.String(), "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp); err != nil {
+		return fmt.Errorf("connect: %s", err)
+	}
+	var s HTTPSession
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		return fmt.Errorf("connect: %s", err)
+	}
+	t.session = url.QueryEscape(s.Session)
+
+	c.conn = t
+	go c.pollLoop(t)
+	return nil
+}
+
+func checkStatus(resp *http.Response) error {
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+}
+
+func (t *httpTransport) Send(data []byte) error {
+	resp, err := t.post.Post(t.base+HTTPSendPath+"?session="+t.session, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp); err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
+
+// recv returns the envelopes it hasn't seen before, in order.
+func (t *httpTransport) recv() ([]json.RawMessage, error) {
+	resp, err := t.poll.Get(t.base + HTTPRecvPath + "?session=" + t.session + "&after=" + strconv.FormatUint(t.acked, 10))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp); err != nil {
+		return nil, err
+	}
+	var batch HTTPBatch
+	if err := json.NewDecoder(resp.Body).Decode(&batch); err != nil {
+		return nil, err
+	}
+	if batch.First == 0 || batch.First > t.acked+1 {
+		return nil, fmt.Errorf("missing envelopes %d to %d", t.acked+1, batch.First-1)
+	}
+	var msgs []json.RawMessage
+	for i, m := range batch.Envelopes {
+		if seq := batch.First + uint64(i); seq > t.acked {
+			msgs = append(msgs, m)
+			t.acked = seq
+		}
+	}
+	return msgs, nil
+}
+
+// Close ends the session in the background; the entry server expires it
+// anyway if the request doesn't get through.
+func (t *httpTransport) Close() {
+	t.closeOnce.Do(func() {
+		close(t.done)
+		go func() {
+			resp, err := t.post.Post(t.base+HTTPClosePath+"?session="+t.session, "", nil)
+			if err == nil {
+				resp.Body.Close()
+			}
+		}()
+	})
+}
+
+func (c *Client) pollLoop(t *httpTransport) {
+	failures := 0
+	for {
+		msgs, err := t.recv()
+		select {
+		case <-t.done:
+			return
+		default:
+		}
+		if err != nil {
+			log.WithFields(log.Fields{"call": "httpRecv"}).Debug(err)
+			if failures++; failures > httpPollRetries {
+				c.transportFailed(t, err)
+				return
+			}
+			select {
+			case <-t.done:
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		failures = 0
+		for _, m := range msgs {
+			c.receive(m)
+		}
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	. "github.com/davidlazar/vuvuzela"
+)
+
+// IntroPolicy decides which introductions reach the inbox. Anyone who
+// knows our key can dial us every round, so without a policy a stranger
+// can fill the screen with dial requests.
+//
+// The sender's key in an introduction isn't authenticated, so blocking
+// and rate limits are per key and best effort: a stranger can send from
+// a fresh key, or claim a contact's key.
+type IntroPolicy struct {
+	// Block drops introductions from these keys.
+	Block []*BoxKey `json:",omitempty"`
+
+	// Allow, if set, drops introductions from everyone but these contacts.
+	Allow []string `json:",omitempty"`
+
+	// IgnoreUnknown drops introductions from keys that aren't contacts.
+	IgnoreUnknown bool `json:",omitempty"`
+
+	// MaxPerHour limits the introductions from one sender that reach
+	// the inbox each hour (default 4).
+	MaxPerHour int `json:",omitempty"`
+}
+
+const (
+	defaultMaxIntrosPerHour = 4
+	maxPendingDials         = 32
+
+	// Strangers only get this many of the pending slots, and evict each
+	// other's requests rather than contacts'.
+	maxPendingUnknown = 16
+)
+
+// An IncomingDial is a dial request waiting to be accepted or declined.
+type IncomingDial struct {
+	ID       int
+	Name     string // empty if the sender isn't a contact
+	Intro    *Introduction
+	Received time.Time
+	Count    int
+}
+
+// Note returns the caller's note, without anything that could mess
+// with the terminal.
+func (r *IncomingDial) Note() string {
+	return strings.Map(func(c rune) rune {
+		if unicode.IsPrint(c) {
+			return c
+		}
+		return -1
+	}, r.Intro.NoteText())
+}
+
+func (r *IncomingDial) String() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return fmt.Sprintf("(%s)", &r.Intro.LongTermKey)
+}
+
+type Inbox struct {
+	sync.Mutex
+
+	policy   IntroPolicy
+	contacts *ContactBook
+
+	blocked map[BoxKey]bool
+	recent  map[BoxKey][]time.Time
+	pending []*IncomingDial
+	nextID  int
+}
+
+func NewInbox(policy *IntroPolicy, contacts *ContactBook) *Inbox {
+	in := &Inbox{
+		contacts: contacts,
+		blocked:  make(map[BoxKey]bool),
+		recent:   make(map[BoxKey][]time.Time),
+		nextID:   1,
+	}
+	if policy != nil {
+		in.policy = *policy
+	}
+	if in.policy.MaxPerHour <= 0 {
+		in.policy.MaxPerHour = defaultMaxIntrosPerHour
+	}
+	for _, key := range in.policy.Block {
+		in.blocked[*key] = true
+	}
+	return in
+}
+
+func (in *Inbox) allowed(name string) bool {
+	for _, n := range in.policy.Allow {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Receive applies the policy to an introduction. It returns nil if the
+// introduction was dropped. A sender who is already in the inbox gets
+// their entry updated, and isNew is false.
+func (in *Inbox) Receive(intro *Introduction, now time.Time) (req *IncomingDial, isNew bool) {
+	key := intro.LongTermKey
+	name, known := in.contacts.NameOf(&key)
+
+	in.Lock()
+	defer in.Unlock()
+
+	if in.blocked[key] {
+		return nil, false
+	}
+	if len(in.policy.Allow) > 0 && !(known && in.allowed(name)) {
+		return nil, false
+	}
+	if in.policy.IgnoreUnknown && !known {
+		return nil, false
+	}
+
+	for k, times := range in.recent {
+		i := 0
+		for i < len(times) && now.Sub(times[i]) >= time.Hour {
+			i++
+		}
+		if i == len(times) {
+			delete(in.recent, k)
+		} else {
+			in.recent[k] = times[i:]
+		}
+	}
+	if len(in.recent[key]) >= in.policy.MaxPerHour {
+		return nil, false
+	}
+	in.recent[key] = append(in.recent[key], now)
+
+	for _, r := range in.pending {
+		if r.Intro.LongTermKey == key {
+			r.Name = name
+			r.Intro = intro
+			r.Received = now
+			r.Count++
+			return r, false
+		}
+	}
+
+	req = &IncomingDial{
+		ID:       in.nextID,
+		Name:     name,
+		Intro:    intro,
+		Received: now,
+		Count:    1,
+	}
+	in.nextID++
+	if !known && in.countUnknown() >= maxPendingUnknown {
+		in.evictOldest(isUnknown)
+	}
+	if len(in.pending) >= maxPendingDials && !in.evictOldest(isUnknown) {
+		in.evictOldest(func(*IncomingDial) bool { return true })
+	}
+	in.pending = append(in.pending, req)
+	return req, true
+}
+
+func isUnknown(r *IncomingDial) bool {
+	return r.Name == ""
+}
+
+func (in *Inbox) countUnknown() int {
+	n := 0
+	for _, r := range in.pending {
+		if isUnknown(r) {
+			n++
+		}
+	}
+	return n
+}
+
+// evictOldest drops the oldest pending request that match accepts, and
+// reports whether there was one.
+func (in *Inbox) evictOldest(match func(*IncomingDial) bool) bool {
+	for i, r := range in.pending {
+		if match(r) {
+			in.pending = append(in.pending[:i], in.pending[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (in *Inbox) Pending() []*IncomingDial {
+	in.Lock()
+	defer in.Unlock()
+	return append([]*IncomingDial(nil), in.pending...)
+}
+
+// Take removes a request from the inbox, found by number or by name.
+func (in *Inbox) Take(ref string) (*IncomingDial, error) {
+	in.Lock()
+	defer in.Unlock()
+
+	id, _ := strconv.Atoi(strings.TrimPrefix(ref, "#"))
+	for i, r := range in.pending {
+		if r.ID == id || (r.Name != "" && r.Name == ref) {
+			in.pending = append(in.pending[:i], in.pending[i+1:]...)
+			return r, nil
+		}
+	}
+	return nil, fmt.Errorf("no dial request %q (see /requests)", ref)
+}
+
+// putBack returns a request after a failed accept.
+func (in *Inbox) putBack(req *IncomingDial) {
+	in.Lock()
+	defer in.Unlock()
+	in.pending = append([]*IncomingDial{req}, in.pending...)
+}
+
+// Block drops the key's pending request and any future ones.
+func (in *Inbox) Block(key *BoxKey) {
+	in.Lock()
+	defer in.Unlock()
+
+	in.blocked[*key] = true
+	for i, r := range in.pending {
+		if r.Intro.LongTermKey == *key {
+			in.pending = append(in.pending[:i], in.pending[i+1:]...)
+			break
+		}
+	}
+}
+
+func (in *Inbox) Unblock(key *BoxKey) bool {
+	in.Lock()
+	defer in.Unlock()
+	ok := in.blocked[*key]
+	delete(in.blocked, *key)
+	return ok
+}
+
+func (in *Inbox) Blocked() []*BoxKey {
+	in.Lock()
+	defer in.Unlock()
+	keys := make([]*BoxKey, 0, len(in.blocked))
+	for k := range in.blocked {
+		key := k
+		keys = append(keys, &key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].String() < keys[j].String()
+	})
+	return keys
+}
+
+func (gc *GuiClient) listRequests() {
+	reqs := gc.inbox.Pending()
+	if len(reqs) == 0 {
+		gc.Warnf("No dial requests\n")
+		return
+	}
+	now := time.Now()
+	for _, r := range reqs {
+		gc.Warnf("#%d %s, %d times, last %s ago\n", r.ID, r, r.Count, now.Sub(r.Received).Truncate(time.Second))
+		if note := r.Note(); note != "" {
+			gc.Warnf("    %q\n", note)
+		}
+	}
+	gc.Warnf("/accept <n> to talk (unknown senders need a name: /accept <n> <name>), /decline <n>, /block <n>\n")
+}
+
+func (gc *GuiClient) acceptRequest(args string) {
+	fields := strings.Fields(args)
+	if len(fields) == 0 || len(fields) > 2 {
+		gc.Warnf("usage: /accept <n> [name]\n")
+		return
+	}
+	req, err := gc.inbox.Take(fields[0])
+	if err != nil {
+		gc.Warnf("%s\n", err)
+		return
+	}
+	name := req.Name
+	if name == "" {
+		if len(fields) != 2 {
+			gc.inbox.putBack(req)
+			gc.Warnf("%s isn't a contact: /accept %d <name>\n", req, req.ID)
+			return
+		}
+		name = fields[1]
+		if err := gc.contacts.Add(name, &req.Intro.LongTermKey); err != nil {
+			gc.inbox.putBack(req)
+			gc.Warnf("Accept failed: %s\n", err)
+			return
+		}
+		gc.saveContacts()
+	}
+	gc.dialer.accept(req.Intro)
+	gc.switchConversation(name)
+}
+
+func (gc *GuiClient) declineRequest(ref string) {
+	req, err := gc.inbox.Take(ref)
+	if err != nil {
+		gc.Warnf("%s\n", err)
+		return
+	}
+	gc.Warnf("Declined dial request from %s\n", req)
+}
+
+// blockSender blocks the sender of a pending request, or a contact.
+func (gc *GuiClient) blockSender(ref string) {
+	var who string
+	var key *BoxKey
+	if req, err := gc.inbox.Take(ref); err == nil {
+		who, key = req.String(), &req.Intro.LongTermKey
+	} else if k, ok := gc.contacts.Lookup(ref); ok {
+		who, key = ref, k
+	} else {
+		gc.Warnf("%s\n", err)
+		return
+	}
+	gc.inbox.Block(key)
+	gc.dialer.forget(key)
+	gc.saveContacts()
+	gc.Warnf("Blocked %s\n", who)
+}
+
+func (gc *GuiClient) unblockSender(ref string) {
+	key, ok := gc.contacts.Lookup(ref)
+	if !ok {
+		var err error
+		key, err = KeyFromString(strings.Trim(ref, "()"))
+		if err != nil {
+			gc.Warnf("usage: /unblock <name|key>\n")
+			return
+		}
+	}
+	if !gc.inbox.Unblock(key) {
+		gc.Warnf("%s isn't blocked\n", ref)
+		return
+	}
+	gc.saveContacts()
+	gc.Warnf("Unblocked %s\n", ref)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/rand"
+	"testing"
+	"time"
+
+	. "github.com/davidlazar/vuvuzela"
+)
+
+func TestInbox(t *testing.T) {
+	alicePublic, _, _ := GenerateBoxKey(rand.Reader)
+	malloryPublic, _, _ := GenerateBoxKey(rand.Reader)
+	contacts := NewContactBook(map[string]*BoxKey{"alice": alicePublic})
+
+	in := NewInbox(&IntroPolicy{MaxPerHour: 2}, contacts)
+	now := time.Now()
+
+	req, isNew := in.Receive(&Introduction{LongTermKey: *alicePublic}, now)
+	if req == nil || !isNew || req.Name != "alice" {
+		t.Fatalf("expecting new request from alice, got %v", req)
+	}
+	if req, isNew = in.Receive(&Introduction{LongTermKey: *alicePublic}, now); req == nil || isNew || req.Count != 2 {
+		t.Fatalf("expecting repeat request from alice")
+	}
+	if req, _ = in.Receive(&Introduction{LongTermKey: *alicePublic}, now); req != nil {
+		t.Fatalf("expecting rate limit")
+	}
+	if req, _ = in.Receive(&Introduction{LongTermKey: *alicePublic}, now.Add(time.Hour)); req == nil {
+		t.Fatalf("expecting rate limit to expire")
+	}
+
+	req, _ = in.Receive(&Introduction{LongTermKey: *malloryPublic}, now)
+	if req == nil || req.Name != "" {
+		t.Fatalf("expecting request from unknown sender")
+	}
+	in.Block(malloryPublic)
+	if len(in.Pending()) != 1 {
+		t.Fatalf("expecting blocked request to leave the inbox")
+	}
+	if req, _ = in.Receive(&Introduction{LongTermKey: *malloryPublic}, now.Add(2*time.Hour)); req != nil {
+		t.Fatalf("expecting blocked sender to be dropped")
+	}
+
+	if _, err := in.Take("alice"); err != nil {
+		t.Fatalf("Take: %s", err)
+	}
+	if len(in.Pending()) != 0 {
+		t.Fatalf("expecting empty inbox")
+	}
+
+	strict := NewInbox(&IntroPolicy{IgnoreUnknown: true}, contacts)
+	if req, _ = strict.Receive(&Introduction{LongTermKey: *malloryPublic}, now); req != nil {
+		t.Fatalf("expecting unknown sender to be ignored")
+	}
+	allow := NewInbox(&IntroPolicy{Allow: []string{"bob"}}, contacts)
+	if req, _ = allow.Receive(&Introduction{LongTermKey: *alicePublic}, now); req != nil {
+		t.Fatalf("expecting alice to be dropped by the allow list")
+	}
+}
+
+func TestInboxFlood(t *testing.T) {
+	alicePublic, _, _ := GenerateBoxKey(rand.Reader)
+	contacts := NewContactBook(map[string]*BoxKey{"alice": alicePublic})
+	in := NewInbox(nil, contacts)
+	now := time.Now()
+
+	if req, _ := in.Receive(&Introduction{LongTermKey: *alicePublic}, now); req == nil {
+		t.Fatalf("expecting request from alice")
+	}
+	// A stranger with a fresh key every time can't push alice out.
+	for i := 0; i < 2*maxPendingDials; i++ {
+		key, _, _ := GenerateBoxKey(rand.Reader)
+		if req, _ := in.Receive(&Introduction{LongTermKey: *key}, now); req == nil {
+			t.Fatalf("expecting request from unknown sender %d", i)
+		}
+	}
+	pending := in.Pending()
+	if len(pending) != maxPendingUnknown+1 {
+		t.Fatalf("expecting %d pending requests, got %d", maxPendingUnknown+1, len(pending))
+	}
+	if pending[0].Name != "alice" {
+		t.Fatalf("alice's request was evicted")
+	}
+	// The newest strangers are kept.
+	if last := pending[len(pending)-1]; last.ID != 2*maxPendingDials+1 {
+		t.Fatalf("expecting the newest request last, got #%d", last.ID)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/nacl/box"
+
+	. "github.com/davidlazar/vuvuzela"
+)
+
+// Mail can't use the round number as a nonce because the recipient doesn't
+// know which round it was deposited in, so it carries a random nonce and
+// has less room for the message.
+const SizeMailboxMessage = SizeMessage - 24
+
+// Start depositing queued messages after the peer misses this many rounds.
+const mailboxAfterRounds = 3
+
+type mailPickup struct {
+	peerName      string
+	peerPublicKey *BoxKey
+}
+
+// sealMail encrypts a marshaled message, which must fit in
+// SizeMailboxMessage bytes apart from its zero padding.
+func sealMail(message []byte, peerPublicKey, myPrivateKey *BoxKey) ([]byte, error) {
+	if len(bytes.TrimRight(message, "\x00")) > SizeMailboxMessage {
+		return nil, fmt.Errorf("message too long for a mailbox")
+	}
+	var padded [SizeMailboxMessage]byte
+	copy(padded[:], message)
+	var nonce [24]byte
+	rand.Read(nonce[:])
+	return box.Seal(nonce[:], padded[:], &nonce, peerPublicKey.Key(), myPrivateKey.Key()), nil
+}
+
+func openMail(ctxt []byte, peerPublicKey, myPrivateKey *BoxKey) ([]byte, bool) {
+	if len(ctxt) < 24 {
+		return nil, false
+	}
+	var nonce [24]byte
+	copy(nonce[:], ctxt[:24])
+	return box.Open(nil, ctxt[24:], &nonce, peerPublicKey.Key(), myPrivateKey.Key())
+}
+
+func (c *Conversation) peerAway() bool {
+	c.RLock()
+	defer c.RUnlock()
+	return !c.Solo() && c.unansweredRounds >= mailboxAfterRounds
+}
+
+// nextPickup picks the mailbox to check this round. An idle client cycles
+// through everyone it knows; a conversation with an absent peer checks
+// only that peer's mailbox.
+func (c *Conversation) nextPickup(round uint32) (*mailPickup, DeadDrop) {
+	var pickups []*mailPickup
+	if c.Solo() {
+		for _, name := range c.contacts.Names() {
+			key, _ := c.contacts.Lookup(name)
+			if *key != *c.myPublicKey {
+				pickups = append(pickups, &mailPickup{name, key})
+			}
+		}
+	} else {
+		pickups = append(pickups, &mailPickup{c.peerName, c.peerPublicKey})
+	}
+	if len(pickups) == 0 {
+		return nil, DeadDrop{}
+	}
+
+	c.Lock()
+	i := c.pickupIndex
+	c.pickupIndex++
+	c.Unlock()
+
+	lookback := int(c.pki.MailboxLookback())
+	p := pickups[(i/lookback)%len(pickups)]
+	window := round / MailboxWindow
+	if back := uint32(i % lookback); back <= window {
+		window -= back
+	}
+	senderRole := ConvoRole(p.peerPublicKey, c.myPublicKey)
+	return p, MailboxDeadDrop(c.myPrivateKey, p.peerPublicKey, senderRole, window)
+}
+
+func (c *Conversation) handleMail(round uint32, p *mailPickup, encmsg []byte) {
+	rlog := log.WithFields(log.Fields{"round": round})
+
+	msgdata, ok := openMail(encmsg, p.peerPublicKey, c.myPrivateKey)
+	if !ok {
+		rlog.Error("decrypting mail failed")
+		return
+	}
+
+	msg := new(ConvoMessage)
+	if err := msg.Unmarshal(msgdata); err != nil {
+		rlog.Errorf("unmarshaling mail failed: %s", err)
+		return
+	}
+	c.handleMessage(&IncomingMessage{
+		ConvoMessage: msg,
+		Round:        round,
+		Peer:         p.peerName,
+		Mailbox:      true,
+	})
+}
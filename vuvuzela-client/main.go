@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"flag"
 	"io/ioutil"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 
@@ -15,11 +16,40 @@ import (
 var doInit = flag.Bool("init", false, "create default config file")
 var confPath = flag.String("conf", "confs/client.conf", "config file")
 var pkiPath = flag.String("pki", "confs/pki.conf", "pki file")
+var daemon = flag.Bool("daemon", false, "stay online without the terminal UI, following the Presence policy")
+var proxyURL = flag.String("proxy", "", "SOCKS5 proxy for the entry server connection, like socks5://127.0.0.1:9050 (overrides Proxy in conf)")
+var statePath = flag.String("state", "", "state directory (default: conf path with .state extension)")
 
 type Conf struct {
 	MyName       string
 	MyPublicKey  *BoxKey
 	MyPrivateKey *BoxKey
+
+	StateDir string        `json:",omitempty"`
+	Presence *PresenceConf `json:",omitempty"`
+
+	// Mailbox leaves messages for peers who are offline and checks for
+	// messages left while we were away. Needs MailboxRounds in the PKI.
+	Mailbox bool `json:",omitempty"`
+
+	// DelayedStart lets conversations we dial start up to this many
+	// convo rounds after the rendezvous, at a round only the two peers know.
+	DelayedStart uint32 `json:",omitempty"`
+
+	// Intros filters incoming dial requests.
+	Intros *IntroPolicy `json:",omitempty"`
+
+	// Proxy hides our IP address from the entry server, for example
+	// "socks5://127.0.0.1:9050" to connect through a local Tor daemon.
+	Proxy string `json:",omitempty"`
+
+	// Transport picks how to reach the entry server: "websocket", "http"
+	// (long-polling), or empty to fall back to HTTP when websockets fail.
+	Transport string `json:",omitempty"`
+
+	// Hooks run commands or write to named pipes on events like
+	// incoming messages and dial requests.
+	Hooks []HookConf `json:",omitempty"`
 }
 
 func WriteDefaultConf(path string) {
@@ -57,11 +87,74 @@ func main() {
 		log.Fatalf("missing required fields: %s", *confPath)
 	}
 
+	stateDir := *statePath
+	if stateDir == "" {
+		stateDir = conf.StateDir
+	}
+	if stateDir == "" {
+		stateDir = strings.TrimSuffix(*confPath, ".conf") + ".state"
+	}
+	store, err := OpenStore(stateDir)
+	if err != nil {
+		log.Fatalf("OpenStore: %s", err)
+	}
+
+	if conf.Mailbox && pki.MailboxRounds == 0 {
+		log.Warn("Mailbox: the servers don't keep mail (no MailboxRounds in the PKI)")
+		conf.Mailbox = false
+	}
+
 	gc := &GuiClient{
 		pki:          pki,
 		myName:       conf.MyName,
 		myPublicKey:  conf.MyPublicKey,
 		myPrivateKey: conf.MyPrivateKey,
+		store:        store,
+		mailbox:      conf.Mailbox,
+		delayedStart: conf.DelayedStart,
+		proxy:        conf.Proxy,
+		transport:    conf.Transport,
+		introPolicy:  conf.Intros,
+	}
+	if *proxyURL != "" {
+		gc.proxy = *proxyURL
+	}
+	if gc.proxy != "" {
+		if _, err := proxyDialer(gc.proxy); err != nil {
+			log.Fatalf("Proxy: %s", err)
+		}
+	}
+
+	if conf.DelayedStart > MaxScheduleDelay {
+		log.Fatalf("DelayedStart: at most %d rounds", MaxScheduleDelay)
+	}
+
+	switch gc.transport {
+	case "", "websocket", "http":
+	default:
+		log.Fatalf("Transport: unknown transport %q", gc.transport)
+	}
+
+	gc.hooks, err = NewHooks(conf.Hooks)
+	if err != nil {
+		log.Fatalf("Hooks: %s", err)
+	}
+
+	// The terminal UI always stays connected; the presence policy is
+	// only for -daemon.
+	if conf.Presence == nil && *daemon {
+		conf.Presence = &PresenceConf{Always: true}
+	}
+	if conf.Presence != nil && *daemon {
+		gc.presence, err = NewPresence(conf.Presence)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *daemon {
+		gc.RunDaemon()
+	} else {
+		gc.Run()
 	}
-	gc.Run()
 }
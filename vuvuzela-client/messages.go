@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	. "github.com/davidlazar/vuvuzela"
+)
+
+// A ConvoMessage fills the plaintext of a conversation exchange. The first
+// byte is the message type. Types 0 (timestamp) and 1 (text) predate the
+// registry and are followed directly by their body; every other type is
+// followed by a flags byte and then its body.
+type ConvoMessage struct {
+	Type  byte
+	Flags byte
+	Body  interface{}
+}
+
+const (
+	// FlagCritical asks a peer that doesn't know the type to say so
+	// instead of silently ignoring the message.
+	FlagCritical byte = 0x80
+
+	flagVersionMask byte = 0x0f
+
+	// Types below this one have no flags byte.
+	firstFlaggedType byte = 2
+)
+
+// A MessageType describes how to encode, decode and handle one kind of
+// conversation message.
+type MessageType struct {
+	ID   byte
+	Name string
+
+	// Body is a value of the Go type carried by messages of this type,
+	// such as (*TextMessage)(nil).
+	Body interface{}
+
+	// Version is sent in the low bits of the flags byte so that a type's
+	// encoding can change without taking a new ID.
+	Version byte
+
+	// Critical sets FlagCritical on outgoing messages.
+	Critical bool
+
+	Marshal   func(body interface{}, data []byte)
+	Unmarshal func(version byte, data []byte) (interface{}, error)
+
+	// Handle is called for each message received from a peer.
+	Handle func(c *Conversation, in *IncomingMessage)
+}
+
+// An IncomingMessage is a message received from a peer, either in a
+// conversation round or picked up from a mailbox.
+type IncomingMessage struct {
+	*ConvoMessage
+	Round   uint32
+	Peer    string
+	Mailbox bool
+}
+
+var (
+	messageTypes     = make(map[byte]*MessageType)
+	messageTypesByGo = make(map[reflect.Type]*MessageType)
+)
+
+// RegisterMessageType makes a message type available to all conversations.
+// It panics if the ID or the body type is already registered.
+func RegisterMessageType(t *MessageType) {
+	if t.ID < firstFlaggedType && t.Version != 0 {
+		panic(fmt.Sprintf("message type %d can't be versioned", t.ID))
+	}
+	if t.Version > flagVersionMask {
+		panic(fmt.Sprintf("message type %d: version %d too large", t.ID, t.Version))
+	}
+	if _, ok := messageTypes[t.ID]; ok {
+		panic(fmt.Sprintf("message type %d registered twice", t.ID))
+	}
+	goType := reflect.TypeOf(t.Body)
+	if _, ok := messageTypesByGo[goType]; ok {
+		panic(fmt.Sprintf("message body %s registered twice", goType))
+	}
+	messageTypes[t.ID] = t
+	messageTypesByGo[goType] = t
+}
+
+// UnknownMessage is the body of a message whose type isn't registered.
+type UnknownMessage struct {
+	Data []byte
+}
+
+func (cm *ConvoMessage) Marshal() (msg [SizeMessage]byte) {
+	t, ok := messageTypesByGo[reflect.TypeOf(cm.Body)]
+	if !ok {
+		panic(fmt.Sprintf("unregistered message body %T", cm.Body))
+	}
+	msg[0] = t.ID
+	data := msg[1:]
+	if t.ID >= firstFlaggedType {
+		flags := t.Version
+		if t.Critical {
+			flags |= FlagCritical
+		}
+		msg[1] = flags
+		data = msg[2:]
+	}
+	t.Marshal(cm.Body, data)
+	return
+}
+
+func (cm *ConvoMessage) Unmarshal(msg []byte) error {
+	if len(msg) == 0 {
+		return fmt.Errorf("empty message")
+	}
+	cm.Type = msg[0]
+	cm.Flags = 0
+	data := msg[1:]
+	if cm.Type >= firstFlaggedType {
+		if len(data) == 0 {
+			return fmt.Errorf("message type %d: missing flags", cm.Type)
+		}
+		cm.Flags = data[0]
+		data = data[1:]
+	}
+
+	t, ok := messageTypes[cm.Type]
+	if !ok {
+		cm.Body = &UnknownMessage{Data: data}
+		return nil
+	}
+	body, err := t.Unmarshal(cm.Flags&flagVersionMask, data)
+	if err != nil {
+		return fmt.Errorf("%s message: %s", t.Name, err)
+	}
+	cm.Body = body
+	return nil
+}
+
+func (c *Conversation) handleMessage(in *IncomingMessage) {
+	t, ok := messageTypes[in.Type]
+	if !ok {
+		if in.Flags&FlagCritical != 0 {
+			c.warnUnknownType(in)
+		}
+		return
+	}
+	if t.Handle != nil {
+		t.Handle(c, in)
+	}
+}
+
+// warnUnknownType tells the user once per type that the peer is sending
+// something this client can't show.
+func (c *Conversation) warnUnknownType(in *IncomingMessage) {
+	c.Lock()
+	if c.warnedTypes == nil {
+		c.warnedTypes = make(map[byte]bool)
+	}
+	warned := c.warnedTypes[in.Type]
+	c.warnedTypes[in.Type] = true
+	c.Unlock()
+	if !warned {
+		c.gui.PeerWarnf(c.peerName, "%s sent a message this client doesn't understand (type %d); consider upgrading\n", in.Peer, in.Type)
+	}
+}
+
+func (c *Conversation) printText(in *IncomingMessage, msg []byte) {
+	s := strings.TrimRight(string(msg), "\x00")
+	if in.Mailbox {
+		c.gui.PeerPrintf(c.peerName, "<%s> [mailbox] %s\n", in.Peer, s)
+	} else {
+		c.gui.PeerPrintf(c.peerName, "<%s> %s\n", in.Peer, s)
+	}
+	c.gui.hooks.Emit(&HookEvent{Event: "message", Peer: in.Peer, Text: s, Round: in.Round, Mailbox: in.Mailbox})
+}
+
+type TextMessage struct {
+	Message []byte
+}
+
+// TimestampMessage was sent by older clients instead of EchoMessage. It
+// is still decoded, but the peer's clock isn't used for latency.
+type TimestampMessage struct {
+	Timestamp time.Time
+}
+
+func init() {
+	RegisterMessageType(&MessageType{
+		ID:   0,
+		Name: "timestamp",
+		Body: (*TimestampMessage)(nil),
+		Marshal: func(body interface{}, data []byte) {
+			binary.PutVarint(data, body.(*TimestampMessage).Timestamp.Unix())
+		},
+		Unmarshal: func(_ byte, data []byte) (interface{}, error) {
+			ts, _ := binary.Varint(data)
+			return &TimestampMessage{Timestamp: time.Unix(ts, 0)}, nil
+		},
+	})
+
+	RegisterMessageType(&MessageType{
+		ID:   1,
+		Name: "text",
+		Body: (*TextMessage)(nil),
+		Marshal: func(body interface{}, data []byte) {
+			copy(data, body.(*TextMessage).Message)
+		},
+		Unmarshal: func(_ byte, data []byte) (interface{}, error) {
+			return &TextMessage{data}, nil
+		},
+		Handle: func(c *Conversation, in *IncomingMessage) {
+			c.printText(in, in.Body.(*TextMessage).Message)
+		},
+	})
+}
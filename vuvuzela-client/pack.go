@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	. "github.com/davidlazar/vuvuzela"
+)
+
+// A PackedTextMessage carries several queued text messages in one slot,
+// optionally compressed. Its encoding is a mode byte, the length of the
+// payload as a uvarint, and the payload: each message as a uvarint length
+// followed by its bytes. In packCompressed mode the payload is deflated
+// with packDictionary, which can't change without bumping the version.
+type PackedTextMessage struct {
+	Messages [][]byte
+
+	encoded []byte
+}
+
+const (
+	packRaw        byte = 0
+	packCompressed byte = 1
+
+	packVersion = 1
+
+	// maxUnpackedSize bounds what a compressed slot can expand to.
+	maxUnpackedSize = 16 * SizeMessage
+)
+
+// packDictionary primes the compressor with text that is common in chat,
+// so that even short messages shrink.
+const packDictionary = "http://https://www. .com .org ok okay sure yes yeah no nope " +
+	"thanks thank you please sorry hello hi hey bye see you later talk soon " +
+	"good morning good night how are you what's up I'm I am I'll I don't know " +
+	"I think you're we're they're it's that's can't won't didn't doesn't isn't " +
+	"what when where why who how the and that this with for have just about " +
+	"would could should there their they them then than been were will today " +
+	"tomorrow yesterday tonight right now let me know sounds good on my way " +
+	"are you there? message meeting call later lol :) :( ? ! . , "
+
+// encodePacked returns the shorter of the raw and compressed encodings.
+func encodePacked(msgs [][]byte) []byte {
+	payload := new(bytes.Buffer)
+	var n [binary.MaxVarintLen64]byte
+	for _, m := range msgs {
+		payload.Write(n[:binary.PutUvarint(n[:], uint64(len(m)))])
+		payload.Write(m)
+	}
+
+	best := packFrame(packRaw, payload.Bytes())
+	compressed := new(bytes.Buffer)
+	w, _ := flate.NewWriterDict(compressed, flate.BestCompression, []byte(packDictionary))
+	w.Write(payload.Bytes())
+	w.Close()
+	if c := packFrame(packCompressed, compressed.Bytes()); len(c) < len(best) {
+		best = c
+	}
+	return best
+}
+
+func packFrame(mode byte, payload []byte) []byte {
+	var n [binary.MaxVarintLen64]byte
+	frame := []byte{mode}
+	frame = append(frame, n[:binary.PutUvarint(n[:], uint64(len(payload)))]...)
+	return append(frame, payload...)
+}
+
+func decodePacked(data []byte) ([][]byte, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty message")
+	}
+	mode := data[0]
+	size, n := binary.Uvarint(data[1:])
+	if n <= 0 || size > uint64(len(data)-1-n) {
+		return nil, fmt.Errorf("bad payload length")
+	}
+	payload := data[1+n : 1+n+int(size)]
+
+	switch mode {
+	case packRaw:
+	case packCompressed:
+		r := flate.NewReaderDict(bytes.NewReader(payload), []byte(packDictionary))
+		var err error
+		payload, err = ioutil.ReadAll(io.LimitReader(r, maxUnpackedSize+1))
+		if err != nil {
+			return nil, fmt.Errorf("decompressing: %s", err)
+		}
+		if len(payload) > maxUnpackedSize {
+			return nil, fmt.Errorf("message too large")
+		}
+	default:
+		return nil, fmt.Errorf("unknown mode %d", mode)
+	}
+
+	var msgs [][]byte
+	for len(payload) > 0 {
+		size, n := binary.Uvarint(payload)
+		if n <= 0 || size > uint64(len(payload)-n) {
+			return nil, fmt.Errorf("bad message length")
+		}
+		msgs = append(msgs, payload[n:n+int(size)])
+		payload = payload[n+int(size):]
+	}
+	return msgs, nil
+}
+
+// nextText takes as many queued messages as fit in a slot of the given
+// size. A lone message that fits as a plain TextMessage is sent as one,
+// so that peers running older clients can still read it.
+func (c *Conversation) nextText(slot int) (texts [][]byte, body interface{}) {
+	c.Lock()
+	defer c.Unlock()
+	if len(c.outQueue) == 0 {
+		return nil, nil
+	}
+
+	first := c.outQueue[0]
+	packed := encodePacked(c.outQueue[:1])
+	n := 1
+	for n < len(c.outQueue) {
+		p := encodePacked(c.outQueue[:n+1])
+		if len(p) > slot-2 {
+			break
+		}
+		packed = p
+		n++
+	}
+	texts = append(texts, c.outQueue[:n]...)
+	c.outQueue = c.outQueue[n:]
+
+	if n == 1 && (len(first) <= slot-1 || len(packed) > slot-2) {
+		return texts, &TextMessage{Message: first}
+	}
+	return texts, &PackedTextMessage{Messages: texts, encoded: packed}
+}
+
+func init() {
+	RegisterMessageType(&MessageType{
+		ID:       3,
+		Name:     "packed text",
+		Body:     (*PackedTextMessage)(nil),
+		Version:  packVersion,
+		Critical: true,
+		Marshal: func(body interface{}, data []byte) {
+			m := body.(*PackedTextMessage)
+			if m.encoded == nil {
+				m.encoded = encodePacked(m.Messages)
+			}
+			copy(data, m.encoded)
+		},
+		Unmarshal: func(version byte, data []byte) (interface{}, error) {
+			if version != packVersion {
+				return nil, fmt.Errorf("unsupported version %d", version)
+			}
+			msgs, err := decodePacked(data)
+			if err != nil {
+				return nil, err
+			}
+			return &PackedTextMessage{Messages: msgs}, nil
+		},
+		Handle: func(c *Conversation, in *IncomingMessage) {
+			for _, m := range in.Body.(*PackedTextMessage).Messages {
+				c.printText(in, m)
+			}
+		},
+	})
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// PresenceConf says when the client should stay connected and send cover
+// traffic, regardless of whether anyone is using it.
+type PresenceConf struct {
+	Always bool `json:",omitempty"`
+
+	// Hours lists daily windows in local time, like "08:00-23:30".
+	// A window that ends before it starts wraps past midnight.
+	Hours []string `json:",omitempty"`
+
+	// ReportMinutes is how often to report bandwidth (default 60).
+	ReportMinutes int `json:",omitempty"`
+}
+
+type presenceWindow struct {
+	start, end time.Duration // offsets from midnight
+}
+
+func (w presenceWindow) contains(d time.Duration) bool {
+	if w.start <= w.end {
+		return d >= w.start && d < w.end
+	}
+	return d >= w.start || d < w.end
+}
+
+func (w presenceWindow) length() time.Duration {
+	if w.start <= w.end {
+		return w.end - w.start
+	}
+	return 24*time.Hour - w.start + w.end
+}
+
+type presenceTarget interface {
+	Connect() error
+	Disconnect()
+	Connected() bool
+	Traffic() Traffic
+}
+
+type Presence struct {
+	always         bool
+	windows        []presenceWindow
+	reportInterval time.Duration
+
+	onlineTime time.Duration
+}
+
+func NewPresence(conf *PresenceConf) (*Presence, error) {
+	p := &Presence{
+		always:         conf.Always,
+		reportInterval: time.Duration(conf.ReportMinutes) * time.Minute,
+	}
+	if p.reportInterval <= 0 {
+		p.reportInterval = time.Hour
+	}
+	for _, h := range conf.Hours {
+		w, err := parseWindow(h)
+		if err != nil {
+			return nil, err
+		}
+		p.windows = append(p.windows, w)
+	}
+	if !p.always && len(p.windows) == 0 {
+		return nil, fmt.Errorf("presence: need Always or at least one window in Hours")
+	}
+	return p, nil
+}
+
+func parseWindow(s string) (presenceWindow, error) {
+	var w presenceWindow
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return w, fmt.Errorf("presence: bad window %q (expecting HH:MM-HH:MM)", s)
+	}
+	for i, part := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return w, fmt.Errorf("presence: bad window %q: %s", s, err)
+		}
+		d := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+		if i == 0 {
+			w.start = d
+		} else {
+			w.end = d
+		}
+	}
+	return w, nil
+}
+
+func (p *Presence) Online(t time.Time) bool {
+	if p.always {
+		return true
+	}
+	d := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	for _, w := range p.windows {
+		if w.contains(d) {
+			return true
+		}
+	}
+	return false
+}
+
+// OnlinePerDay is how long the policy keeps the client online each day.
+func (p *Presence) OnlinePerDay() time.Duration {
+	if p.always {
+		return 24 * time.Hour
+	}
+	// Overlapping windows are counted by sampling each minute of the day.
+	var online time.Duration
+	for d := time.Duration(0); d < 24*time.Hour; d += time.Minute {
+		for _, w := range p.windows {
+			if w.contains(d) {
+				online += time.Minute
+				break
+			}
+		}
+	}
+	return online
+}
+
+func (p *Presence) Run(target presenceTarget, report func(format string, v ...interface{})) {
+	const checkInterval = 15 * time.Second
+
+	lastCheck := time.Now()
+	lastReport := lastCheck
+	for {
+		now := time.Now()
+		connected := target.Connected()
+		if connected {
+			p.onlineTime += now.Sub(lastCheck)
+		}
+		lastCheck = now
+
+		if want := p.Online(now); want && !connected {
+			if err := target.Connect(); err != nil {
+				report("Presence: failed to connect: %s\n", err)
+			} else {
+				report("Presence: online\n")
+			}
+		} else if !want && connected {
+			target.Disconnect()
+			report("Presence: offline until the next scheduled window\n")
+		}
+
+		if now.Sub(lastReport) >= p.reportInterval {
+			report("%s\n", p.bandwidthReport(target.Traffic()))
+			lastReport = now
+		}
+
+		time.Sleep(checkInterval)
+	}
+}
+
+func (p *Presence) bandwidthReport(t Traffic) string {
+	total := t.BytesSent + t.BytesReceived
+	s := fmt.Sprintf("Presence: online %s, %d convo rounds, %d dial rounds, sent %s, received %s",
+		p.onlineTime/time.Second*time.Second, t.ConvoRounds, t.DialRounds, byteSize(t.BytesSent), byteSize(t.BytesReceived))
+	if p.onlineTime > time.Minute {
+		perDay := float64(total) / p.onlineTime.Seconds() * p.OnlinePerDay().Seconds()
+		s += fmt.Sprintf(", about %s/day at this schedule", byteSize(int64(perDay)))
+	}
+	return s
+}
+
+func byteSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fGB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fKB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%dB", n)
+	}
+}
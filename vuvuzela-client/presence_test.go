@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPresenceWindows(t *testing.T) {
+	p, err := NewPresence(&PresenceConf{Hours: []string{"08:00-12:00", "22:00-02:00"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	day := time.Date(2015, 10, 4, 0, 0, 0, 0, time.Local)
+	tests := []struct {
+		at     time.Duration
+		online bool
+	}{
+		{7*time.Hour + 59*time.Minute, false},
+		{8 * time.Hour, true},
+		{11*time.Hour + 59*time.Minute, true},
+		{12 * time.Hour, false},
+		{23 * time.Hour, true},
+		{1 * time.Hour, true},
+		{2 * time.Hour, false},
+	}
+	for _, test := range tests {
+		if online := p.Online(day.Add(test.at)); online != test.online {
+			t.Errorf("at %s: expecting online=%v", test.at, test.online)
+		}
+	}
+
+	if d := p.OnlinePerDay(); d != 8*time.Hour {
+		t.Fatalf("expecting 8h online per day, got %s", d)
+	}
+}
+
+func TestPresenceConf(t *testing.T) {
+	if _, err := NewPresence(&PresenceConf{}); err == nil {
+		t.Fatalf("expecting error for empty policy")
+	}
+	if _, err := NewPresence(&PresenceConf{Hours: []string{"8-12"}}); err == nil {
+		t.Fatalf("expecting error for malformed window")
+	}
+}
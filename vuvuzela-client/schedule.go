@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+
+	. "github.com/davidlazar/vuvuzela"
+)
+
+// A Schedule decides which rounds a newly dialed conversation uses its
+// dead drop. Both peers derive it from their shared key and the dial's
+// rendezvous, so they show up in the same rounds without talking first.
+// Participation starts at a pseudorandom round (up to delay rounds after
+// the rendezvous) and grows to every round over ScheduleRamp rounds, so
+// a new pair of doubles doesn't appear exactly when someone types /talk.
+type Schedule struct {
+	key   []byte
+	start uint32
+	ramp  uint32
+}
+
+func NewSchedule(sharedKey *[32]byte, rendezvous uint32, delay uint32) *Schedule {
+	h := hmac.New(sha256.New, sharedKey[:])
+	h.Write([]byte("schedule"))
+	binary.Write(h, binary.BigEndian, rendezvous)
+
+	s := &Schedule{
+		key:   h.Sum(nil),
+		start: rendezvous,
+		ramp:  ScheduleRamp,
+	}
+	if delay > MaxScheduleDelay {
+		delay = MaxScheduleDelay
+	}
+	if delay > 0 {
+		start := uint64(rendezvous) + uint64(s.prf("start", rendezvous))%(uint64(delay)+1)
+		if start > math.MaxUint32 {
+			start = math.MaxUint32
+		}
+		s.start = uint32(start)
+	}
+	return s
+}
+
+func (s *Schedule) prf(label string, round uint32) uint32 {
+	h := hmac.New(sha256.New, s.key)
+	h.Write([]byte(label))
+	binary.Write(h, binary.BigEndian, round)
+	return binary.BigEndian.Uint32(h.Sum(nil))
+}
+
+func (s *Schedule) Active(round uint32) bool {
+	if round < s.start {
+		return false
+	}
+	n := round - s.start
+	if n >= s.ramp {
+		return true
+	}
+	// participate with probability (n+1)/(ramp+1)
+	return s.prf("round", round)%(s.ramp+1) <= n
+}
+
+// StartsIn returns how many rounds remain until the schedule starts.
+func (s *Schedule) StartsIn(round uint32) uint32 {
+	if round >= s.start {
+		return 0
+	}
+	return s.start - round
+}
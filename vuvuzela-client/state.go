@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/davidlazar/vuvuzela"
+)
+
+// ClientState is everything the client needs to pick up where it left off.
+type ClientState struct {
+	Selected      string
+	Conversations map[string]*ConversationState
+	PendingDials  []*BoxKey
+
+	// DialNotes[i] is the note sent with PendingDials[i].
+	DialNotes []string `json:",omitempty"`
+
+	// The first convo and dial rounds to accept, so old round
+	// announcements can't be replayed after a restart.
+	ConvoRound uint32 `json:",omitempty"`
+	DialRound  uint32 `json:",omitempty"`
+}
+
+// SavedContacts are the contacts and blocked keys that aren't in the
+// PKI or config file.
+type SavedContacts struct {
+	Cards    []*ContactCard     `json:",omitempty"`
+	Accepted map[string]*BoxKey `json:",omitempty"`
+	Blocked  []*BoxKey          `json:",omitempty"`
+}
+
+type ConversationState struct {
+	// Unacked messages were sent in a round that hasn't been answered by
+	// the peer. They are resent first, so the peer might see duplicates.
+	Unacked [][]byte `json:",omitempty"`
+	Queued  [][]byte `json:",omitempty"`
+}
+
+type Store struct {
+	mu           sync.Mutex
+	path         string
+	contactsPath string
+	roundsPath   string
+}
+
+// SavedRounds are saved on their own after every round announcement, since
+// saving the whole state that often would be slow.
+type SavedRounds struct {
+	ConvoRound uint32
+	DialRound  uint32
+}
+
+func OpenStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Store{
+		path:         filepath.Join(dir, "state.json"),
+		contactsPath: filepath.Join(dir, "contacts.json"),
+		roundsPath:   filepath.Join(dir, "rounds.json"),
+	}, nil
+}
+
+// LoadContacts returns the saved contacts. Cards that have expired
+// since they were imported are kept.
+func (s *Store) LoadContacts() (*SavedContacts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	saved := new(SavedContacts)
+	data, err := ioutil.ReadFile(s.contactsPath)
+	if os.IsNotExist(err) {
+		return saved, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, saved); err != nil {
+		return nil, fmt.Errorf("%s: %s", s.contactsPath, err)
+	}
+	return saved, nil
+}
+
+func (s *Store) SaveContacts(saved *SavedContacts) error {
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return writeFileAtomic(s.contactsPath, data, 0600)
+}
+
+func (s *Store) Load() (*ClientState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := &ClientState{
+		Conversations: make(map[string]*ConversationState),
+	}
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, err
+	}
+
+	data, err = ioutil.ReadFile(s.roundsPath)
+	if os.IsNotExist(err) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rounds := new(SavedRounds)
+	if err := json.Unmarshal(data, rounds); err != nil {
+		return nil, fmt.Errorf("%s: %s", s.roundsPath, err)
+	}
+	if rounds.ConvoRound > st.ConvoRound {
+		st.ConvoRound = rounds.ConvoRound
+	}
+	if rounds.DialRound > st.DialRound {
+		st.DialRound = rounds.DialRound
+	}
+	return st, nil
+}
+
+func (s *Store) Save(st *ClientState) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return writeFileAtomic(s.path, data, 0600)
+}
+
+func (s *Store) SaveRounds(rounds *SavedRounds) error {
+	data, err := json.Marshal(rounds)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return writeFileAtomic(s.roundsPath, data, 0600)
+}
+
+// writeFileAtomic replaces path with data such that a crash leaves
+// either the old file or the new file, never a partial one.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+	defer os.Remove(tmpPath)
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (c *Conversation) state() *ConversationState {
+	c.RLock()
+	defer c.RUnlock()
+
+	rounds := make([]int, 0, len(c.pendingRounds))
+	for round, pr := range c.pendingRounds {
+		if pr.texts != nil {
+			rounds = append(rounds, int(round))
+		}
+	}
+	sort.Ints(rounds)
+
+	st := new(ConversationState)
+	for _, round := range rounds {
+		st.Unacked = append(st.Unacked, c.pendingRounds[uint32(round)].texts...)
+	}
+	st.Queued = append(st.Queued, c.outQueue...)
+	return st
+}
+
+func (c *Conversation) restore(st *ConversationState) {
+	c.Lock()
+	queue := make([][]byte, 0, len(st.Unacked)+len(st.Queued)+len(c.outQueue))
+	for _, msg := range append(st.Unacked, st.Queued...) {
+		queue = append(queue, splitText(msg)...)
+	}
+	c.outQueue = append(queue, c.outQueue...)
+	c.Unlock()
+}
+
+func (d *Dialer) pending() (keys []*BoxKey, notes []string) {
+	d.Lock()
+	defer d.Unlock()
+
+	rounds := make([]int, 0, len(d.inflightRequests))
+	for round := range d.inflightRequests {
+		rounds = append(rounds, int(round))
+	}
+	sort.Ints(rounds)
+
+	reqs := make([]*outgoingDial, 0, len(rounds)+len(d.userDialRequests))
+	for _, round := range rounds {
+		reqs = append(reqs, d.inflightRequests[uint32(round)])
+	}
+	reqs = append(reqs, d.userDialRequests...)
+
+	hasNotes := false
+	for _, req := range reqs {
+		keys = append(keys, req.key)
+		notes = append(notes, req.note)
+		hasNotes = hasNotes || req.note != ""
+	}
+	if !hasNotes {
+		notes = nil
+	}
+	return keys, notes
+}
+
+func (d *Dialer) restore(keys []*BoxKey, notes []string) {
+	reqs := make([]*outgoingDial, len(keys))
+	for i, key := range keys {
+		reqs[i] = &outgoingDial{key: key}
+		if i < len(notes) {
+			reqs[i].note = notes[i]
+		}
+	}
+	d.Lock()
+	d.userDialRequests = append(reqs, d.userDialRequests...)
+	d.Unlock()
+}
+
+func (gc *GuiClient) snapshot() *ClientState {
+	st := &ClientState{
+		Conversations: make(map[string]*ConversationState),
+	}
+
+	gc.Lock()
+	if gc.selectedConvo != nil {
+		st.Selected = gc.selectedConvo.peerName
+	}
+	for peer, convo := range gc.conversations {
+		st.Conversations[peer] = convo.state()
+	}
+	gc.Unlock()
+
+	if gc.dialer != nil {
+		st.PendingDials, st.DialNotes = gc.dialer.pending()
+	}
+	st.ConvoRound, st.DialRound = gc.savedRounds[0], gc.savedRounds[1]
+	if gc.client != nil {
+		st.ConvoRound, st.DialRound = gc.client.Rounds()
+	}
+	return st
+}
+
+// saveRounds saves the rounds after every round announcement, before the
+// round is used, so a crash can't leave an old round open to replay.
+func (gc *GuiClient) saveRounds() {
+	if gc.store == nil {
+		return
+	}
+
+	// Rounds is read under roundsMu, so a slow save can't overwrite a
+	// later one.
+	gc.roundsMu.Lock()
+	defer gc.roundsMu.Unlock()
+	rounds := new(SavedRounds)
+	rounds.ConvoRound, rounds.DialRound = gc.client.Rounds()
+	if err := gc.store.SaveRounds(rounds); err != nil {
+		log.WithFields(log.Fields{"call": "SaveRounds"}).Error(err)
+	}
+}
+
+func (gc *GuiClient) SaveState() {
+	if gc.store == nil {
+		return
+	}
+
+	gc.saveMu.Lock()
+	defer gc.saveMu.Unlock()
+	if err := gc.store.Save(gc.snapshot()); err != nil {
+		log.WithFields(log.Fields{"call": "SaveState"}).Error(err)
+	}
+}
+
+func (gc *GuiClient) restoreState() {
+	selected := gc.myName
+	if gc.store != nil {
+		st, err := gc.store.Load()
+		if err != nil {
+			log.WithFields(log.Fields{"call": "LoadState"}).Error(err)
+		} else {
+			for peer, cs := range st.Conversations {
+				if convo := gc.conversation(peer); convo != nil {
+					convo.restore(cs)
+				}
+			}
+			gc.dialer.restore(st.PendingDials, st.DialNotes)
+			gc.savedRounds = [2]uint32{st.ConvoRound, st.DialRound}
+			if _, ok := gc.conversations[st.Selected]; ok {
+				selected = st.Selected
+			}
+		}
+	}
+	gc.switchConversation(selected)
+}
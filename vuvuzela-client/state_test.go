@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	. "github.com/davidlazar/vuvuzela"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vuvuzela-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := OpenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := store.Load()
+	if err != nil {
+		t.Fatalf("Load of missing state: %s", err)
+	}
+	if len(st.Conversations) != 0 {
+		t.Fatalf("expecting empty state")
+	}
+
+	st.Selected = "bob"
+	st.Conversations["bob"] = &ConversationState{
+		Unacked: [][]byte{[]byte("hello")},
+		Queued:  [][]byte{[]byte("are you there?")},
+	}
+	if err := store.Save(st); err != nil {
+		t.Fatalf("Save: %s", err)
+	}
+
+	xst, err := store.Load()
+	if err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+	if xst.Selected != "bob" {
+		t.Fatalf("expecting selected conversation bob, got %q", xst.Selected)
+	}
+	cs := xst.Conversations["bob"]
+	if cs == nil || len(cs.Unacked) != 1 || !bytes.Equal(cs.Queued[0], []byte("are you there?")) {
+		t.Fatalf("conversation state not restored: %#v", cs)
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Fatalf("expecting only the state file, found %d files", len(files))
+	}
+
+	// The rounds saved on their own win over older ones in the state.
+	st.ConvoRound, st.DialRound = 10, 20
+	if err := store.Save(st); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveRounds(&SavedRounds{ConvoRound: 15, DialRound: 5}); err != nil {
+		t.Fatal(err)
+	}
+	xst, err = store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if xst.ConvoRound != 15 || xst.DialRound != 20 {
+		t.Fatalf("expecting rounds 15 and 20, got %d and %d", xst.ConvoRound, xst.DialRound)
+	}
+}
+
+func TestConversationRestore(t *testing.T) {
+	convo := new(Conversation)
+	convo.Init()
+	convo.outQueue = [][]byte{[]byte("c")}
+	convo.restore(&ConversationState{
+		Unacked: [][]byte{[]byte("a")},
+		Queued:  [][]byte{[]byte("b")},
+	})
+	for _, want := range []string{"a", "b", "c"} {
+		if m := convo.dequeue(); string(m) != want {
+			t.Fatalf("expecting %q, got %q", want, m)
+		}
+	}
+	if convo.dequeue() != nil {
+		t.Fatalf("expecting empty queue")
+	}
+}
+
+func TestDialerRestore(t *testing.T) {
+	alice, _, _ := GenerateBoxKey(rand.Reader)
+	bob, _, _ := GenerateBoxKey(rand.Reader)
+
+	d := &Dialer{gui: new(GuiClient)}
+	d.Init()
+	if err := d.QueueRequest(alice, strings.Repeat("x", SizeIntroNote+1)); err == nil {
+		t.Fatalf("expecting long note to be rejected")
+	}
+	d.QueueRequest(alice, "")
+	d.QueueRequest(bob, "about the trip")
+
+	keys, notes := d.pending()
+	x := &Dialer{}
+	x.Init()
+	x.restore(keys, notes)
+	for _, want := range []*outgoingDial{{alice, ""}, {bob, "about the trip"}} {
+		req := x.nextRequest(1)
+		if *req.key != *want.key || req.note != want.note {
+			t.Fatalf("expecting %v, got %v", want, req)
+		}
+	}
+
+	// State saved before notes existed.
+	x.restore([]*BoxKey{alice}, nil)
+	if req := x.nextRequest(2); *req.key != *alice || req.note != "" {
+		t.Fatalf("unexpected request: %v", req)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/davidlazar/vuvuzela"
+)
+
+var errAborted = errors.New("round aborted by operator")
+
+type roundKey struct {
+	service string
+	round   uint32
+}
+
+type runningRound struct {
+	onions int
+	abort  chan struct{}
+}
+
+// runAbortable runs f for a round, returning early with errAborted if an
+// operator aborts the round. f keeps running in the background, but its
+// results are ignored.
+func (srv *server) runAbortable(service string, round uint32, onions int, f func() error) error {
+	key := roundKey{service, round}
+	rr := &runningRound{
+		onions: onions,
+		abort:  make(chan struct{}),
+	}
+	srv.runningMu.Lock()
+	srv.running[key] = rr
+	srv.runningMu.Unlock()
+
+	defer func() {
+		srv.runningMu.Lock()
+		delete(srv.running, key)
+		srv.runningMu.Unlock()
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- f()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-rr.abort:
+		return errAborted
+	}
+}
+
+// admin is the entry server's admin service for vuvuzelactl.
+type admin struct {
+	srv   *server
+	token string
+}
+
+func (a *admin) check(rpc string, args *AdminArgs) error {
+	if err := CheckAdminToken(a.token, args); err != nil {
+		log.WithFields(log.Fields{"service": "admin", "rpc": rpc}).Warn(err)
+		return err
+	}
+	log.WithFields(log.Fields{"service": "admin", "rpc": rpc, "round": args.Round}).Info(args.Service)
+	return nil
+}
+
+func (a *admin) setPaused(args *AdminArgs, paused int32) error {
+	switch args.Service {
+	case "convo":
+		atomic.StoreInt32(&a.srv.convoPaused, paused)
+	case "dial":
+		atomic.StoreInt32(&a.srv.dialPaused, paused)
+	case "":
+		atomic.StoreInt32(&a.srv.convoPaused, paused)
+		atomic.StoreInt32(&a.srv.dialPaused, paused)
+	default:
+		return fmt.Errorf("unknown service: %q", args.Service)
+	}
+	return nil
+}
+
+// Pause stops announcing new rounds. Rounds in progress finish.
+func (a *admin) Pause(args *AdminArgs, reply *AdminReply) error {
+	if err := a.check("Pause", args); err != nil {
+		return err
+	}
+	return a.setPaused(args, 1)
+}
+
+func (a *admin) Resume(args *AdminArgs, reply *AdminReply) error {
+	if err := a.check("Resume", args); err != nil {
+		return err
+	}
+	return a.setPaused(args, 0)
+}
+
+func (a *admin) Rounds(args *AdminArgs, reply *AdminReply) error {
+	if err := a.check("Rounds", args); err != nil {
+		return err
+	}
+	srv := a.srv
+
+	srv.convoMu.Lock()
+	reply.Rounds = append(reply.Rounds, AdminRound{Service: "convo", Round: srv.convoRound, Status: "collecting", Onions: len(srv.convoRequests)})
+	srv.convoMu.Unlock()
+	srv.dialMu.Lock()
+	reply.Rounds = append(reply.Rounds, AdminRound{Service: "dial", Round: srv.dialRound, Status: "collecting", Onions: len(srv.dialRequests)})
+	srv.dialMu.Unlock()
+
+	srv.runningMu.Lock()
+	for key, rr := range srv.running {
+		reply.Rounds = append(reply.Rounds, AdminRound{Service: key.service, Round: key.round, Status: "running", Onions: rr.onions})
+	}
+	srv.runningMu.Unlock()
+
+	sort.Slice(reply.Rounds, func(i, j int) bool {
+		return reply.Rounds[i].Round < reply.Rounds[j].Round
+	})
+	convoPaused := atomic.LoadInt32(&srv.convoPaused) != 0
+	dialPaused := atomic.LoadInt32(&srv.dialPaused) != 0
+	if convoPaused || dialPaused {
+		reply.Message = fmt.Sprintf("paused: convo=%v dial=%v", convoPaused, dialPaused)
+	}
+	return nil
+}
+
+// Abort stops waiting for a running round and tells its clients it
+// failed. Use it together with Abort on the mix servers.
+func (a *admin) Abort(args *AdminArgs, reply *AdminReply) error {
+	if err := a.check("Abort", args); err != nil {
+		return err
+	}
+
+	srv := a.srv
+	srv.runningMu.Lock()
+	rr, ok := srv.running[roundKey{args.Service, args.Round}]
+	if ok {
+		delete(srv.running, roundKey{args.Service, args.Round})
+	}
+	srv.runningMu.Unlock()
+	if !ok {
+		return fmt.Errorf("no running %s round %d", args.Service, args.Round)
+	}
+	close(rr.abort)
+	reply.Message = fmt.Sprintf("aborted %s round %d", args.Service, args.Round)
+	return nil
+}
+
+func (a *admin) Clients(args *AdminArgs, reply *AdminReply) error {
+	if err := a.check("Clients", args); err != nil {
+		return err
+	}
+	a.srv.connectionsMu.Lock()
+	reply.Clients = len(a.srv.connections)
+	a.srv.connectionsMu.Unlock()
+	return nil
+}
+
+func (a *admin) ReloadPKI(args *AdminArgs, reply *AdminReply) error {
+	if err := a.check("ReloadPKI", args); err != nil {
+		return err
+	}
+
+	pki, err := LoadPKI(*pkiPath)
+	if err != nil {
+		return err
+	}
+	if err := SameServers(a.srv.getPKI(), pki); err != nil {
+		return err
+	}
+	a.srv.setPKI(pki)
+	reply.Message = fmt.Sprintf("loaded %s (epoch %d)", *pkiPath, pki.Epoch)
+	return nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/davidlazar/vuvuzela"
+)
+
+// Requests are small; this is generous.
+const maxHTTPRequestSize = 1 << 20
+
+func (srv *server) httpConnectHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	pk, err := KeyFromString(r.URL.Query().Get("publickey"))
+	if err != nil {
+		http.Error(w, "expecting box key in publickey query parameter", http.StatusBadRequest)
+		return
+	}
+
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		log.WithFields(log.Fields{"call": "rand.Read"}).Error(err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	c := newConnection(srv, nil, pk)
+	c.session = hex.EncodeToString(id[:])
+	c.lastPoll = time.Now().UnixNano()
+	c.firstSeq = 1
+	srv.connectionsMu.Lock()
+	srv.sessions[c.session] = c
+	srv.connectionsMu.Unlock()
+	srv.register(c)
+	go c.expireLoop()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&HTTPSession{Session: c.session})
+}
+
+// httpSession looks up the session named in the request, or writes an
+// error and returns nil.
+func (srv *server) httpSession(w http.ResponseWriter, r *http.Request, method string) *connection {
+	if r.Method != method {
+		http.Error(w, "Method not allowed", 405)
+		return nil
+	}
+	srv.connectionsMu.Lock()
+	c := srv.sessions[r.URL.Query().Get("session")]
+	srv.connectionsMu.Unlock()
+	if c == nil {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return nil
+	}
+	return c
+}
+
+func (srv *server) httpSendHandler(w http.ResponseWriter, r *http.Request) {
+	c := srv.httpSession(w, r, "POST")
+	if c == nil {
+		return
+	}
+
+	var e Envelope
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxHTTPRequestSize)).Decode(&e); err != nil {
+		http.Error(w, "expecting an envelope", http.StatusBadRequest)
+		return
+	}
+	c.receive(&e)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// httpRecvHandler forgets the envelopes acknowledged by the after
+// parameter, waits up to HTTPPollWait if there is nothing else to send,
+// then returns every unacknowledged envelope. Envelopes lost with a
+// dropped response, or taken by a racing poll, go out again on the next
+// poll.
+func (srv *server) httpRecvHandler(w http.ResponseWriter, r *http.Request) {
+	c := srv.httpSession(w, r, "GET")
+	if c == nil {
+		return
+	}
+	var after uint64
+	if s := r.URL.Query().Get("after"); s != "" {
+		var err error
+		if after, err = strconv.ParseUint(s, 10, 64); err != nil {
+			http.Error(w, "bad after parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	atomic.StoreInt64(&c.lastPoll, time.Now().UnixNano())
+	defer atomic.StoreInt64(&c.lastPoll, time.Now().UnixNano())
+
+	if !c.ack(after) {
+		timer := time.NewTimer(HTTPPollWait)
+		defer timer.Stop()
+		select {
+		case e := <-c.out:
+			c.pollMu.Lock()
+			c.hold(e)
+			c.pollMu.Unlock()
+		case <-timer.C:
+		case <-c.done:
+			http.Error(w, "session closed", http.StatusGone)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(c.pending()); err != nil {
+		log.WithFields(log.Fields{"call": "httpRecv"}).Debug(err)
+		writeErrors.Add(1)
+	}
+}
+
+// ack forgets the envelopes up to sequence number after, and reports
+// whether any are still unacknowledged.
+func (c *connection) ack(after uint64) bool {
+	c.pollMu.Lock()
+	defer c.pollMu.Unlock()
+	for len(c.unacked) > 0 && c.firstSeq <= after {
+		c.unacked = c.unacked[1:]
+		c.firstSeq++
+	}
+	return len(c.unacked) > 0
+}
+
+// hold adds e to the unacknowledged envelopes. c.pollMu must be held.
+func (c *connection) hold(e *Envelope) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.WithFields(log.Fields{"bug": true, "call": "json.Marshal"}).Error(err)
+		return
+	}
+	c.unacked = append(c.unacked, data)
+	messagesSent.Add(1)
+}
+
+// pending moves what's queued behind the unacknowledged envelopes, up to
+// the size of the queue, and returns all of them. Once they reach that
+// size the queue fills up and -slowpolicy applies.
+func (c *connection) pending() *HTTPBatch {
+	c.pollMu.Lock()
+	defer c.pollMu.Unlock()
+drain:
+	for len(c.unacked) < cap(c.out) {
+		select {
+		case e := <-c.out:
+			c.hold(e)
+		default:
+			break drain
+		}
+	}
+	return &HTTPBatch{
+		First:     c.firstSeq,
+		Envelopes: append([]json.RawMessage{}, c.unacked...),
+	}
+}
+
+func (srv *server) httpCloseHandler(w http.ResponseWriter, r *http.Request) {
+	c := srv.httpSession(w, r, "POST")
+	if c == nil {
+		return
+	}
+	c.Close()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// expireLoop closes an HTTP session once its client stops polling.
+func (c *connection) expireLoop() {
+	ticker := time.NewTicker(HTTPSessionTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			last := time.Unix(0, atomic.LoadInt64(&c.lastPoll))
+			if time.Since(last) > HTTPSessionTimeout {
+				log.WithFields(log.Fields{"call": "expireLoop"}).Debug("closing idle HTTP session")
+				c.Close()
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// Clients and the first server reject rounds that don't increase, so
+// the entry server keeps the next rounds it may use in a file, and a
+// restart picks up after them.
+type nextRounds struct {
+	Convo uint32
+	Dial  uint32
+}
+
+type roundsFile struct {
+	mu   sync.Mutex
+	path string
+	next nextRounds
+}
+
+// openRoundsFile reads the rounds kept at path, if it exists. With an
+// empty path the rounds are only kept in memory.
+func openRoundsFile(path string) (*roundsFile, error) {
+	f := &roundsFile{path: path}
+	if path == "" {
+		return f, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &f.next); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return f, nil
+}
+
+// firstRounds starts from the saved rounds, or from the clock if it is
+// ahead of them (or there are none).
+func (f *roundsFile) firstRounds(now time.Time) (convo, dial uint32) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	clock := uint32(now.Unix())
+	convo, dial = f.next.Convo, f.next.Dial
+	if convo < clock {
+		convo = clock
+	}
+	if dial < clock {
+		dial = clock
+	}
+	return convo, dial
+}
+
+// reserve records that the service's rounds before next may have been
+// used. It must succeed before a round is announced.
+func (f *roundsFile) reserve(service string, next uint32) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch service {
+	case "convo":
+		f.next.Convo = next
+	case "dial":
+		f.next.Dial = next
+	}
+	if f.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(&f.next)
+	if err != nil {
+		return err
+	}
+	tmp := f.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path)
+}
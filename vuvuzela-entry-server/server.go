@@ -1,11 +1,19 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/json"
+	"expvar"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/rpc"
 	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -13,23 +21,45 @@ import (
 
 	. "github.com/davidlazar/vuvuzela"
 	. "github.com/davidlazar/vuvuzela/internal"
+	"github.com/davidlazar/vuvuzela/internal/workpool"
 	"github.com/davidlazar/vuvuzela/vrpc"
 )
 
 type server struct {
 	connectionsMu sync.Mutex
 	connections   map[*connection]bool
+	sessions      map[string]*connection
 
 	convoMu       sync.Mutex
 	convoRound    uint32
 	convoRequests []*convoReq
+	convoSenders  map[*connection]bool
+	convoInflight int32
 
 	dialMu       sync.Mutex
 	dialRound    uint32
 	dialRequests []*dialReq
 
+	rounds *roundsFile
+
+	// buckets from the last DialHistoryRounds rounds
+	dialHistoryMu sync.Mutex
+	dialHistory   map[uint32][][][SizeEncryptedIntro]byte
+
+	convoPaused int32
+	dialPaused  int32
+
+	runningMu sync.Mutex
+	running   map[roundKey]*runningRound
+
+	pkiMu       sync.Mutex
+	pki         *PKI
 	firstServer *vrpc.Client
 	lastServer  *vrpc.Client
+
+	selfTestMu        sync.Mutex
+	nextConvoSelfTest time.Time
+	nextDialSelfTest  time.Time
 }
 
 type convoReq struct {
@@ -43,11 +73,56 @@ type dialReq struct {
 }
 
 type connection struct {
-	sync.Mutex
-
-	ws        *websocket.Conn
+	ws        *websocket.Conn // nil for HTTP sessions
 	srv       *server
 	publicKey *BoxKey
+
+	// session and lastPoll (unix nanoseconds) are for HTTP sessions
+	session  string
+	lastPoll int64
+
+	// unacked holds the envelopes sent to an HTTP session that it hasn't
+	// acknowledged yet; unacked[0] has sequence number firstSeq.
+	pollMu   sync.Mutex
+	unacked  []json.RawMessage
+	firstSeq uint64
+
+	// bucketRequests counts DialBucketRequests, which a client only
+	// sends once per retained round after it connects.
+	bucketRequests int32
+
+	// out is drained by writeLoop so a slow client can't hold up
+	// deliveries to everyone else.
+	out       chan *Envelope
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Exported at /debug/vars.
+var (
+	messagesQueued     = expvar.NewInt("MessagesQueued")
+	messagesSent       = expvar.NewInt("MessagesSent")
+	messagesDropped    = expvar.NewInt("MessagesDropped")
+	connectionsEvicted = expvar.NewInt("ConnectionsEvicted")
+	writeErrors        = expvar.NewInt("WriteErrors")
+	convoRejected      = expvar.NewInt("ConvoRejected")
+	bucketFloods       = expvar.NewInt("BucketFloods")
+)
+
+func init() {
+	expvar.Publish("WorkPool", expvar.Func(func() interface{} {
+		return workpool.Default.Stats()
+	}))
+}
+
+func newConnection(srv *server, ws *websocket.Conn, publicKey *BoxKey) *connection {
+	return &connection{
+		ws:        ws,
+		srv:       srv,
+		publicKey: publicKey,
+		out:       make(chan *Envelope, *outQueueSize),
+		done:      make(chan struct{}),
+	}
 }
 
 func (srv *server) register(c *connection) {
@@ -69,39 +144,85 @@ func (srv *server) allConnections() []*connection {
 }
 
 func broadcast(conns []*connection, v interface{}) {
-	ParallelFor(len(conns), func(p *P) {
-		for i, ok := p.Next(); ok; i, ok = p.Next() {
-			conns[i].Send(v)
-		}
-	})
+	e, err := Envelop(v)
+	if err != nil {
+		log.WithFields(log.Fields{"bug": true, "call": "Envelop"}).Error(err)
+		return
+	}
+	for _, c := range conns {
+		c.enqueue(e)
+	}
 }
 
 func (c *connection) Close() {
-	c.ws.Close()
+	c.closeOnce.Do(func() {
+		close(c.done)
+		if c.ws != nil {
+			c.ws.Close()
+		}
 
-	c.srv.connectionsMu.Lock()
-	delete(c.srv.connections, c)
-	c.srv.connectionsMu.Unlock()
+		c.srv.connectionsMu.Lock()
+		delete(c.srv.connections, c)
+		if c.session != "" {
+			delete(c.srv.sessions, c.session)
+		}
+		c.srv.connectionsMu.Unlock()
+	})
 }
 
 func (c *connection) Send(v interface{}) {
-	const writeWait = 10 * time.Second
-
 	e, err := Envelop(v)
 	if err != nil {
 		log.WithFields(log.Fields{"bug": true, "call": "Envelop"}).Error(err)
 		return
 	}
+	c.enqueue(e)
+}
 
-	c.Lock()
-	c.ws.SetWriteDeadline(time.Now().Add(writeWait))
-	if err := c.ws.WriteJSON(e); err != nil {
-		log.WithFields(log.Fields{"call": "WriteJSON"}).Debug(err)
-		c.Unlock()
-		c.Close()
+// enqueue never blocks. When the client's queue is full, the -slowpolicy
+// flag decides whether to drop the message or disconnect the client.
+func (c *connection) enqueue(e *Envelope) {
+	select {
+	case <-c.done:
 		return
+	default:
+	}
+
+	select {
+	case c.out <- e:
+		messagesQueued.Add(1)
+		return
+	default:
+	}
+
+	if *slowPolicy == "evict" {
+		connectionsEvicted.Add(1)
+		log.WithFields(log.Fields{"call": "enqueue"}).Info("evicting slow client")
+		c.Close()
+	} else {
+		messagesDropped.Add(1)
+		log.WithFields(log.Fields{"call": "enqueue", "type": e.Type}).Debug("dropping message for slow client")
+	}
+}
+
+func (c *connection) writeLoop() {
+	const writeWait = 10 * time.Second
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case e := <-c.out:
+			c.ws.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.ws.WriteJSON(e); err != nil {
+				log.WithFields(log.Fields{"call": "WriteJSON"}).Debug(err)
+				writeErrors.Add(1)
+				c.Close()
+				return
+			}
+			messagesSent.Add(1)
+		}
 	}
-	c.Unlock()
 }
 
 func (c *connection) readLoop() {
@@ -112,14 +233,18 @@ func (c *connection) readLoop() {
 			c.Close()
 			break
 		}
+		c.receive(&e)
+	}
+}
 
-		v, err := e.Open()
-		if err != nil {
-			msg := fmt.Sprintf("error parsing request: %s", err)
-			go c.Send(&BadRequestError{Err: msg})
-		}
-		go c.handleRequest(v)
+func (c *connection) receive(e *Envelope) {
+	v, err := e.Open()
+	if err != nil {
+		msg := fmt.Sprintf("error parsing request: %s", err)
+		c.Send(&BadRequestError{Err: msg})
+		return
 	}
+	go c.handleRequest(v)
 }
 
 func (c *connection) handleRequest(v interface{}) {
@@ -128,6 +253,8 @@ func (c *connection) handleRequest(v interface{}) {
 		c.handleConvoRequest(v)
 	case *DialRequest:
 		c.handleDialRequest(v)
+	case *DialBucketRequest:
+		c.handleDialBucketRequest(v)
 	}
 }
 
@@ -138,9 +265,15 @@ func (c *connection) handleConvoRequest(r *ConvoRequest) {
 	if r.Round != currRound {
 		srv.convoMu.Unlock()
 		err := fmt.Sprintf("wrong round (currently %d)", currRound)
-		go c.Send(&ConvoError{Round: r.Round, Err: err})
+		c.Send(&ConvoError{Round: r.Round, Err: err})
+		return
+	}
+	if srv.convoSenders[c] {
+		srv.convoMu.Unlock()
+		c.Send(&ConvoError{Round: r.Round, Err: "one request per round"})
 		return
 	}
+	srv.convoSenders[c] = true
 	rr := &convoReq{
 		conn:  c,
 		onion: r.Onion,
@@ -156,7 +289,7 @@ func (c *connection) handleDialRequest(r *DialRequest) {
 	if r.Round != currRound {
 		srv.dialMu.Unlock()
 		err := fmt.Sprintf("wrong round (currently %d)", currRound)
-		go c.Send(&DialError{Round: r.Round, Err: err})
+		c.Send(&DialError{Round: r.Round, Err: err})
 		return
 	}
 	rr := &dialReq{
@@ -167,16 +300,82 @@ func (c *connection) handleDialRequest(r *DialRequest) {
 	srv.dialMu.Unlock()
 }
 
+func (c *connection) handleDialBucketRequest(r *DialBucketRequest) {
+	// A retained bucket is much bigger than the request for it, so a
+	// client asking for more than it could catch up on is disconnected.
+	if atomic.AddInt32(&c.bucketRequests, 1) > DialHistoryRounds {
+		bucketFloods.Add(1)
+		log.WithFields(log.Fields{"call": "handleDialBucketRequest"}).Info("too many bucket requests, disconnecting client")
+		c.Close()
+		return
+	}
+
+	srv := c.srv
+	srv.dialHistoryMu.Lock()
+	buckets, ok := srv.dialHistory[r.Round]
+	srv.dialHistoryMu.Unlock()
+	if !ok {
+		c.Send(&DialError{Round: r.Round, Err: "round not retained"})
+		return
+	}
+
+	bi := KeyDialBucket(c.publicKey, TotalDialBuckets)
+	c.Send(&DialBucket{
+		Round:    r.Round,
+		Intros:   buckets[bi],
+		Retained: true,
+	})
+}
+
+func (srv *server) retainDialBuckets(round uint32, buckets [][][SizeEncryptedIntro]byte) {
+	srv.dialHistoryMu.Lock()
+	defer srv.dialHistoryMu.Unlock()
+
+	srv.dialHistory[round] = buckets
+	for r := range srv.dialHistory {
+		if r+DialHistoryRounds <= round {
+			delete(srv.dialHistory, r)
+		}
+	}
+}
+
+func (srv *server) getPKI() *PKI {
+	srv.pkiMu.Lock()
+	defer srv.pkiMu.Unlock()
+	return srv.pki
+}
+
+func (srv *server) setPKI(pki *PKI) {
+	srv.pkiMu.Lock()
+	srv.pki = pki
+	srv.pkiMu.Unlock()
+}
+
 func (srv *server) convoRoundLoop() {
 	for {
-		if err := NewConvoRound(srv.firstServer, srv.convoRound); err != nil {
+		if atomic.LoadInt32(&srv.convoPaused) != 0 {
+			time.Sleep(time.Second)
+			continue
+		}
+		if err := srv.rounds.reserve("convo", srv.convoRound+1); err != nil {
+			log.WithFields(log.Fields{"service": "convo", "round": srv.convoRound, "call": "reserve"}).Error(err)
+			time.Sleep(10 * time.Second)
+			continue
+		}
+		sig, err := NewConvoRound(srv.firstServer, srv.convoRound)
+		if err != nil {
 			log.WithFields(log.Fields{"service": "convo", "round": srv.convoRound, "call": "NewConvoRound"}).Error(err)
 			time.Sleep(10 * time.Second)
 			continue
 		}
 		log.WithFields(log.Fields{"service": "convo", "round": srv.convoRound}).Info("Broadcast")
 
-		broadcast(srv.allConnections(), &AnnounceConvoRound{srv.convoRound})
+		broadcast(srv.allConnections(), &AnnounceConvoRound{
+			Round:     srv.convoRound,
+			Epoch:     sig.Epoch,
+			Timestamp: sig.Timestamp,
+			Signature: sig.Signature,
+		})
 		time.Sleep(*receiveWait)
 
 		srv.convoMu.Lock()
@@ -184,6 +383,7 @@ func (srv *server) convoRoundLoop() {
 
 		srv.convoRound += 1
 		srv.convoRequests = make([]*convoReq, 0, len(srv.convoRequests))
+		srv.convoSenders = make(map[*connection]bool)
 		srv.convoMu.Unlock()
 	}
 }
@@ -191,14 +391,29 @@ func (srv *server) convoRoundLoop() {
 func (srv *server) dialRoundLoop() {
 	for {
 		time.Sleep(DialWait)
-		if err := NewDialRound(srv.firstServer, srv.dialRound); err != nil {
+		if atomic.LoadInt32(&srv.dialPaused) != 0 {
+			continue
+		}
+		if err := srv.rounds.reserve("dial", srv.dialRound+1); err != nil {
+			log.WithFields(log.Fields{"service": "dial", "round": srv.dialRound, "call": "reserve"}).Error(err)
+			time.Sleep(10 * time.Second)
+			continue
+		}
+		sig, err := NewDialRound(srv.firstServer, srv.dialRound)
+		if err != nil {
 			log.WithFields(log.Fields{"service": "dial", "round": srv.dialRound, "call": "NewDialRound"}).Error(err)
 			time.Sleep(10 * time.Second)
 			continue
 		}
 		log.WithFields(log.Fields{"service": "dial", "round": srv.dialRound}).Info("Broadcast")
 
-		broadcast(srv.allConnections(), &AnnounceDialRound{srv.dialRound, TotalDialBuckets})
+		broadcast(srv.allConnections(), &AnnounceDialRound{
+			Round:     srv.dialRound,
+			Buckets:   TotalDialBuckets,
+			Epoch:     sig.Epoch,
+			Timestamp: sig.Timestamp,
+			Signature: sig.Signature,
+		})
 		time.Sleep(*receiveWait)
 
 		srv.dialMu.Lock()
@@ -210,7 +425,77 @@ func (srv *server) dialRoundLoop() {
 	}
 }
 
+func (srv *server) selfTestDue(next *time.Time) bool {
+	srv.selfTestMu.Lock()
+	defer srv.selfTestMu.Unlock()
+
+	now := time.Now()
+	if next.IsZero() || (*selfTestInterval > 0 && !now.Before(*next)) {
+		*next = now.Add(*selfTestInterval)
+		return true
+	}
+	return false
+}
+
+func reportSelfTest(rlog *log.Entry, err error) {
+	if err != nil {
+		rlog.WithFields(log.Fields{"call": "SelfTest"}).Error(err)
+	} else {
+		rlog.WithFields(log.Fields{"call": "SelfTest"}).Info("OK")
+	}
+}
+
+// admit sheds load when more clients show up than the chain can handle.
+// The limit halves for every extra round queued at the entry server or
+// any mix server. Clients are turned away uniformly at random, so arriving
+// early doesn't help, and are told how many rounds to sit out.
+func (srv *server) admit(rlog *log.Entry, round uint32, requests []*convoReq) []*convoReq {
+	if *capacity <= 0 {
+		return requests
+	}
+
+	backlog := int(atomic.LoadInt32(&srv.convoInflight))
+	if b, err := ConvoBacklog(srv.firstServer, round); err != nil {
+		rlog.WithFields(log.Fields{"call": "ConvoBacklog"}).Error(err)
+	} else if b > backlog {
+		backlog = b
+	}
+
+	limit := *capacity
+	for i := 1; i < backlog && limit > 1; i++ {
+		limit /= 2
+	}
+	if len(requests) <= limit {
+		return requests
+	}
+
+	for i := len(requests) - 1; i > 0; i-- {
+		j := Intn(rand.Reader, i+1)
+		requests[i], requests[j] = requests[j], requests[i]
+	}
+	admitted, rejected := requests[:limit], requests[limit:]
+
+	const maxRetryAfter = 16
+	retryAfter := backlog + len(rejected)/limit
+	if retryAfter > maxRetryAfter {
+		retryAfter = maxRetryAfter
+	}
+	rlog.WithFields(log.Fields{"call": "admit", "backlog": backlog, "limit": limit, "rejected": len(rejected)}).Warn("Shedding load")
+	convoRejected.Add(int64(len(rejected)))
+
+	for _, r := range rejected {
+		r.conn.Send(&ConvoError{Round: round, Err: "server overloaded", RetryAfter: uint32(retryAfter)})
+	}
+	return admitted
+}
+
 func (srv *server) runConvoRound(round uint32, requests []*convoReq) {
+	atomic.AddInt32(&srv.convoInflight, 1)
+	defer atomic.AddInt32(&srv.convoInflight, -1)
+
+	rlog := log.WithFields(log.Fields{"service": "convo", "round": round})
+	requests = srv.admit(rlog, round, requests)
+
 	conns := make([]*connection, len(requests))
 	onions := make([][]byte, len(requests))
 	for i, r := range requests {
@@ -218,26 +503,42 @@ func (srv *server) runConvoRound(round uint32, requests []*convoReq) {
 		onions[i] = r.onion
 	}
 
-	rlog := log.WithFields(log.Fields{"service": "convo", "round": round})
+	var probe *ConvoProbe
+	if srv.selfTestDue(&srv.nextConvoSelfTest) {
+		probe = NewConvoProbe(srv.getPKI(), round)
+		onions = append(onions, probe.Onion)
+	}
+
 	rlog.WithFields(log.Fields{"call": "RunConvoRound", "onions": len(onions)}).Info()
 
-	replies, err := RunConvoRound(srv.firstServer, round, onions)
+	var replies [][]byte
+	err := srv.runAbortable("convo", round, len(onions), func() error {
+		var err error
+		replies, err = RunConvoRound(srv.firstServer, round, onions)
+		return err
+	})
 	if err != nil {
 		rlog.WithFields(log.Fields{"call": "RunConvoRound"}).Error(err)
-		broadcast(conns, &ConvoError{Round: round, Err: "server error"})
+		if probe != nil {
+			reportSelfTest(rlog, fmt.Errorf("convo round failed: %s", err))
+		}
+		broadcast(conns, &ConvoError{Round: round, Err: roundError(err)})
 		return
 	}
 
+	if probe != nil {
+		reportSelfTest(rlog, probe.Check(replies[len(conns)]))
+		replies = replies[:len(conns)]
+	}
+
 	rlog.WithFields(log.Fields{"replies": len(replies)}).Info("Success")
 
-	ParallelFor(len(replies), func(p *P) {
-		for i, ok := p.Next(); ok; i, ok = p.Next() {
-			reply := &ConvoResponse{
-				Round: round,
-				Onion: replies[i],
-			}
-			conns[i].Send(reply)
+	workpool.For("entry/convo", len(replies), func(i int) {
+		reply := &ConvoResponse{
+			Round: round,
+			Onion: replies[i],
 		}
+		conns[i].Send(reply)
 	})
 }
 
@@ -250,19 +551,32 @@ func (srv *server) runDialRound(round uint32, requests []*dialReq) {
 	}
 
 	rlog := log.WithFields(log.Fields{"service": "dial", "round": round})
-	rlog.WithFields(log.Fields{"call": "RunDialRound", "onions": len(onions)}).Info()
 
-	if err := RunDialRound(srv.firstServer, round, onions); err != nil {
-		rlog.WithFields(log.Fields{"call": "RunDialRound"}).Error(err)
-		broadcast(conns, &DialError{Round: round, Err: "server error"})
-		return
+	var probe *DialProbe
+	if srv.selfTestDue(&srv.nextDialSelfTest) {
+		probe = NewDialProbe(srv.getPKI(), round, TotalDialBuckets)
+		onions = append(onions, probe.Onion)
 	}
 
-	args := &DialBucketsArgs{Round: round}
+	rlog.WithFields(log.Fields{"call": "RunDialRound", "onions": len(onions)}).Info()
+
 	result := new(DialBucketsResult)
-	if err := srv.lastServer.Call("DialService.Buckets", args, result); err != nil {
-		rlog.WithFields(log.Fields{"call": "Buckets"}).Error(err)
-		broadcast(conns, &DialError{Round: round, Err: "server error"})
+	err := srv.runAbortable("dial", round, len(onions), func() error {
+		if err := RunDialRound(srv.firstServer, round, onions); err != nil {
+			return err
+		}
+		args := &DialBucketsArgs{Round: round}
+		if err := srv.lastServer.Call("DialService.Buckets", args, result); err != nil {
+			return fmt.Errorf("Buckets: %s", err)
+		}
+		return nil
+	})
+	if err != nil {
+		rlog.WithFields(log.Fields{"call": "RunDialRound"}).Error(err)
+		if probe != nil {
+			reportSelfTest(rlog, fmt.Errorf("dial round failed: %s", err))
+		}
+		broadcast(conns, &DialError{Round: round, Err: roundError(err)})
 		return
 	}
 
@@ -272,20 +586,31 @@ func (srv *server) runDialRound(round uint32, requests []*dialReq) {
 	}
 	rlog.WithFields(log.Fields{"buckets": len(result.Buckets), "intros": intros}).Info("Buckets")
 
-	ParallelFor(len(conns), func(p *P) {
-		for i, ok := p.Next(); ok; i, ok = p.Next() {
-			c := conns[i]
-			bi := KeyDialBucket(c.publicKey, TotalDialBuckets)
+	if probe != nil {
+		reportSelfTest(rlog, probe.Check(result.Buckets))
+	}
 
-			db := &DialBucket{
-				Round:  round,
-				Intros: result.Buckets[bi],
-			}
-			c.Send(db)
+	srv.retainDialBuckets(round, result.Buckets)
+
+	workpool.For("entry/dial", len(conns), func(i int) {
+		c := conns[i]
+		bi := KeyDialBucket(c.publicKey, TotalDialBuckets)
+
+		db := &DialBucket{
+			Round:  round,
+			Intros: result.Buckets[bi],
 		}
+		c.Send(db)
 	})
 }
 
+func roundError(err error) string {
+	if err == errAborted {
+		return "round aborted"
+	}
+	return "server error"
+}
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
@@ -309,23 +634,32 @@ func (srv *server) wsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	c := &connection{
-		ws:        ws,
-		srv:       srv,
-		publicKey: pk,
-	}
+	c := newConnection(srv, ws, pk)
 	srv.register(c)
+	go c.writeLoop()
 	c.readLoop()
 }
 
 var addr = flag.String("addr", ":8080", "http service address")
 var pkiPath = flag.String("pki", "confs/pki.conf", "pki file")
 var receiveWait = flag.Duration("wait", DefaultReceiveWait, "")
+var roundsPath = flag.String("rounds", "confs/entry.rounds", "file that keeps the next rounds across restarts (\"\" keeps them in memory)")
+var selfTestInterval = flag.Duration("selftest", 10*time.Minute, "interval between chain self-tests (0 tests only at startup)")
+var outQueueSize = flag.Int("outqueue", 64, "messages queued per client before the slow client policy applies")
+var adminAddr = flag.String("admin", "", "admin RPC address for vuvuzelactl (disabled by default)")
+var adminTokenPath = flag.String("admintoken", "", "file containing the admin token")
+var adminRemote = flag.Bool("adminremote", false, "allow a non-loopback -admin address (the admin RPC is not encrypted)")
+var capacity = flag.Int("capacity", 0, "most convo requests admitted per round, shrinking when the chain falls behind (0 is unlimited)")
+var slowPolicy = flag.String("slowpolicy", "drop", "what to do when a client's queue is full: drop (the message) or evict (the client)")
 
 func main() {
 	flag.Parse()
 	log.SetFormatter(&ServerFormatter{})
 
+	if *slowPolicy != "drop" && *slowPolicy != "evict" {
+		log.Fatalf("unknown -slowpolicy: %q", *slowPolicy)
+	}
+
 	pki := ReadPKI(*pkiPath)
 
 	firstServer, err := vrpc.Dial("tcp", pki.FirstServer(), runtime.NumCPU())
@@ -338,20 +672,62 @@ func main() {
 		log.Fatalf("vrpc.Dial: %s", err)
 	}
 
+	rounds, err := openRoundsFile(*roundsPath)
+	if err != nil {
+		log.Fatalf("reading rounds: %s", err)
+	}
+	convoRound, dialRound := rounds.firstRounds(time.Now())
+
 	srv := &server{
+		pki:           pki,
 		firstServer:   firstServer,
 		lastServer:    lastServer,
 		connections:   make(map[*connection]bool),
-		convoRound:    0,
+		sessions:      make(map[string]*connection),
+		convoRound:    convoRound,
 		convoRequests: make([]*convoReq, 0, 10000),
-		dialRound:     0,
+		convoSenders:  make(map[*connection]bool),
+		dialRound:     dialRound,
 		dialRequests:  make([]*dialReq, 0, 10000),
+		dialHistory:   make(map[uint32][][][SizeEncryptedIntro]byte),
+		running:       make(map[roundKey]*runningRound),
+		rounds:        rounds,
+	}
+
+	if *adminAddr != "" {
+		if err := CheckAdminAddr(*adminAddr); err != nil {
+			if !*adminRemote {
+				log.Fatalf("%s (use -adminremote to allow it)", err)
+			}
+			log.Warnf("-adminremote: %s; anyone on the path can take over this server", err)
+		}
+		token, err := ioutil.ReadFile(*adminTokenPath)
+		if err != nil {
+			log.Fatalf("reading admin token: %s", err)
+		}
+		a := &admin{srv: srv, token: strings.TrimSpace(string(token))}
+		if a.token == "" {
+			log.Fatalf("empty admin token: %s", *adminTokenPath)
+		}
+		adminServer := rpc.NewServer()
+		if err := adminServer.RegisterName("Admin", a); err != nil {
+			log.Fatalf("rpc.Register: %s", err)
+		}
+		adminListen, err := net.Listen("tcp", *adminAddr)
+		if err != nil {
+			log.Fatal("Listen:", err)
+		}
+		go adminServer.Accept(adminListen)
 	}
 
 	go srv.convoRoundLoop()
 	go srv.dialRoundLoop()
 
 	http.HandleFunc("/ws", srv.wsHandler)
+	http.HandleFunc(HTTPConnectPath, srv.httpConnectHandler)
+	http.HandleFunc(HTTPSendPath, srv.httpSendHandler)
+	http.HandleFunc(HTTPRecvPath, srv.httpRecvHandler)
+	http.HandleFunc(HTTPClosePath, srv.httpCloseHandler)
 
 	httpServer := &http.Server{
 		Addr: *addr,
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	. "github.com/davidlazar/vuvuzela"
+)
+
+func testServer() *server {
+	return &server{
+		connections: make(map[*connection]bool),
+		sessions:    make(map[string]*connection),
+	}
+}
+
+// setSlowPolicy changes the flags and returns a func that restores them.
+func setSlowPolicy(policy string, queueSize int) func() {
+	oldPolicy, oldSize := *slowPolicy, *outQueueSize
+	*slowPolicy, *outQueueSize = policy, queueSize
+	return func() {
+		*slowPolicy, *outQueueSize = oldPolicy, oldSize
+	}
+}
+
+func isClosed(c *connection) bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestSlowPolicyDrop(t *testing.T) {
+	defer setSlowPolicy("drop", 2)()
+	srv := testServer()
+	public, _, _ := GenerateBoxKey(rand.Reader)
+	c := newConnection(srv, nil, public)
+	srv.register(c)
+
+	dropped := messagesDropped.Value()
+	for i := uint32(0); i < 3; i++ {
+		c.Send(&AnnounceConvoRound{Round: i})
+	}
+	if len(c.out) != 2 {
+		t.Fatalf("expecting a full queue of 2, got %d", len(c.out))
+	}
+	if n := messagesDropped.Value() - dropped; n != 1 {
+		t.Fatalf("expecting 1 dropped message, got %d", n)
+	}
+	if isClosed(c) || len(srv.allConnections()) != 1 {
+		t.Fatalf("drop policy disconnected the client")
+	}
+
+	// The oldest messages are kept.
+	e := <-c.out
+	v, err := e.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, ok := v.(*AnnounceConvoRound); !ok || a.Round != 0 {
+		t.Fatalf("unexpected first message: %#v", v)
+	}
+}
+
+func TestSlowPolicyEvict(t *testing.T) {
+	defer setSlowPolicy("evict", 2)()
+	srv := testServer()
+	public, _, _ := GenerateBoxKey(rand.Reader)
+	c := newConnection(srv, nil, public)
+	c.session = "s1"
+	srv.sessions[c.session] = c
+	srv.register(c)
+
+	evicted := connectionsEvicted.Value()
+	c.Send(&AnnounceConvoRound{Round: 1})
+	c.Send(&AnnounceConvoRound{Round: 2})
+	if isClosed(c) {
+		t.Fatalf("evicted before the queue was full")
+	}
+	c.Send(&AnnounceConvoRound{Round: 3})
+	if !isClosed(c) {
+		t.Fatalf("expecting the slow client to be evicted")
+	}
+	if n := connectionsEvicted.Value() - evicted; n != 1 {
+		t.Fatalf("expecting 1 eviction, got %d", n)
+	}
+	if len(srv.allConnections()) != 0 || len(srv.sessions) != 0 {
+		t.Fatalf("evicted client is still registered")
+	}
+
+	// Later messages and closes are no-ops.
+	c.Send(&AnnounceConvoRound{Round: 4})
+	c.Close()
+	if n := connectionsEvicted.Value() - evicted; n != 1 {
+		t.Fatalf("expecting 1 eviction, got %d", n)
+	}
+}
+
+func TestCloseRacesWriteLoop(t *testing.T) {
+	defer setSlowPolicy("evict", 4)()
+	srv := testServer()
+	conns := make(chan *connection, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		public, _, _ := GenerateBoxKey(rand.Reader)
+		c := newConnection(srv, ws, public)
+		srv.register(c)
+		conns <- c
+	}))
+	defer ts.Close()
+
+	for i := 0; i < 20; i++ {
+		client, _, err := websocket.DefaultDialer.Dial(strings.Replace(ts.URL, "http://", "ws://", 1), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := <-conns
+
+		writeDone := make(chan struct{})
+		go func() {
+			c.writeLoop()
+			close(writeDone)
+		}()
+
+		// Senders fill the queue (evicting the client) while others
+		// close it and the client goes away, all at once.
+		var wg sync.WaitGroup
+		for j := 0; j < 4; j++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				for k := uint32(0); k < 50; k++ {
+					c.Send(&AnnounceConvoRound{Round: k})
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				c.Close()
+			}()
+		}
+		client.Close()
+		wg.Wait()
+
+		select {
+		case <-writeDone:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("writeLoop didn't stop after Close")
+		}
+		if !isClosed(c) || len(srv.allConnections()) != 0 {
+			t.Fatalf("connection still open after Close")
+		}
+	}
+}
+
+func TestDialBucketRequestLimit(t *testing.T) {
+	defer setSlowPolicy("drop", 2*DialHistoryRounds)()
+	srv := testServer()
+	srv.dialHistory = make(map[uint32][][][SizeEncryptedIntro]byte)
+	srv.retainDialBuckets(5, make([][][SizeEncryptedIntro]byte, TotalDialBuckets))
+	public, _, _ := GenerateBoxKey(rand.Reader)
+	c := newConnection(srv, nil, public)
+	srv.register(c)
+
+	for i := 0; i < DialHistoryRounds; i++ {
+		c.handleDialBucketRequest(&DialBucketRequest{Round: 5})
+	}
+	if isClosed(c) || len(c.out) != DialHistoryRounds {
+		t.Fatalf("expecting %d buckets, got %d (closed=%v)", DialHistoryRounds, len(c.out), isClosed(c))
+	}
+
+	c.handleDialBucketRequest(&DialBucketRequest{Round: 5})
+	if !isClosed(c) || len(srv.allConnections()) != 0 {
+		t.Fatalf("expecting the client to be disconnected")
+	}
+	if len(c.out) != DialHistoryRounds {
+		t.Fatalf("bucket sent past the limit")
+	}
+}
+
+func TestRoundsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vuvuzela-entry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "entry.rounds")
+
+	f, err := openRoundsFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1000, 0)
+	if convo, dial := f.firstRounds(now); convo != 1000 || dial != 1000 {
+		t.Fatalf("expecting rounds from the clock, got %d and %d", convo, dial)
+	}
+
+	// Short rounds outrun the clock, so a restart picks up after them.
+	if err := f.reserve("convo", 5000); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.reserve("dial", 1200); err != nil {
+		t.Fatal(err)
+	}
+	f, err = openRoundsFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if convo, dial := f.firstRounds(now.Add(500 * time.Second)); convo != 5000 || dial != 1500 {
+		t.Fatalf("expecting rounds 5000 and 1500, got %d and %d", convo, dial)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"crypto/rand"
 	"encoding/json"
+	"expvar"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -11,12 +12,14 @@ import (
 	_ "net/http/pprof"
 	"net/rpc"
 	"runtime"
+	"strings"
 	"sync"
 
 	log "github.com/sirupsen/logrus"
 
 	. "github.com/davidlazar/vuvuzela"
 	. "github.com/davidlazar/vuvuzela/internal"
+	"github.com/davidlazar/vuvuzela/internal/workpool"
 	"github.com/davidlazar/vuvuzela/vrpc"
 )
 
@@ -24,6 +27,7 @@ var doInit = flag.Bool("init", false, "create default config file")
 var confPath = flag.String("conf", "", "config file")
 var pkiPath = flag.String("pki", "confs/pki.conf", "pki file")
 var muOverride = flag.Float64("mu", -1.0, "override ConvoMu in conf file")
+var workerAddr = flag.String("worker", "", "run as a decryption worker for the server in -conf, listening on this address")
 
 type Conf struct {
 	ServerName string
@@ -32,11 +36,47 @@ type Conf struct {
 	ListenAddr string `json:",omitempty"`
 	DebugAddr  string `json:",omitempty"`
 
+	// The first server signs round announcements with SigningKey.
+	// VerifyKey goes in the PKI.
+	VerifyKey  *VerifyKey  `json:",omitempty"`
+	SigningKey *SigningKey `json:",omitempty"`
+
 	ConvoMu float64
 	ConvoB  float64
 
 	DialMu float64
 	DialB  float64
+
+	// Mail is kept for the PKI's MailboxRounds.
+	MailboxMu float64 `json:",omitempty"`
+	MailboxB  float64 `json:",omitempty"`
+
+	// RoundsPath keeps the last round signed for each service, so a
+	// restarted server can't be made to sign an old round again
+	// (default: conf path with a .rounds extension).
+	RoundsPath string `json:",omitempty"`
+
+	// TranscriptPath enables the per-round transcript, which
+	// vuvuzela-verify checks against the neighboring servers'.
+	TranscriptPath string `json:",omitempty"`
+
+	// Every server but the first audits the previous server's noise.
+	// The audit warns if the average noise per round falls below these.
+	MinPrevConvoNoise float64 `json:",omitempty"`
+	MinPrevDialNoise  float64 `json:",omitempty"`
+
+	// Workers are the addresses of worker processes (vuvuzela-server
+	// -worker) that open onions for this server. Workers only answer
+	// this server, but they must still be reachable only over a private
+	// network.
+	Workers []string `json:",omitempty"`
+
+	// AdminAddr enables the admin RPC for vuvuzelactl. Calls must carry
+	// AdminToken. The RPC isn't encrypted, so AdminAddr must be loopback
+	// unless AdminRemote is set.
+	AdminAddr   string `json:",omitempty"`
+	AdminToken  string `json:",omitempty"`
+	AdminRemote bool   `json:",omitempty"`
 }
 
 func WriteDefaultConf(path string) {
@@ -44,10 +84,16 @@ func WriteDefaultConf(path string) {
 	if err != nil {
 		log.Fatalf("GenerateKey: %s", err)
 	}
+	verifyKey, signingKey, err := GenerateSigningKey(rand.Reader)
+	if err != nil {
+		log.Fatalf("GenerateSigningKey: %s", err)
+	}
 	conf := &Conf{
 		ServerName: "mit",
 		PublicKey:  myPublicKey,
 		PrivateKey: myPrivateKey,
+		VerifyKey:  verifyKey,
+		SigningKey: signingKey,
 	}
 
 	data, err := json.MarshalIndent(conf, "", "  ")
@@ -73,14 +119,30 @@ func main() {
 		return
 	}
 
-	pki := ReadPKI(*pkiPath)
-
 	conf := new(Conf)
 	ReadJSONFile(*confPath, conf)
 	if conf.ServerName == "" || conf.PublicKey == nil || conf.PrivateKey == nil {
 		log.Fatalf("missing required fields: %s", *confPath)
 	}
 
+	if *workerAddr != "" {
+		if err := rpc.Register(&WorkerService{PrivateKey: conf.PrivateKey}); err != nil {
+			log.Fatalf("rpc.Register: %s", err)
+		}
+		listen, err := net.Listen("tcp", *workerAddr)
+		if err != nil {
+			log.Fatal("Listen:", err)
+		}
+		rpc.Accept(listen)
+		return
+	}
+
+	pki := ReadPKI(*pkiPath)
+
+	if pki.Index(conf.ServerName) == 0 && conf.SigningKey == nil {
+		log.Warn("no SigningKey: clients can't verify round announcements")
+	}
+
 	if *muOverride >= 0 {
 		conf.ConvoMu = *muOverride
 	}
@@ -94,6 +156,43 @@ func main() {
 		}
 	}
 
+	var transcript *Transcript
+	if conf.TranscriptPath != "" {
+		if conf.SigningKey == nil {
+			log.Warn("no SigningKey: transcript entries will be unsigned")
+		}
+		transcript, err = OpenTranscript(conf.TranscriptPath, conf.ServerName, conf.SigningKey)
+		if err != nil {
+			log.Fatalf("OpenTranscript: %s", err)
+		}
+	}
+
+	roundsPath := conf.RoundsPath
+	if roundsPath == "" {
+		roundsPath = strings.TrimSuffix(*confPath, ".conf") + ".rounds"
+	}
+	signedRounds, err := OpenSignedRounds(roundsPath)
+	if err != nil {
+		log.Fatalf("OpenSignedRounds: %s", err)
+	}
+
+	var auditor *NoiseAuditor
+	if i := pki.Index(conf.ServerName); i > 0 {
+		prev := pki.ServerOrder[i-1]
+		auditor = NewNoiseAuditor(prev, pki.Servers[prev].VerifyKey)
+		auditor.SetPKI(pki)
+		auditor.MinMeanNoise["convo"] = conf.MinPrevConvoNoise
+		auditor.MinMeanNoise["dial"] = conf.MinPrevDialNoise
+	}
+
+	var workers *Workers
+	if len(conf.Workers) > 0 {
+		workers, err = DialWorkers(conf.Workers, conf.PrivateKey)
+		if err != nil {
+			log.Fatalf("DialWorkers: %s", err)
+		}
+	}
+
 	var idle sync.Mutex
 
 	convoService := &ConvoService{
@@ -102,12 +201,21 @@ func main() {
 		LaplaceMu: conf.ConvoMu,
 		LaplaceB:  conf.ConvoB,
 
+		MailboxMu:     conf.MailboxMu,
+		MailboxB:      conf.MailboxB,
+		MailboxRounds: pki.MailboxRounds,
+
 		PKI:        pki,
 		ServerName: conf.ServerName,
 		PrivateKey: conf.PrivateKey,
+		SigningKey: conf.SigningKey,
 
-		Client:     client,
-		LastServer: client == nil,
+		Client:       client,
+		LastServer:   client == nil,
+		Transcript:   transcript,
+		SignedRounds: signedRounds,
+		Auditor:      auditor,
+		Workers:      workers,
 	}
 	InitConvoService(convoService)
 
@@ -125,9 +233,14 @@ func main() {
 		PKI:        pki,
 		ServerName: conf.ServerName,
 		PrivateKey: conf.PrivateKey,
+		SigningKey: conf.SigningKey,
 
-		Client:     client,
-		LastServer: client == nil,
+		Client:       client,
+		LastServer:   client == nil,
+		Transcript:   transcript,
+		SignedRounds: signedRounds,
+		Auditor:      auditor,
+		Workers:      workers,
 	}
 	InitDialService(dialService)
 
@@ -137,14 +250,59 @@ func main() {
 	if err := rpc.Register(convoService); err != nil {
 		log.Fatalf("rpc.Register: %s", err)
 	}
+	transcriptService := &TranscriptService{
+		Transcript: transcript,
+		PKI:        pki,
+		ServerName: conf.ServerName,
+	}
+	if err := rpc.Register(transcriptService); err != nil {
+		log.Fatalf("rpc.Register: %s", err)
+	}
+	if err := rpc.Register(&NoiseService{Auditor: auditor}); err != nil {
+		log.Fatalf("rpc.Register: %s", err)
+	}
 
 	if conf.DebugAddr != "" {
+		// /debug/vars shows how the onion loops are using the CPUs.
+		expvar.Publish("WorkPool", expvar.Func(func() interface{} {
+			return workpool.Default.Stats()
+		}))
 		go func() {
 			log.Println(http.ListenAndServe(conf.DebugAddr, nil))
 		}()
 		runtime.SetBlockProfileRate(1)
 	}
 
+	if conf.AdminAddr != "" {
+		if conf.AdminToken == "" {
+			log.Fatalf("AdminAddr requires an AdminToken")
+		}
+		if err := CheckAdminAddr(conf.AdminAddr); err != nil {
+			if !conf.AdminRemote {
+				log.Fatalf("%s (set AdminRemote to allow it)", err)
+			}
+			log.Warnf("AdminRemote: %s; anyone on the path can take over this server", err)
+		}
+		admin := &ServerAdmin{
+			Token:   conf.AdminToken,
+			PKIPath: *pkiPath,
+			Convo:   convoService,
+			Dial:    dialService,
+			Auditor: auditor,
+
+			Transcripts: transcriptService,
+		}
+		adminServer := rpc.NewServer()
+		if err := adminServer.RegisterName("Admin", admin); err != nil {
+			log.Fatalf("rpc.Register: %s", err)
+		}
+		adminListen, err := net.Listen("tcp", conf.AdminAddr)
+		if err != nil {
+			log.Fatal("Listen:", err)
+		}
+		go adminServer.Accept(adminListen)
+	}
+
 	if conf.ListenAddr == "" {
 		conf.ListenAddr = DefaultServerAddr
 	}
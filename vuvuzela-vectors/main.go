@@ -0,0 +1,73 @@
+// Command vuvuzela-vectors writes the protocol test vectors as JSON.
+// The vectors checked in at conformance/testdata/vectors.json use the
+// default flags.
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/davidlazar/vuvuzela/conformance"
+)
+
+var seedHex = flag.String("seed", "", "32-byte seed in hex (default all zeros)")
+var numServers = flag.Int("servers", 3, "number of servers in the chain")
+var outPath = flag.String("o", "", "output file (default stdout)")
+var checkPath = flag.String("check", "", "check this implementation against a vectors file instead")
+
+func main() {
+	flag.Parse()
+
+	if *checkPath != "" {
+		v, err := conformance.ReadVectors(*checkPath)
+		if err != nil {
+			fatalf("%s", err)
+		}
+		errs := conformance.Check(v, conformance.Reference{})
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		if len(errs) > 0 {
+			fatalf("%d mismatches", len(errs))
+		}
+		fmt.Printf("%s: ok\n", *checkPath)
+		return
+	}
+
+	seed := make([]byte, 32)
+	if *seedHex != "" {
+		b, err := hex.DecodeString(*seedHex)
+		if err != nil || len(b) != 32 {
+			fatalf("-seed must be 32 bytes of hex")
+		}
+		seed = b
+	}
+	if *numServers < 1 {
+		fatalf("-servers must be at least 1")
+	}
+
+	v := conformance.Generate(seed, *numServers)
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		fatalf("json encoding error: %s", err)
+	}
+	data = append(data, '\n')
+
+	if *outPath == "" {
+		os.Stdout.Write(data)
+		return
+	}
+	if err := ioutil.WriteFile(*outPath, data, 0644); err != nil {
+		fatalf("%s", err)
+	}
+	fmt.Fprintf(os.Stderr, "wrote %q\n", *outPath)
+}
+
+func fatalf(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, "vuvuzela-vectors: "+format+"\n", v...)
+	os.Exit(1)
+}
@@ -0,0 +1,48 @@
+// Command vuvuzela-verify checks server transcripts against each other.
+// Pass the transcript of every server you have; each transcript also
+// holds its neighbors' signed entries, so even one can be checked.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	. "github.com/davidlazar/vuvuzela"
+)
+
+var pkiPath = flag.String("pki", "confs/pki.conf", "pki file")
+
+func main() {
+	flag.Parse()
+	if flag.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "usage: vuvuzela-verify [-pki file] transcript...\n")
+		os.Exit(2)
+	}
+
+	pki := ReadPKI(*pkiPath)
+	var logs [][]*TranscriptRecord
+	entries := 0
+	for _, path := range flag.Args() {
+		records, err := ReadTranscript(path)
+		if err != nil {
+			fatalf("%s", err)
+		}
+		logs = append(logs, records)
+		entries += len(records)
+	}
+
+	errs := CheckTranscripts(pki, logs)
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if len(errs) > 0 {
+		fatalf("%d problems", len(errs))
+	}
+	fmt.Printf("ok: %d records in %d transcripts\n", entries, len(logs))
+}
+
+func fatalf(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, "vuvuzela-verify: "+format+"\n", v...)
+	os.Exit(1)
+}
@@ -2,7 +2,10 @@ package vuvuzela
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/binary"
+	"fmt"
 	"unsafe"
 
 	"golang.org/x/crypto/nacl/box"
@@ -19,8 +22,21 @@ const (
 	SizeDialExchange     = int(unsafe.Sizeof(DialExchange{}))
 )
 
+type ExchangeMode uint8
+
+const (
+	// ExchangeSwap swaps messages with whoever else accesses the dead drop
+	// this round, or picks up mail left in it by an earlier deposit.
+	ExchangeSwap ExchangeMode = iota
+
+	// ExchangeDeposit leaves the message in the dead drop's mailbox on
+	// the last server for a later ExchangeSwap to pick up.
+	ExchangeDeposit
+)
+
 type ConvoExchange struct {
 	DeadDrop         DeadDrop
+	Mode             ExchangeMode
 	EncryptedMessage [SizeEncryptedMessage]byte
 }
 
@@ -38,8 +54,23 @@ func (e *ConvoExchange) Unmarshal(data []byte) error {
 }
 
 type Introduction struct {
+	// Rendezvous is the convo round the conversation schedule starts
+	// from (not a dial round).
 	Rendezvous  uint32
 	LongTermKey BoxKey
+
+	// ScheduleDelay is the most rounds after Rendezvous that the
+	// conversation may start, chosen by the caller so both sides derive
+	// the same schedule.
+	ScheduleDelay uint32
+
+	// Note is a short message from the caller, such as why they are
+	// calling, padded with zeros.
+	Note [SizeIntroNote]byte
+}
+
+func (i *Introduction) NoteText() string {
+	return string(bytes.TrimRight(i.Note[:], "\x00"))
 }
 
 func (i *Introduction) Marshal() []byte {
@@ -52,7 +83,13 @@ func (i *Introduction) Marshal() []byte {
 
 func (i *Introduction) Unmarshal(data []byte) error {
 	buf := bytes.NewReader(data)
-	return binary.Read(buf, binary.BigEndian, i)
+	if err := binary.Read(buf, binary.BigEndian, i); err != nil {
+		return err
+	}
+	if i.ScheduleDelay > MaxScheduleDelay {
+		return fmt.Errorf("schedule delay too long: %d rounds", i.ScheduleDelay)
+	}
+	return nil
 }
 
 type DialExchange struct {
@@ -90,3 +127,45 @@ func BackwardNonce(round uint32) *[24]byte {
 func KeyDialBucket(key *BoxKey, buckets uint32) uint32 {
 	return binary.BigEndian.Uint32(key[28:32]) % buckets
 }
+
+// ConvoRole is 0 for the peer with the smaller public key and 1 for the
+// other, so that messages in each direction have distinct nonces.
+func ConvoRole(myPublicKey, peerPublicKey *BoxKey) byte {
+	if bytes.Compare(myPublicKey[:], peerPublicKey[:]) < 0 {
+		return 0
+	}
+	return 1
+}
+
+// ConvoNonce is the nonce for a message sealed by the peer with role.
+func ConvoNonce(round uint32, role byte) *[24]byte {
+	var nonce [24]byte
+	binary.BigEndian.PutUint32(nonce[:], round)
+	nonce[23] = role
+	return &nonce
+}
+
+// ConvoDeadDrop is where two peers exchange messages in round.
+func ConvoDeadDrop(myPrivateKey, peerPublicKey *BoxKey, round uint32) (id DeadDrop) {
+	var sharedKey [32]byte
+	box.Precompute(&sharedKey, peerPublicKey.Key(), myPrivateKey.Key())
+
+	h := hmac.New(sha256.New, sharedKey[:])
+	binary.Write(h, binary.BigEndian, round)
+	copy(id[:], h.Sum(nil))
+	return
+}
+
+// MailboxDeadDrop is where the peer with senderRole leaves mail for the
+// other during the given window.
+func MailboxDeadDrop(myPrivateKey, peerPublicKey *BoxKey, senderRole byte, window uint32) (id DeadDrop) {
+	var sharedKey [32]byte
+	box.Precompute(&sharedKey, peerPublicKey.Key(), myPrivateKey.Key())
+
+	h := hmac.New(sha256.New, sharedKey[:])
+	h.Write([]byte("mailbox"))
+	h.Write([]byte{senderRole})
+	binary.Write(h, binary.BigEndian, window)
+	copy(id[:], h.Sum(nil))
+	return
+}
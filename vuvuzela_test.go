@@ -1,10 +1,83 @@
 package vuvuzela
 
 import (
+	"crypto/rand"
+	"encoding/json"
 	"testing"
+	"unsafe"
+
+	"github.com/davidlazar/vuvuzela/onionbox"
 )
 
 func TestDialExchangeMarshal(t *testing.T) {
 	ex := new(DialExchange)
 	_ = ex.Marshal()
 }
+
+func TestIntroductionSize(t *testing.T) {
+	// The wire size must match the in-memory size that SizeEncryptedIntro
+	// is derived from, or the note won't fit in fake introductions.
+	intro := &Introduction{Rendezvous: 7}
+	copy(intro.Note[:], "hello")
+	if n := len(intro.Marshal()); n != int(unsafe.Sizeof(Introduction{})) {
+		t.Fatalf("introduction marshals to %d bytes, expecting %d", n, unsafe.Sizeof(Introduction{}))
+	}
+	if intro.NoteText() != "hello" {
+		t.Fatalf("unexpected note: %q", intro.NoteText())
+	}
+
+	keys := genKeys(2)
+	noise := make([][]byte, 3)
+	FillWithFakeIntroductions(noise, []int{3}, new([24]byte), keys)
+	for _, onion := range noise {
+		if len(onion) != 2*onionbox.Overhead+SizeDialExchange {
+			t.Fatalf("fake introduction is %d bytes", len(onion))
+		}
+	}
+}
+
+func TestSignedAnnouncement(t *testing.T) {
+	verifyKey, signingKey, err := GenerateSigningKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(signingKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xsigningKey := new(SigningKey)
+	if err := json.Unmarshal(data, xsigningKey); err != nil {
+		t.Fatal(err)
+	}
+
+	var round uint32 = 1000
+	sig := signRound(xsigningKey, 7, func(ts int64) []byte {
+		return ConvoRoundMessage(round, 7, ts)
+	})
+	a := &AnnounceConvoRound{
+		Round:     round,
+		Epoch:     sig.Epoch,
+		Timestamp: sig.Timestamp,
+		Signature: sig.Signature,
+	}
+	if !a.Verify(verifyKey) {
+		t.Fatalf("failed to verify announcement")
+	}
+
+	a.Round--
+	if a.Verify(verifyKey) {
+		t.Fatalf("verified announcement with a different round")
+	}
+
+	d := &AnnounceDialRound{
+		Round:     round,
+		Buckets:   TotalDialBuckets,
+		Epoch:     sig.Epoch,
+		Timestamp: sig.Timestamp,
+		Signature: sig.Signature,
+	}
+	if d.Verify(verifyKey) {
+		t.Fatalf("convo signature verified as a dial announcement")
+	}
+}
@@ -0,0 +1,156 @@
+// Command vuvuzelactl controls a running vuvuzela-server or
+// vuvuzela-entry-server through its admin RPC.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/rpc"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	. "github.com/davidlazar/vuvuzela"
+)
+
+var addr = flag.String("addr", "localhost:2721", "admin RPC address")
+var tokenPath = flag.String("token", "", "file containing the admin token (default $VUVUZELA_ADMIN_TOKEN)")
+
+const usage = `usage: vuvuzelactl [flags] <command> [args]
+
+commands:
+  pause [convo|dial]             stop starting new rounds
+  resume [convo|dial]            start rounds again
+  rounds                         list open rounds
+  abort <convo|dial> <round>     abort a stuck round
+  clients                        count connected clients (entry server)
+  setnoise <convo|dial|mailbox> <mu> <b>
+                                 change noise for the next round (mix server)
+  reload                         reload the PKI file
+  noiseaudit                     show the audit of the previous server's noise
+
+flags:
+`
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	args := &AdminArgs{
+		Token: readToken(),
+	}
+	method, err := parseCommand(flag.Args(), args)
+	if err != nil {
+		fatalf("%s", err)
+	}
+
+	client, err := rpc.Dial("tcp", *addr)
+	if err != nil {
+		fatalf("dial %s: %s", *addr, err)
+	}
+	defer client.Close()
+
+	reply := new(AdminReply)
+	if err := client.Call("Admin."+method, args, reply); err != nil {
+		fatalf("%s: %s", method, err)
+	}
+	printReply(method, reply)
+}
+
+func parseCommand(argv []string, args *AdminArgs) (method string, err error) {
+	cmd, rest := argv[0], argv[1:]
+	switch cmd {
+	case "pause", "resume":
+		if len(rest) > 1 {
+			return "", fmt.Errorf("usage: %s [convo|dial]", cmd)
+		}
+		if len(rest) == 1 {
+			args.Service = rest[0]
+		}
+		if cmd == "pause" {
+			return "Pause", nil
+		}
+		return "Resume", nil
+	case "rounds":
+		return "Rounds", nil
+	case "clients":
+		return "Clients", nil
+	case "abort":
+		if len(rest) != 2 {
+			return "", fmt.Errorf("usage: abort <convo|dial> <round>")
+		}
+		round, err := strconv.ParseUint(rest[1], 10, 32)
+		if err != nil {
+			return "", fmt.Errorf("bad round: %s", err)
+		}
+		args.Service = rest[0]
+		args.Round = uint32(round)
+		return "Abort", nil
+	case "setnoise":
+		if len(rest) != 3 {
+			return "", fmt.Errorf("usage: setnoise <convo|dial|mailbox> <mu> <b>")
+		}
+		args.Service = rest[0]
+		if args.Mu, err = strconv.ParseFloat(rest[1], 64); err != nil {
+			return "", fmt.Errorf("bad mu: %s", err)
+		}
+		if args.B, err = strconv.ParseFloat(rest[2], 64); err != nil {
+			return "", fmt.Errorf("bad b: %s", err)
+		}
+		return "SetNoise", nil
+	case "reload":
+		return "ReloadPKI", nil
+	case "noiseaudit":
+		return "NoiseAudit", nil
+	}
+	return "", fmt.Errorf("unknown command: %q", cmd)
+}
+
+func readToken() string {
+	if *tokenPath == "" {
+		return os.Getenv("VUVUZELA_ADMIN_TOKEN")
+	}
+	data, err := ioutil.ReadFile(*tokenPath)
+	if err != nil {
+		fatalf("reading token: %s", err)
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func printReply(method string, reply *AdminReply) {
+	switch method {
+	case "Rounds":
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "SERVICE\tROUND\tSTATUS\tONIONS")
+		for _, r := range reply.Rounds {
+			fmt.Fprintf(w, "%s\t%d\t%s\t%d\n", r.Service, r.Round, r.Status, r.Onions)
+		}
+		w.Flush()
+	case "Clients":
+		fmt.Printf("%d clients\n", reply.Clients)
+	case "NoiseAudit":
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "SERVICE\tSERVER\tROUNDS\tFAILURES\tMEAN NOISE\tLAST PROBLEM")
+		for _, s := range reply.NoiseAudit {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%.1f\t%s\n", s.Service, s.Server, s.Rounds, s.Failures, s.MeanNoise(), s.LastProblem)
+		}
+		w.Flush()
+	}
+	if reply.Message != "" {
+		fmt.Println(reply.Message)
+	}
+}
+
+func fatalf(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, "vuvuzelactl: "+format+"\n", v...)
+	os.Exit(1)
+}
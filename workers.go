@@ -0,0 +1,256 @@
+package vuvuzela
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/nacl/box"
+
+	. "github.com/davidlazar/vuvuzela/internal"
+	"github.com/davidlazar/vuvuzela/internal/workpool"
+	"github.com/davidlazar/vuvuzela/vrpc"
+)
+
+// A WorkerService opens onions for a chain position that has more of them
+// than one machine can handle. The position's coordinator (the server in
+// the PKI) hands each batch of onions to its Workers, which share its
+// private key. Everything else about a round, including the noise and the
+// shuffle, stays on the coordinator.
+//
+// Every call carries a MAC keyed from the private key, so only the
+// coordinator can use a worker, and a worker only opens onions for
+// rounds the coordinator has begun. Workers still see which onion became
+// which message, so the link between a coordinator and its workers must
+// be private.
+type WorkerService struct {
+	PrivateKey *BoxKey
+
+	mu     sync.Mutex
+	begun  map[string]map[uint32]bool
+	newest map[string]uint32
+}
+
+// Workers forget a round once this many newer rounds have begun.
+const workerRoundsKept = 8
+
+type WorkerBeginArgs struct {
+	Service string
+	Round   uint32
+	MAC     []byte
+}
+
+type WorkerOpenArgs struct {
+	Service   string
+	Round     uint32
+	OnionSize int
+	Onions    [][]byte
+
+	// Keys asks for the shared keys, which the coordinator needs to
+	// seal convo replies.
+	Keys bool
+
+	MAC []byte
+}
+
+type WorkerOpenResult struct {
+	// Messages is empty where the onion didn't open.
+	Messages [][]byte
+	Keys     [][32]byte
+}
+
+func workerKey(privateKey *BoxKey) []byte {
+	h := sha256.New()
+	h.Write([]byte("vuvuzela worker"))
+	h.Write(privateKey[:])
+	return h.Sum(nil)
+}
+
+func workerMAC(key []byte, op string, service string, round uint32, onionSize int, onions [][]byte, keys bool) []byte {
+	mac := hmac.New(sha256.New, key)
+	var b [8]byte
+	for _, s := range []string{op, service} {
+		binary.BigEndian.PutUint64(b[:], uint64(len(s)))
+		mac.Write(b[:])
+		mac.Write([]byte(s))
+	}
+	binary.BigEndian.PutUint32(b[:4], round)
+	mac.Write(b[:4])
+	binary.BigEndian.PutUint64(b[:], uint64(onionSize))
+	mac.Write(b[:])
+	if keys {
+		mac.Write([]byte{1})
+	} else {
+		mac.Write([]byte{0})
+	}
+	binary.BigEndian.PutUint64(b[:], uint64(len(onions)))
+	mac.Write(b[:])
+	for _, onion := range onions {
+		binary.BigEndian.PutUint64(b[:], uint64(len(onion)))
+		mac.Write(b[:])
+		mac.Write(onion)
+	}
+	return mac.Sum(nil)
+}
+
+func (w *WorkerService) Begin(args *WorkerBeginArgs, _ *struct{}) error {
+	log.WithFields(log.Fields{"service": "worker", "rpc": "Begin", "round": args.Round}).Info()
+
+	mac := workerMAC(workerKey(w.PrivateKey), "begin", args.Service, args.Round, 0, nil, false)
+	if !hmac.Equal(mac, args.MAC) {
+		return fmt.Errorf("bad MAC")
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.begun == nil {
+		w.begun = make(map[string]map[uint32]bool)
+		w.newest = make(map[string]uint32)
+	}
+	rounds := w.begun[args.Service]
+	if rounds == nil {
+		rounds = make(map[uint32]bool)
+		w.begun[args.Service] = rounds
+	}
+	rounds[args.Round] = true
+	if args.Round > w.newest[args.Service] {
+		w.newest[args.Service] = args.Round
+	}
+	for r := range rounds {
+		if r+workerRoundsKept < w.newest[args.Service] {
+			delete(rounds, r)
+		}
+	}
+	return nil
+}
+
+func (w *WorkerService) Open(args *WorkerOpenArgs, result *WorkerOpenResult) error {
+	log.WithFields(log.Fields{"service": "worker", "rpc": "Open", "round": args.Round, "onions": len(args.Onions)}).Debug()
+
+	mac := workerMAC(workerKey(w.PrivateKey), "open", args.Service, args.Round, args.OnionSize, args.Onions, args.Keys)
+	if !hmac.Equal(mac, args.MAC) {
+		return fmt.Errorf("bad MAC")
+	}
+	if args.Keys && args.Service != "convo" {
+		return fmt.Errorf("%s rounds don't need shared keys", args.Service)
+	}
+	w.mu.Lock()
+	begun := w.begun[args.Service][args.Round]
+	w.mu.Unlock()
+	if !begun {
+		return fmt.Errorf("%s round %d has not begun", args.Service, args.Round)
+	}
+
+	nonce := ForwardNonce(args.Round)
+	result.Messages = make([][]byte, len(args.Onions))
+	if args.Keys {
+		result.Keys = make([][32]byte, len(args.Onions))
+	}
+	workpool.For("worker/open", len(args.Onions), func(i int) {
+		onion := args.Onions[i]
+		if len(onion) != args.OnionSize || len(onion) < 32 {
+			return
+		}
+		var theirPublic, sharedKey [32]byte
+		copy(theirPublic[:], onion[0:32])
+
+		box.Precompute(&sharedKey, &theirPublic, w.PrivateKey.Key())
+		if message, ok := box.OpenAfterPrecomputation(nil, onion[32:], nonce, &sharedKey); ok {
+			result.Messages[i] = message
+		}
+		if args.Keys {
+			result.Keys[i] = sharedKey
+		}
+	})
+	return nil
+}
+
+// Workers spreads the onions in each Add call across a coordinator's
+// workers.
+type Workers struct {
+	Clients []*vrpc.Client
+
+	key []byte
+
+	// rotates the first worker so small batches don't all go to one
+	next uint32
+}
+
+func DialWorkers(addrs []string, privateKey *BoxKey) (*Workers, error) {
+	w := &Workers{key: workerKey(privateKey)}
+	for _, addr := range addrs {
+		client, err := vrpc.Dial("tcp", addr, 1)
+		if err != nil {
+			return nil, fmt.Errorf("worker %s: %s", addr, err)
+		}
+		w.Clients = append(w.Clients, client)
+	}
+	return w, nil
+}
+
+// Begin lets the workers open onions for round.
+func (w *Workers) Begin(service string, round uint32) error {
+	args := &WorkerBeginArgs{
+		Service: service,
+		Round:   round,
+		MAC:     workerMAC(w.key, "begin", service, round, 0, nil, false),
+	}
+	for _, c := range w.Clients {
+		if err := c.Call("WorkerService.Begin", args, nil); err != nil {
+			return fmt.Errorf("WorkerService.Begin: %s", err)
+		}
+	}
+	return nil
+}
+
+func (w *Workers) Open(service string, round uint32, onionSize int, onions [][]byte, keys bool) (*WorkerOpenResult, error) {
+	merged := &WorkerOpenResult{
+		Messages: make([][]byte, 0, len(onions)),
+	}
+	if len(onions) == 0 {
+		return merged, nil
+	}
+
+	n := len(w.Clients)
+	spans := Spans(len(onions), (len(onions)+n-1)/n)
+	first := int(atomic.AddUint32(&w.next, 1))
+	results := make([]*WorkerOpenResult, len(spans))
+	errs := make(chan error, len(spans))
+	for i, span := range spans {
+		go func(i int, span Span) {
+			args := &WorkerOpenArgs{
+				Service:   service,
+				Round:     round,
+				OnionSize: onionSize,
+				Onions:    onions[span.Start : span.Start+span.Count],
+				Keys:      keys,
+			}
+			args.MAC = workerMAC(w.key, "open", service, round, onionSize, args.Onions, keys)
+			results[i] = new(WorkerOpenResult)
+			errs <- w.Clients[(first+i)%n].Call("WorkerService.Open", args, results[i])
+		}(i, span)
+	}
+
+	var err error
+	for range spans {
+		if e := <-errs; e != nil {
+			err = e
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("WorkerService.Open: %s", err)
+	}
+
+	for i, r := range results {
+		if len(r.Messages) != spans[i].Count || (keys && len(r.Keys) != spans[i].Count) {
+			return nil, fmt.Errorf("WorkerService.Open: worker returned %d messages for %d onions", len(r.Messages), spans[i].Count)
+		}
+		merged.Messages = append(merged.Messages, r.Messages...)
+		merged.Keys = append(merged.Keys, r.Keys...)
+	}
+	return merged, nil
+}
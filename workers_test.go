@@ -0,0 +1,177 @@
+package vuvuzela
+
+import (
+	"crypto/rand"
+	"net"
+	"net/rpc"
+	"sync"
+	"testing"
+)
+
+func startWorker(t *testing.T, privateKey *BoxKey) string {
+	server := rpc.NewServer()
+	if err := server.Register(&WorkerService{PrivateKey: privateKey}); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Accept(l)
+	return l.Addr().String()
+}
+
+func TestConvoWorkers(t *testing.T) {
+	pki, privateKeys := testChain(t, 1)
+	workers, err := DialWorkers([]string{startWorker(t, privateKeys[0]), startWorker(t, privateKeys[0])}, privateKeys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var idle sync.Mutex
+	srv := &ConvoService{
+		Idle:       &idle,
+		PKI:        pki,
+		ServerName: "a",
+		PrivateKey: privateKeys[0],
+		LastServer: true,
+		Workers:    workers,
+	}
+	InitConvoService(srv)
+
+	const round = 9
+	var probes []*ConvoProbe
+	var onions [][]byte
+	for i := 0; i < 5; i++ {
+		p := NewConvoProbe(pki, round)
+		probes = append(probes, p)
+		onions = append(onions, p.Onion)
+	}
+	garbage := make([]byte, len(onions[0]))
+	rand.Read(garbage)
+	onions = append(onions, garbage, []byte("short"))
+
+	if err := srv.NewRound(round, new(RoundSignature)); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Open(&ConvoOpenArgs{Round: round, NumIncoming: len(onions)}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Add(&ConvoAddArgs{Round: round, Onions: onions[:3]}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Add(&ConvoAddArgs{Round: round, Offset: 3, Onions: onions[3:]}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Close(round, nil); err != nil {
+		t.Fatal(err)
+	}
+	result := new(ConvoGetResult)
+	if err := srv.Get(&ConvoGetArgs{Round: round, Count: len(onions)}, result); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, p := range probes {
+		if err := p.Check(result.Onions[i]); err != nil {
+			t.Fatalf("probe %d: %s", i, err)
+		}
+	}
+	if len(result.Onions[5]) != len(result.Onions[0]) || len(result.Onions[6]) != len(result.Onions[0]) {
+		t.Fatalf("expecting random replies for onions that don't open")
+	}
+}
+
+func TestWorkerAuth(t *testing.T) {
+	pki, privateKeys := testChain(t, 1)
+	addr := startWorker(t, privateKeys[0])
+	workers, err := DialWorkers([]string{addr}, privateKeys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherKey, _ := GenerateBoxKey(rand.Reader)
+	impostor, err := DialWorkers([]string{addr}, otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewConvoProbe(pki, 10)
+	onions := [][]byte{p.Onion}
+	size := len(p.Onion)
+
+	if _, err := workers.Open("convo", 10, size, onions, true); err == nil {
+		t.Fatalf("expecting Open to fail before the round has begun")
+	}
+	if err := impostor.Begin("convo", 10); err == nil {
+		t.Fatalf("expecting Begin with the wrong key to fail")
+	}
+	if err := workers.Begin("convo", 10); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := impostor.Open("convo", 10, size, onions, true); err == nil {
+		t.Fatalf("expecting Open with the wrong key to fail")
+	}
+	if _, err := workers.Open("dial", 10, size, onions, false); err == nil {
+		t.Fatalf("expecting Open to fail for a round begun by another service")
+	}
+
+	// A tampered request doesn't match its MAC.
+	args := &WorkerOpenArgs{Service: "convo", Round: 10, OnionSize: size, Onions: onions, Keys: true}
+	args.MAC = workerMAC(workerKey(privateKeys[0]), "open", "convo", 10, size, nil, true)
+	if err := workers.Clients[0].Call("WorkerService.Open", args, new(WorkerOpenResult)); err == nil {
+		t.Fatalf("expecting Open with a mismatched MAC to fail")
+	}
+
+	result, err := workers.Open("convo", 10, size, onions, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Messages[0]) == 0 {
+		t.Fatalf("expecting the onion to open")
+	}
+
+	for r := uint32(11); r <= 11+workerRoundsKept; r++ {
+		if err := workers.Begin("convo", r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := workers.Open("convo", 10, size, onions, true); err == nil {
+		t.Fatalf("expecting old rounds to be forgotten")
+	}
+}
+
+func TestWorkerBeginFails(t *testing.T) {
+	pki, privateKeys := testChain(t, 1)
+	addr := startWorker(t, privateKeys[0])
+	_, otherKey, _ := GenerateBoxKey(rand.Reader)
+	broken, err := DialWorkers([]string{addr}, otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := OpenSignedRounds("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var idle sync.Mutex
+	srv := &DialService{
+		Idle:         &idle,
+		PKI:          pki,
+		ServerName:   "a",
+		PrivateKey:   privateKeys[0],
+		LastServer:   true,
+		SignedRounds: signed,
+		Workers:      broken,
+	}
+	InitDialService(srv)
+
+	if err := srv.NewRound(5, new(RoundSignature)); err == nil {
+		t.Fatalf("expecting NewRound to fail when the workers do")
+	}
+	srv.Workers, err = DialWorkers([]string{addr}, privateKeys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.NewRound(5, new(RoundSignature)); err != nil {
+		t.Fatalf("round burned by a failed NewRound: %s", err)
+	}
+}